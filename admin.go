@@ -0,0 +1,305 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+	log "github.com/sirupsen/logrus"
+)
+
+type adminServer struct {
+	addr      string
+	mgr       *ResourceManager
+	rtrServer *rtrServer
+	mux       *http.ServeMux
+}
+
+func newAdminServer(addr string, mgr *ResourceManager) *adminServer {
+	s := &adminServer{
+		addr: addr,
+		mgr:  mgr,
+		mux:  http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/inject-error", s.handleInjectError)
+	s.mux.HandleFunc("/slurm", s.handleSLURM)
+	s.mux.HandleFunc("/delta", s.handleDelta)
+	s.mux.HandleFunc("/promote", s.handlePromote)
+	s.mux.HandleFunc("/raw", s.handleRaw)
+	s.mux.HandleFunc("/retry-interval", s.handleRetryInterval)
+	s.mux.HandleFunc("/roas", s.handleROAs)
+	s.mux.HandleFunc("/session-stats", s.handleSessionStats)
+	s.mux.HandleFunc("/status", s.handleStatus)
+	s.mux.Handle("/debug/vars", expvar.Handler())
+	return s
+}
+
+func (s *adminServer) run() {
+	err := http.ListenAndServe(s.addr, s.mux)
+	checkError(err)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+type injectErrorStatus struct {
+	Code      uint16 `json:"code"`
+	Remaining int    `json:"remaining"`
+}
+
+// handleInjectError shows or configures the Error Report PDU which is sent
+// instead of the response to the next N queries.
+// eg. curl -d code=1 -d count=3 http://127.0.0.1:8323/inject-error
+func (s *adminServer) handleInjectError(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		code, err := strconv.ParseUint(req.FormValue("code"), 10, 16)
+		if err != nil {
+			http.Error(w, "invalid code: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		count, err := strconv.Atoi(req.FormValue("count"))
+		if err != nil || count < 0 {
+			http.Error(w, "invalid count", http.StatusBadRequest)
+			return
+		}
+		injector.set(uint16(code), count)
+		log.Infof("Error injection configured (ErrorCode: %v, Count: %v)", code, count)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	code, remaining := injector.status()
+	writeJSON(w, &injectErrorStatus{Code: code, Remaining: remaining})
+}
+
+// handleSLURM exports the current ROAs as prefixAssertions of a SLURM file.
+// eg. curl http://127.0.0.1:8323/slurm > snapshot.slurm
+func (s *adminServer) handleSLURM(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, newSLURM(s.mgr.CurrentList()))
+}
+
+type deltaResponse struct {
+	Serial uint32 `json:"serial"`
+	// CacheReset is set if the serial has been expired, so that a router at
+	// the serial would receive Cache Reset PDU instead of the delta.
+	CacheReset bool                    `json:"cache_reset"`
+	Announced  []*slurmPrefixAssertion `json:"announced"`
+	Withdrawn  []*slurmPrefixAssertion `json:"withdrawn"`
+}
+
+// handleDelta shows ROAs which a router at the serial would receive by Serial
+// Query.
+// eg. curl http://127.0.0.1:8323/delta?serial=1546300800
+func (s *adminServer) handleDelta(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sn, err := strconv.ParseUint(req.FormValue("serial"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid serial: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	trans := s.mgr.BeginTransaction()
+	defer trans.EndTransaction()
+	res := &deltaResponse{Serial: trans.CurrentSerial()}
+	if !trans.HasKey(uint32(sn)) {
+		res.CacheReset = true
+		writeJSON(w, res)
+		return
+	}
+	lists := trans.DeltaList(uint32(sn))
+	res.Announced = slurmPrefixAssertions(lists, rtr.ANNOUNCEMENT)
+	res.Withdrawn = slurmPrefixAssertions(lists, rtr.WITHDRAWAL)
+	writeJSON(w, res)
+}
+
+// handlePromote makes the RTR server in standby mode start accepting
+// connections.
+// eg. curl -X POST http://127.0.0.1:8323/promote
+func (s *adminServer) handlePromote(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.rtrServer == nil {
+		http.Error(w, "RTR server is not running", http.StatusServiceUnavailable)
+		return
+	}
+	s.rtrServer.promote()
+	log.Infof("Promoted by the admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRaw shows a source as read last, before ROAs are filtered, or the
+// list of sources without the source parameter.
+// eg. curl http://127.0.0.1:8323/raw?source=/path/to/irr.db
+func (s *adminServer) handleRaw(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	source := req.FormValue("source")
+	if source == "" {
+		sources := rawSources.sources()
+		sort.Strings(sources)
+		writeJSON(w, sources)
+		return
+	}
+	p := rawSources.get(source)
+	if p == nil {
+		http.Error(w, "unknown source", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	// The cached copy is cut at --raw-cache-size
+	w.Header().Set("X-Raw-Size", strconv.Itoa(p.size))
+	w.Header().Set("X-Raw-Truncated", strconv.FormatBool(p.truncated))
+	w.Write(p.data)
+}
+
+type retryIntervalResponse struct {
+	RetryInterval int `json:"retry_interval"`
+	// Overridden is set if the interval has been changed from
+	// --retry-interval
+	Overridden bool `json:"overridden"`
+}
+
+// handleRetryInterval shows or changes the Retry Interval sent in End of Data
+// PDUs of version 1 from now on, eg. to make routers back off while the cache
+// is under stress. 0 restores --retry-interval.
+// eg. curl -d seconds=1800 http://127.0.0.1:8323/retry-interval
+func (s *adminServer) handleRetryInterval(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		seconds, err := strconv.Atoi(req.FormValue("seconds"))
+		if err != nil || seconds < 0 {
+			http.Error(w, "invalid seconds", http.StatusBadRequest)
+			return
+		}
+		if seconds > 0 {
+			if err := checkTimers(commandOpts.Refresh, seconds, commandOpts.Expire); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		atomic.StoreInt32(&retryOverride, int32(seconds))
+		log.Infof("Retry Interval changed to %v by the admin API", retryInterval())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, &retryIntervalResponse{
+		RetryInterval: retryInterval(),
+		Overridden:    atomic.LoadInt32(&retryOverride) > 0,
+	})
+}
+
+type roasResponse struct {
+	Serial uint32                  `json:"serial"`
+	ROAs   []*slurmPrefixAssertion `json:"roas"`
+}
+
+// handleROAs shows the ROAs which the cache serves now with the serial of
+// them.
+// eg. curl http://127.0.0.1:8323/roas
+func (s *adminServer) handleROAs(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	trans := s.mgr.BeginTransaction()
+	defer trans.EndTransaction()
+	writeJSON(w, &roasResponse{
+		Serial: trans.CurrentSerial(),
+		ROAs:   slurmPrefixAssertions(trans.CurrentList(), rtr.ANNOUNCEMENT),
+	})
+}
+
+// handleSessionStats shows the counters of the session with the router, or
+// resets them to measure a fresh window without reconnecting the router.
+// Without the peer parameter, it shows the counters of all sessions.
+// eg. curl -X DELETE http://127.0.0.1:8323/session-stats?peer=192.0.2.1:49152
+func (s *adminServer) handleSessionStats(w http.ResponseWriter, req *http.Request) {
+	if req.FormValue("peer") == "" && req.Method == http.MethodGet {
+		all := map[string]*sessionStats{}
+		for _, r := range sessions.all() {
+			all[r.remoteAddr.String()] = r.loadStats()
+		}
+		writeJSON(w, all)
+		return
+	}
+	r := sessions.lookup(req.FormValue("peer"))
+	if r == nil {
+		http.Error(w, "unknown peer", http.StatusNotFound)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		r.resetStats()
+		log.Infof("Statistics of the session with %v were reset (ID: %v)", r.remoteAddr, r.sessionId)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r.loadStats())
+}
+
+type statusResponse struct {
+	StartedAt  time.Time `json:"started_at"`
+	Uptime     string    `json:"uptime"`
+	Serial     uint32    `json:"serial"`
+	ReloadedAt time.Time `json:"reloaded_at"`
+	Sources    []string  `json:"sources"`
+	// ContentHash is the same among caches serving the same data
+	ContentHash string `json:"content_hash,omitempty"`
+}
+
+// handleStatus shows when the process started, and when and from where the
+// current ROAs were loaded, to confirm that the cache is refreshed.
+// eg. curl http://127.0.0.1:8323/status
+func (s *adminServer) handleStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := s.mgr.Status()
+	writeJSON(w, &statusResponse{
+		StartedAt:   startedAt,
+		Uptime:      time.Since(startedAt).Round(time.Second).String(),
+		Serial:      status.Serial,
+		ReloadedAt:  status.ReloadedAt,
+		Sources:     status.Sources,
+		ContentHash: status.Hash,
+	})
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminInjectError(t *testing.T) {
+	assert := assert.New(t)
+	s := newAdminServer("", nil)
+	defer injector.set(0, 0)
+
+	form := url.Values{"code": {"1"}, "count": {"2"}}
+	req := httptest.NewRequest(http.MethodPost, "/inject-error", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, req)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(`{"code":1,"remaining":2}`, w.Body.String())
+	code, count := injector.status()
+	assert.Equal(rtr.INTERNAL_ERROR, code)
+	assert.Equal(2, count)
+
+	req = httptest.NewRequest(http.MethodPost, "/inject-error", strings.NewReader("code=foo&count=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	s.mux.ServeHTTP(w, req)
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestAdminRetryInterval(t *testing.T) {
+	assert := assert.New(t)
+	s := newAdminServer("", nil)
+	commandOpts.MaxVersion = 1
+	commandOpts.Refresh, commandOpts.Retry, commandOpts.Expire = 1800, 300, 3600
+	defer func() {
+		commandOpts.MaxVersion = 0
+		commandOpts.Refresh, commandOpts.Retry, commandOpts.Expire = 0, 0, 0
+		atomic.StoreInt32(&retryOverride, 0)
+	}()
+
+	post := func(seconds string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/retry-interval", strings.NewReader("seconds="+seconds))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, req)
+		return w
+	}
+	r := &rtrConn{sessionId: 1}
+	r.negotiate(1)
+	advertised := func() uint32 {
+		pdu, _ := r.endOfData(1).Serialize()
+		endOfData := &rtrEndOfDataV1{}
+		assert.Nil(endOfData.DecodeFromBytes(pdu))
+		return endOfData.RetryInterval
+	}
+	assert.Equal(uint32(300), advertised())
+
+	w := post("1200")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(`{"retry_interval":1200,"overridden":true}`, w.Body.String())
+	assert.Equal(uint32(1200), advertised())
+
+	// Not shorter than the Expire Interval
+	assert.Equal(http.StatusBadRequest, post("3600").Code)
+	assert.Equal(http.StatusBadRequest, post("foo").Code)
+	assert.Equal(uint32(1200), advertised())
+
+	w = post("0")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(`{"retry_interval":300,"overridden":false}`, w.Body.String())
+	assert.Equal(uint32(300), advertised())
+}
+
+func TestAdminSLURM(t *testing.T) {
+	assert := assert.New(t)
+
+	file := createFile("TestAdminSLURM", []string{
+		"route: 192.168.1.0/24\n",
+		"origin: AS65001\n",
+		"remarks: maxLength 26\n",
+		"source: TEST\n",
+		"\n",
+		"route: 10.0.0.0/8\n",
+		"origin: AS65002\n",
+		"source: TEST\n",
+		"\n",
+		"route6: 2001:db8::/32\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(file)
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{file})
+	s := newAdminServer("", mgr)
+
+	req := httptest.NewRequest(http.MethodGet, "/slurm", nil)
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, req)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(`{
+		"slurmVersion": 1,
+		"validationOutputFilters": {
+			"prefixFilters": [],
+			"bgpsecFilters": []
+		},
+		"locallyAddedAssertions": {
+			"prefixAssertions": [
+				{"asn": 65002, "prefix": "10.0.0.0/8", "maxPrefixLength": 8},
+				{"asn": 65001, "prefix": "192.168.1.0/24", "maxPrefixLength": 26},
+				{"asn": 65001, "prefix": "2001:db8::/32", "maxPrefixLength": 32}
+			],
+			"bgpsecAssertions": []
+		}
+	}`, w.Body.String())
+}
+
+func TestAdminStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	file := createFile("TestAdminStatus", []string{
+		"route: 192.168.1.0/24\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(file)
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{file})
+	mgr.Reload()
+	s := newAdminServer("", mgr)
+
+	req := httptest.NewRequest(http.MethodGet, "/status", nil)
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, req)
+	assert.Equal(http.StatusOK, w.Code)
+
+	status := &statusResponse{}
+	assert.Nil(json.NewDecoder(w.Body).Decode(status))
+	assert.Equal(mgr.CurrentSerial(), status.Serial)
+	assert.Equal([]string{file}, status.Sources)
+	assert.True(time.Since(status.ReloadedAt) < time.Minute)
+	assert.False(status.StartedAt.After(status.ReloadedAt))
+}
+
+func TestAdminDelta(t *testing.T) {
+	assert := assert.New(t)
+
+	file := createFile("TestAdminDelta", []string{
+		"route: 192.168.1.0/24\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(file)
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{file})
+	oldSN := mgr.CurrentSerial()
+	ioutil.WriteFile(file, []byte("route: 192.168.2.0/24\norigin: AS65001\nsource: TEST\n\nroute6: 2001:db8::/32\norigin: AS65002\nsource: TEST\n\n"), 0644)
+	mgr.Reload()
+	s := newAdminServer("", mgr)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/delta"+query, nil)
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(fmt.Sprintf("?serial=%d", oldSN))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(fmt.Sprintf(`{
+		"serial": %d,
+		"cache_reset": false,
+		"announced": [
+			{"asn": 65001, "prefix": "192.168.2.0/24", "maxPrefixLength": 24},
+			{"asn": 65002, "prefix": "2001:db8::/32", "maxPrefixLength": 32}
+		],
+		"withdrawn": [
+			{"asn": 65001, "prefix": "192.168.1.0/24", "maxPrefixLength": 24}
+		]
+	}`, mgr.CurrentSerial()), w.Body.String())
+
+	w = get(fmt.Sprintf("?serial=%d", oldSN-1))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(fmt.Sprintf(`{"serial": %d, "cache_reset": true, "announced": null, "withdrawn": null}`, mgr.CurrentSerial()), w.Body.String())
+
+	assert.Equal(http.StatusBadRequest, get("?serial=foo").Code)
+}
+
+func TestAdminROAs(t *testing.T) {
+	assert := assert.New(t)
+
+	file := createFile("TestAdminROAs", []string{
+		"route6: 2001:db8::/32\n",
+		"origin: AS65002\n",
+		"source: TEST\n",
+		"\n",
+		"route: 192.168.1.0/24\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(file)
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{file})
+	s := newAdminServer("", mgr)
+
+	req := httptest.NewRequest(http.MethodGet, "/roas", nil)
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, req)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(fmt.Sprintf(`{
+		"serial": %d,
+		"roas": [
+			{"asn": 65001, "prefix": "192.168.1.0/24", "maxPrefixLength": 24},
+			{"asn": 65002, "prefix": "2001:db8::/32", "maxPrefixLength": 32}
+		]
+	}`, mgr.CurrentSerial()), w.Body.String())
+
+	req = httptest.NewRequest(http.MethodPost, "/roas", nil)
+	w = httptest.NewRecorder()
+	s.mux.ServeHTTP(w, req)
+	assert.Equal(http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestAdminRaw(t *testing.T) {
+	assert := assert.New(t)
+
+	content := "route: 192.168.1.0/24\norigin: AS65001\nsource: TEST\n\nroute: 10.0.0.0/8\norigin: AS0\nsource: TEST\n\n"
+	file := createFile("TestAdminRaw", []string{content})
+	defer removeFile(file)
+	mgr := NewResourceManager(false)
+	// The route of AS0 is dropped, but fetched anyway
+	commandOpts.RejectASNs = []asnRange{{0, 0}}
+	commandOpts.RawCacheSize = 1024
+	defer func() {
+		commandOpts.RejectASNs = nil
+		commandOpts.RawCacheSize = 0
+	}()
+	mgr.Load([]string{file})
+	s := newAdminServer("", mgr)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/raw"+query, nil)
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("?source=" + url.QueryEscape(file))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(content, w.Body.String())
+	assert.Equal("false", w.Header().Get("X-Raw-Truncated"))
+
+	assert.Contains(get("").Body.String(), fmt.Sprintf("%q", file))
+	assert.Equal(http.StatusNotFound, get("?source=unknown").Code)
+
+	commandOpts.RawCacheSize = 10
+	mgr.Reload()
+	w = get("?source=" + url.QueryEscape(file))
+	assert.Equal(content[:10], w.Body.String())
+	assert.Equal("true", w.Header().Get("X-Raw-Truncated"))
+	assert.Equal(strconv.Itoa(len(content)), w.Header().Get("X-Raw-Size"))
+}
+
+func TestAdminSessionStats(t *testing.T) {
+	assert := assert.New(t)
+	s := newAdminServer("", nil)
+	r, client := newConnPair()
+	defer r.conn.Close()
+	defer client.Close()
+	sessions.add(r)
+	defer sessions.remove(r)
+
+	r.sendPDU(rtr.NewRTRSerialNotify(r.sessionId, 1))
+	r.sendPDU(rtr.NewRTRCacheReset())
+	r.stats.ResetQueries = 1
+	peer := url.QueryEscape(r.remoteAddr.String())
+
+	stats := func(method string) *sessionStats {
+		req := httptest.NewRequest(method, "/session-stats?peer="+peer, nil)
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, req)
+		assert.Equal(http.StatusOK, w.Code)
+		res := &sessionStats{}
+		json.Unmarshal(w.Body.Bytes(), res)
+		return res
+	}
+	assert.Equal(&sessionStats{PDUsSent: 2, BytesSent: 20, ResetQueries: 1}, stats(http.MethodGet))
+	assert.Equal(&sessionStats{}, stats(http.MethodDelete))
+
+	// The session is still up, and counts from zero
+	assert.Nil(r.sendPDU(rtr.NewRTRCacheReset()))
+	assert.Equal(&sessionStats{PDUsSent: 1, BytesSent: 8}, stats(http.MethodGet))
+
+	req := httptest.NewRequest(http.MethodGet, "/session-stats?peer=192.0.2.1:179", nil)
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, req)
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	// All sessions are shown without the peer
+	req = httptest.NewRequest(http.MethodGet, "/session-stats", nil)
+	w = httptest.NewRecorder()
+	s.mux.ServeHTTP(w, req)
+	all := map[string]*sessionStats{}
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &all))
+	assert.Equal(&sessionStats{PDUsSent: 1, BytesSent: 8}, all[r.remoteAddr.String()])
+}
@@ -0,0 +1,198 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// aspaVersion is the lowest RTR protocol version which has ASPA PDU, defined
+// by the successor of RFC 8210. Routers of older versions don't receive
+// ASPAs.
+const aspaVersion = 2
+
+// aspaTable is the provider ASNs authorized by each customer ASN.
+type aspaTable map[uint32][]uint32
+
+// FakeASPA is an ASPA sent to routers. Providers is nil in a withdrawal.
+type FakeASPA struct {
+	Customer  uint32
+	Providers []uint32
+	Flags     uint8
+}
+
+// add adds providers of the customer. ASPAs of the same customer from
+// multiple sources are merged.
+func (t aspaTable) add(customer uint32, providers []uint32) {
+	seen := map[uint32]bool{}
+	merged := []uint32{}
+	for _, p := range append(t[customer], providers...) {
+		if !seen[p] {
+			seen[p] = true
+			merged = append(merged, p)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i] < merged[j] })
+	t[customer] = merged
+}
+
+func (t aspaTable) customers() []uint32 {
+	customers := make([]uint32, 0, len(t))
+	for c := range t {
+		customers = append(customers, c)
+	}
+	sort.Slice(customers, func(i, j int) bool { return customers[i] < customers[j] })
+	return customers
+}
+
+// aspaTable returns the ASPA table of sn, which is made empty unless it exists.
+func (rsrc *resource) aspaTable(sn uint32) aspaTable {
+	if rsrc.aspas == nil {
+		rsrc.aspas = map[uint32]aspaTable{}
+	}
+	if _, ok := rsrc.aspas[sn]; !ok {
+		rsrc.aspas[sn] = aspaTable{}
+	}
+	return rsrc.aspas[sn]
+}
+
+// currentASPAs returns all ASPAs of the current serial as announcements,
+// sorted by customer ASN.
+func currentASPAs(rsrc *resource) []*FakeASPA {
+	current := rsrc.aspas[rsrc.currentSN]
+	list := []*FakeASPA{}
+	for _, c := range current.customers() {
+		list = append(list, &FakeASPA{Customer: c, Providers: current[c], Flags: 1})
+	}
+	return list
+}
+
+// deltaASPAs returns ASPAs changed from sn to the current serial. An ASPA PDU
+// replaces all providers of the customer, so a changed customer is only
+// announced again.
+func deltaASPAs(rsrc *resource, sn uint32) []*FakeASPA {
+	old, current := rsrc.aspas[sn], rsrc.aspas[rsrc.currentSN]
+	list := []*FakeASPA{}
+	for _, c := range current.customers() {
+		if !reflect.DeepEqual(old[c], current[c]) {
+			list = append(list, &FakeASPA{Customer: c, Providers: current[c], Flags: 1})
+		}
+	}
+	for _, c := range old.customers() {
+		if _, ok := current[c]; !ok {
+			list = append(list, &FakeASPA{Customer: c, Flags: 0})
+		}
+	}
+	return list
+}
+
+// countASPAChanges returns the number of customers whose ASPA differs between
+// the tables.
+func countASPAChanges(current, next aspaTable) int {
+	n := 0
+	for c, providers := range next {
+		if !reflect.DeepEqual(current[c], providers) {
+			n++
+		}
+	}
+	for c := range current {
+		if _, ok := next[c]; !ok {
+			n++
+		}
+	}
+	return n
+}
+
+// rtrASPA is ASPA PDU of version 2 in draft-ietf-sidrops-8210bis, which gobgp
+// doesn't support.
+type rtrASPA struct {
+	Flags     uint8
+	Customer  uint32
+	Providers []uint32
+}
+
+const (
+	rtrASPAType      = 11
+	rtrASPAHeaderLen = 12
+)
+
+func (m *rtrASPA) DecodeFromBytes(data []byte) error {
+	if len(data) < rtrASPAHeaderLen || (len(data)-rtrASPAHeaderLen)%4 != 0 {
+		return fmt.Errorf("ASPA PDU has an invalid length (%d bytes)", len(data))
+	}
+	m.Flags = data[2]
+	m.Customer = binary.BigEndian.Uint32(data[8:12])
+	m.Providers = nil
+	for i := rtrASPAHeaderLen; i < len(data); i += 4 {
+		m.Providers = append(m.Providers, binary.BigEndian.Uint32(data[i:i+4]))
+	}
+	return nil
+}
+
+func (m *rtrASPA) Serialize() ([]byte, error) {
+	length := rtrASPAHeaderLen + 4*len(m.Providers)
+	data := make([]byte, length)
+	data[0] = aspaVersion
+	data[1] = rtrASPAType
+	data[2] = m.Flags
+	binary.BigEndian.PutUint32(data[4:8], uint32(length))
+	binary.BigEndian.PutUint32(data[8:12], m.Customer)
+	for i, p := range m.Providers {
+		binary.BigEndian.PutUint32(data[rtrASPAHeaderLen+4*i:], p)
+	}
+	return data, nil
+}
+
+// supportsASPA returns true if the router has negotiated a version having
+// ASPA PDU.
+func (r *rtrConn) supportsASPA() bool {
+	return r.peerVersion() >= aspaVersion
+}
+
+// currentASPAs returns all ASPAs in the transaction for a router supporting
+// them, or nil for the others.
+func (r *rtrConn) currentASPAs(trans *ResourceManager) []*FakeASPA {
+	if !r.supportsASPA() {
+		return nil
+	}
+	return trans.CurrentASPAs()
+}
+
+// deltaASPAs returns ASPAs changed since sn in the transaction for a router
+// supporting them, or nil for the others.
+func (r *rtrConn) deltaASPAs(trans *ResourceManager, sn uint32) []*FakeASPA {
+	if !r.supportsASPA() {
+		return nil
+	}
+	return trans.DeltaASPAs(sn)
+}
+
+// sendASPAs sends ASPA PDUs as the last phase of the response.
+func (r *rtrConn) sendASPAs(aspas []*FakeASPA) error {
+	for _, v := range aspas {
+		if err := r.bufferPDU(&rtrASPA{Flags: v.Flags, Customer: v.Customer, Providers: v.Providers}); err != nil {
+			return err
+		}
+		r.log().Debugf("Sent ASPA PDU to %v (Customer: AS%v, Providers: %v, flags: %v)", r.remoteAddr, v.Customer, v.Providers, v.Flags)
+	}
+	if len(aspas) != 0 && !commandOpts.Debug {
+		r.log().Infof("Sent ASPA PDU(s) to %v (%d ASPA(s))", r.remoteAddr, len(aspas))
+	}
+	return r.writer().Flush()
+}
@@ -0,0 +1,63 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "sync"
+
+// notifyGroup broadcasts Serial Notify to sessions. Unlike a broadcaster which
+// delivers to members one by one, it never blocks on a slow member, such as a
+// session in the middle of a full synchronization. A member has at most one
+// notification pending, as sessions send the serial current at the time of
+// receiving it.
+type notifyGroup struct {
+	mu      sync.Mutex
+	members map[*notifyMember]struct{}
+}
+
+type notifyMember struct {
+	group *notifyGroup
+	In    chan struct{}
+}
+
+func newNotifyGroup() *notifyGroup {
+	return &notifyGroup{members: map[*notifyMember]struct{}{}}
+}
+
+func (g *notifyGroup) Join() *notifyMember {
+	m := &notifyMember{group: g, In: make(chan struct{}, 1)}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.members[m] = struct{}{}
+	return m
+}
+
+func (g *notifyGroup) Send() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for m := range g.members {
+		select {
+		case m.In <- struct{}{}:
+		default:
+			// Coalesced into the pending one
+		}
+	}
+}
+
+func (m *notifyMember) Close() {
+	m.group.mu.Lock()
+	defer m.group.mu.Unlock()
+	delete(m.group.members, m)
+}
@@ -0,0 +1,264 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armon/go-radix"
+	"github.com/osrg/gobgp/pkg/packet/bgp"
+)
+
+// changeSource is a source which can tell ROAs added and withdrawn since the
+// token returned last time, so that large datasets can be updated without
+// reloading and comparing all ROAs. An empty token asks for changes since the
+// data loaded from files.
+type changeSource interface {
+	Changes(sinceToken string) (added, withdrawn []*FakeROA, nextToken string, err error)
+}
+
+// applyChanges makes the current table with changes from the source applied
+// a new serial. It returns false if there is no change. The source is
+// remembered, so that a reload of the files replays all changes from it.
+func (rsrc *resource) applyChanges(src changeSource) (bool, error) {
+	rsrc.changes = src
+	added, withdrawn, token, err := src.Changes(rsrc.changeToken)
+	if err != nil {
+		return false, err
+	}
+	if len(added) == 0 && len(withdrawn) == 0 {
+		rsrc.changeToken = token
+		return false, nil
+	}
+
+	next, err := rsrc.withChanges(rsrc.table[rsrc.currentSN], added, withdrawn)
+	if err != nil {
+		return false, err
+	}
+	// ASPAs are only loaded from files
+	rsrc.advance(next, rsrc.aspas[rsrc.currentSN], len(added)+len(withdrawn))
+	rsrc.changeToken = token
+	return true, nil
+}
+
+// replayChanges applies all changes from the source to the table loaded from
+// the files, as the changes are since the data loaded from them.
+func (rsrc *resource) replayChanges(loaded map[bgp.RouteFamily]*radix.Tree) (map[bgp.RouteFamily]*radix.Tree, string, error) {
+	added, withdrawn, token, err := rsrc.changes.Changes("")
+	if err != nil {
+		return nil, "", err
+	}
+	next, err := rsrc.withChanges(loaded, added, withdrawn)
+	return next, token, err
+}
+
+// withChanges returns a copy of the table with the ROAs withdrawn and added.
+func (rsrc *resource) withChanges(table map[bgp.RouteFamily]*radix.Tree, added, withdrawn []*FakeROA) (map[bgp.RouteFamily]*radix.Tree, error) {
+	staged := &resource{
+		table:     map[uint32]map[bgp.RouteFamily]*radix.Tree{0: cloneTable(table)},
+		useMaxLen: rsrc.useMaxLen,
+		blocklist: rsrc.blocklist,
+	}
+	for _, roa := range withdrawn {
+		staged.withdraw(0, roa)
+	}
+	var err error
+	for _, roa := range added {
+		staged, err = staged.addValidInfo(0, fmt.Sprintf("AS%d", roa.AS), fmt.Sprintf("%v/%v", roa.Prefix, roa.PrefixLen), int(roa.MaxLen))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return staged.table[0], nil
+}
+
+// changeSet accumulates changes in order into ROAs to withdraw and then to
+// add, so that the last change of a ROA wins.
+type changeSet struct {
+	added, withdrawn []*FakeROA
+}
+
+func (c *changeSet) add(roa *FakeROA) {
+	c.added = append(c.added, roa)
+}
+
+func (c *changeSet) withdraw(roa *FakeROA) {
+	key := roaKey(roa)
+	added := []*FakeROA{}
+	for _, v := range c.added {
+		if roaKey(v) != key {
+			added = append(added, v)
+		}
+	}
+	c.added = added
+	c.withdrawn = append(c.withdrawn, roa)
+}
+
+// roaKey identifies a ROA in the same form as treeToSet.
+func roaKey(v *FakeROA) string {
+	return fmt.Sprintf("%v/%v-%v-%v", v.Prefix, v.PrefixLen, v.MaxLen, v.AS)
+}
+
+// changeJournal is a changeSource reading a file of --changes-file, which a
+// provisioning system appends changes to. Each line adds or withdraws a ROA
+// by "+" or "-", the prefix, the max length and the origin AS, eg.
+// "+ 192.0.2.0/24 24 AS65000" or "- 2001:db8::/32 48 AS65001". The token is
+// the offset of the file read so far. A line without the newline yet is left
+// for the next time.
+type changeJournal struct {
+	fileName string
+}
+
+func (j *changeJournal) Changes(sinceToken string) ([]*FakeROA, []*FakeROA, string, error) {
+	var offset int64
+	if sinceToken != "" {
+		var err error
+		if offset, err = strconv.ParseInt(sinceToken, 10, 64); err != nil {
+			return nil, nil, "", fmt.Errorf("invalid token %q of %v", sinceToken, j.fileName)
+		}
+	}
+	f, err := os.Open(j.fileName)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil {
+		return nil, nil, "", err
+	} else if fi.Size() < offset {
+		return nil, nil, "", fmt.Errorf("%v has been truncated, reload to apply it from the beginning", j.fileName)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, nil, "", err
+	}
+
+	changes := &changeSet{added: []*FakeROA{}, withdrawn: []*FakeROA{}}
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, "", err
+		}
+		offset += int64(len(line))
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		roa, err := parseJournalROA(fields)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("%v: %v", j.fileName, err)
+		}
+		if fields[0] == "+" {
+			changes.add(roa)
+		} else {
+			changes.withdraw(roa)
+		}
+	}
+	return changes.added, changes.withdrawn, strconv.FormatInt(offset, 10), nil
+}
+
+func parseJournalROA(fields []string) (*FakeROA, error) {
+	line := strings.Join(fields, " ")
+	if len(fields) != 4 || (fields[0] != "+" && fields[0] != "-") {
+		return nil, fmt.Errorf("invalid change %q", line)
+	}
+	_, ip, plen, maskLenMax, err := parsePrefix(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix in %q: %v", line, err)
+	}
+	maxLen, err := strconv.ParseUint(fields[2], 10, 8)
+	if err != nil || uint8(maxLen) < plen || uint8(maxLen) > maskLenMax {
+		return nil, fmt.Errorf("invalid max length in %q", line)
+	}
+	as, err := parseASN(fields[3])
+	if err != nil {
+		return nil, fmt.Errorf("%v in %q", err, line)
+	}
+	return &FakeROA{Prefix: ip, PrefixLen: plen, MaxLen: uint8(maxLen), AS: as}, nil
+}
+
+func changesLoop(mgr *ResourceManager, src changeSource, tickCh <-chan time.Time) {
+	for range tickCh {
+		// The error has been logged by the manager
+		mgr.ApplyChanges(src)
+	}
+}
+
+// withdraw removes a ROA from the table, and the prefix as well if it has no
+// ROA any more.
+func (rsrc *resource) withdraw(sn uint32, roa *FakeROA) {
+	rf := bgp.RF_IPv6_UC
+	if roa.Prefix.To4() != nil {
+		rf = bgp.RF_IPv4_UC
+	}
+	key := generateKey(rf, roa.Prefix, roa.PrefixLen)
+	b, ok := rsrc.table[sn][rf].Get(key)
+	if !ok {
+		return
+	}
+	bucket := b.(*prefixResource)
+	values := []*subResource{}
+	for _, r := range bucket.values {
+		if r.maxLen == roa.MaxLen {
+			asns := []uint32{}
+			for _, asn := range r.asns {
+				if asn != roa.AS {
+					asns = append(asns, asn)
+				}
+			}
+			r.asns = asns
+		}
+		if len(r.asns) > 0 {
+			values = append(values, r)
+		}
+	}
+	bucket.values = values
+	if len(values) == 0 {
+		rsrc.table[sn][rf].Delete(key)
+	}
+}
+
+// cloneTable copies the trees deep enough to modify ROAs in them.
+func cloneTable(trees map[bgp.RouteFamily]*radix.Tree) map[bgp.RouteFamily]*radix.Tree {
+	cloned := make(map[bgp.RouteFamily]*radix.Tree)
+	for rf, tree := range trees {
+		cloned[rf] = radix.New()
+		tree.Walk(func(key string, v interface{}) bool {
+			b := v.(*prefixResource)
+			values := make([]*subResource, 0, len(b.values))
+			for _, r := range b.values {
+				values = append(values, &subResource{
+					maxLen: r.maxLen,
+					asns:   append([]uint32{}, r.asns...),
+				})
+			}
+			cloned[rf].Insert(key, &prefixResource{
+				prefix:    b.prefix,
+				prefixLen: b.prefixLen,
+				values:    values,
+			})
+			return false
+		})
+	}
+	return cloned
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/osrg/gobgp/pkg/packet/bgp"
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeChangeSource publishes batches of added and withdrawn ROAs one by one.
+// The token is the number of batches applied.
+type fakeChangeSource struct {
+	batches   [][2][]*FakeROA
+	published int
+}
+
+func (s *fakeChangeSource) Changes(sinceToken string) ([]*FakeROA, []*FakeROA, string, error) {
+	i := 0
+	if sinceToken != "" {
+		i, _ = strconv.Atoi(sinceToken)
+	}
+	changes := &changeSet{}
+	for _, batch := range s.batches[i:s.published] {
+		for _, roa := range batch[1] {
+			changes.withdraw(roa)
+		}
+		for _, roa := range batch[0] {
+			changes.add(roa)
+		}
+	}
+	return changes.added, changes.withdrawn, strconv.Itoa(s.published), nil
+}
+
+func TestApplyChanges(t *testing.T) {
+	assert := assert.New(t)
+
+	newROA := func(prefix string, maxLen uint8, as uint32) *FakeROA {
+		_, ip, plen, _, _ := parsePrefix(prefix)
+		return &FakeROA{Prefix: ip, PrefixLen: plen, MaxLen: maxLen, AS: as}
+	}
+	toStrings := func(roas []*FakeROA) []string {
+		result := []string{}
+		for _, v := range roas {
+			result = append(result, fmt.Sprintf("%v/%v-%v AS%v", v.Prefix, v.PrefixLen, v.MaxLen, v.AS))
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	file := createFile("TestApplyChanges", []string{
+		"route: 192.168.0.0/24\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+		"route: 192.168.1.0/24\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(file)
+	mgr := NewResourceManager(false)
+	assert.Nil(mgr.Load([]string{file}))
+	sn0 := mgr.CurrentSerial()
+
+	src := &fakeChangeSource{batches: [][2][]*FakeROA{
+		{
+			{newROA("10.0.0.0/8", 16, 65002), newROA("192.168.0.0/24", 24, 65002)},
+			{newROA("192.168.1.0/24", 24, 65001)},
+		},
+		{
+			{newROA("2001:db8::/32", 48, 65003)},
+			{newROA("192.168.0.0/24", 24, 65001)},
+		},
+	}}
+
+	src.published = 1
+	assert.Nil(mgr.ApplyChanges(src))
+	sn1 := mgr.CurrentSerial()
+	assert.NotEqual(sn0, sn1)
+	delta := mgr.DeltaList(sn0)
+	assert.Equal([]string{"10.0.0.0/8-16 AS65002", "192.168.0.0/24-24 AS65002"}, toStrings(delta[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT]))
+	assert.Equal([]string{"192.168.1.0/24-24 AS65001"}, toStrings(delta[bgp.RF_IPv4_UC][rtr.WITHDRAWAL]))
+
+	src.published = 2
+	assert.Nil(mgr.ApplyChanges(src))
+	sn2 := mgr.CurrentSerial()
+	assert.NotEqual(sn1, sn2)
+	delta = mgr.DeltaList(sn1)
+	assert.Equal([]string{"2001:db8::/32-48 AS65003"}, toStrings(delta[bgp.RF_IPv6_UC][rtr.ANNOUNCEMENT]))
+	assert.Equal([]string{"192.168.0.0/24-24 AS65001"}, toStrings(delta[bgp.RF_IPv4_UC][rtr.WITHDRAWAL]))
+	assert.Empty(delta[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT])
+
+	current := mgr.CurrentList()
+	assert.Equal([]string{"10.0.0.0/8-16 AS65002", "192.168.0.0/24-24 AS65002"}, toStrings(current[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT]))
+
+	// No more changes
+	assert.Nil(mgr.ApplyChanges(src))
+	assert.Equal(sn2, mgr.CurrentSerial())
+
+	// A reload of the file keeps the changes
+	assert.Nil(mgr.Reload())
+	assert.Equal(sn2, mgr.CurrentSerial())
+	current = mgr.CurrentList()
+	assert.Equal([]string{"10.0.0.0/8-16 AS65002", "192.168.0.0/24-24 AS65002"}, toStrings(current[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT]))
+	assert.Equal([]string{"2001:db8::/32-48 AS65003"}, toStrings(current[bgp.RF_IPv6_UC][rtr.ANNOUNCEMENT]))
+}
+
+func TestChangeJournal(t *testing.T) {
+	assert := assert.New(t)
+
+	file := createFile("TestChangeJournal", []string{
+		"# changes\n",
+		"+ 10.0.0.0/8 16 AS65002\n",
+		"- 192.168.0.0/24 24 AS65001\n",
+		"+ 2001:db8::/32 48 as0065003",
+	})
+	defer removeFile(file)
+	j := &changeJournal{fileName: file}
+
+	// The last line is left until it ends with the newline
+	added, withdrawn, token, err := j.Changes("")
+	assert.Nil(err)
+	assert.Len(added, 1)
+	assert.Equal("10.0.0.0", added[0].Prefix.String())
+	assert.Equal(uint8(16), added[0].MaxLen)
+	assert.Len(withdrawn, 1)
+	assert.Equal(uint32(65001), withdrawn[0].AS)
+
+	f, _ := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("\n")
+	f.Close()
+	added, withdrawn, token, err = j.Changes(token)
+	assert.Nil(err)
+	assert.Len(added, 1)
+	assert.Equal(uint32(65003), added[0].AS)
+	assert.Empty(withdrawn)
+
+	// The last change of a ROA wins
+	f, _ = os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("+ 172.16.0.0/12 12 AS65004\n- 172.16.0.0/12 12 AS65004\n- 172.17.0.0/16 16 AS65004\n+ 172.17.0.0/16 16 AS65004\n")
+	f.Close()
+	added, withdrawn, token, err = j.Changes(token)
+	assert.Nil(err)
+	assert.Len(added, 1)
+	assert.Equal("172.17.0.0", added[0].Prefix.String())
+	assert.Len(withdrawn, 2)
+
+	// Nothing new
+	added, withdrawn, next, err := j.Changes(token)
+	assert.Nil(err)
+	assert.Empty(added)
+	assert.Empty(withdrawn)
+	assert.Equal(token, next)
+
+	for _, line := range []string{
+		"* 10.0.0.0/8 16 AS65002\n",
+		"+ 10.0.0.0/8 AS65002\n",
+		"+ 10.0.0.0/8 7 AS65002\n",
+		"+ 10.0.0.0/8 33 AS65002\n",
+		"+ 10.0.0.0/33 33 AS65002\n",
+		"+ 10.0.0.0/8 16 ASX\n",
+	} {
+		ioutil.WriteFile(file, []byte(line), 0644)
+		_, _, _, err := j.Changes("")
+		assert.NotNil(err, line)
+	}
+
+	// A truncated file is not read from the middle of a line
+	_, _, _, err = j.Changes(token)
+	assert.NotNil(err)
+}
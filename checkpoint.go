@@ -0,0 +1,223 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/armon/go-radix"
+	"github.com/osrg/gobgp/pkg/packet/bgp"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkpoint is the serial history saved with --checkpoint, so that routers
+// at a serial in the history still get a delta after a restart.
+type checkpoint struct {
+	SessionID uint16              `json:"session_id"`
+	Serial    uint32              `json:"serial"`
+	History   []*checkpointSerial `json:"history"`
+}
+
+type checkpointSerial struct {
+	Serial   uint32    `json:"serial"`
+	LoadedAt time.Time `json:"loaded_at"`
+	// ROAs are in the form of "PREFIX/LEN-MAXLEN-ASN"
+	ROAs  []string  `json:"roas"`
+	ASPAs aspaTable `json:"aspas,omitempty"`
+}
+
+func (rsrc *resource) checkpoint() *checkpoint {
+	cp := &checkpoint{Serial: rsrc.currentSN}
+	for sn, trees := range rsrc.table {
+		roas := []string{}
+		for _, rf := range []bgp.RouteFamily{bgp.RF_IPv4_UC, bgp.RF_IPv6_UC} {
+			for _, item := range treeToSet(trees[rf]).ToSlice() {
+				roas = append(roas, item.(string))
+			}
+		}
+		sort.Strings(roas)
+		cp.History = append(cp.History, &checkpointSerial{
+			Serial:   sn,
+			LoadedAt: rsrc.loadedAt[sn],
+			ROAs:     roas,
+			ASPAs:    rsrc.aspas[sn],
+		})
+	}
+	sort.Slice(cp.History, func(i, j int) bool {
+		return cp.History[i].LoadedAt.Before(cp.History[j].LoadedAt)
+	})
+	return cp
+}
+
+// restore replaces the serial history with the checkpoint. The data loaded
+// from files becomes the next serial unless it is the same as the current
+// one in the checkpoint. With --lazy-load, the first load does it instead.
+func (rsrc *resource) restore(cp *checkpoint) error {
+	found := false
+	for _, h := range cp.History {
+		found = found || h.Serial == cp.Serial
+	}
+	if !found {
+		return errors.New("checkpoint doesn't have the current serial")
+	}
+
+	// Build the history aside, so that a broken checkpoint doesn't touch the
+	// loaded data
+	staged := &resource{
+		table:    make(map[uint32]map[bgp.RouteFamily]*radix.Tree),
+		loadedAt: make(map[uint32]time.Time),
+		aspas:    make(map[uint32]aspaTable),
+	}
+	for _, h := range cp.History {
+		staged.initTable(h.Serial)
+		for _, item := range h.ROAs {
+			if strings.Count(item, "-") != 2 {
+				return fmt.Errorf("invalid ROA %q in the checkpoint (SN: %v)", item, h.Serial)
+			}
+			addr, plen, mlen, asn := stringToValues(item)
+			if addr == nil {
+				return fmt.Errorf("invalid ROA %q in the checkpoint (SN: %v)", item, h.Serial)
+			}
+			staged.insert(h.Serial, &FakeROA{Prefix: addr, PrefixLen: plen, MaxLen: mlen, AS: asn})
+		}
+		staged.loadedAt[h.Serial] = h.LoadedAt
+		staged.aspas[h.Serial] = h.ASPAs
+	}
+
+	loaded, loadedASPAs := rsrc.table[rsrc.currentSN], rsrc.aspas[rsrc.currentSN]
+	rsrc.table, rsrc.loadedAt, rsrc.aspas = staged.table, staged.loadedAt, staged.aspas
+	rsrc.currentSN = cp.Serial
+	rsrc.fullSync = nil
+	rsrc.updateContentHash()
+	rsrc.trimHistory()
+	log.Infof("Resource has been restored from the checkpoint. (SN: %v, History: %d)", rsrc.currentSN, len(cp.History))
+
+	if loaded == nil {
+		return nil
+	}
+	if changes := countChanges(rsrc.table[rsrc.currentSN], loaded) + countASPAChanges(rsrc.aspas[rsrc.currentSN], loadedASPAs); changes > 0 {
+		rsrc.advance(loaded, loadedASPAs, changes)
+	}
+	return nil
+}
+
+// insert adds a ROA to the table as is, unlike addValidInfo which filters it.
+func (rsrc *resource) insert(sn uint32, roa *FakeROA) {
+	rf := bgp.RF_IPv6_UC
+	if roa.Prefix.To4() != nil {
+		rf = bgp.RF_IPv4_UC
+	}
+	key := generateKey(rf, roa.Prefix, roa.PrefixLen)
+	b, ok := rsrc.table[sn][rf].Get(key)
+	if !ok {
+		rsrc.table[sn][rf].Insert(key, &prefixResource{
+			prefix:    roa.Prefix,
+			prefixLen: roa.PrefixLen,
+			values:    []*subResource{{maxLen: roa.MaxLen, asns: []uint32{roa.AS}}},
+		})
+		return
+	}
+	bucket := b.(*prefixResource)
+	for _, r := range bucket.values {
+		if r.maxLen == roa.MaxLen {
+			r.asns = append(r.asns, roa.AS)
+			return
+		}
+	}
+	bucket.values = append(bucket.values, &subResource{maxLen: roa.MaxLen, asns: []uint32{roa.AS}})
+}
+
+// readCheckpoint returns nil without an error if the file doesn't exist yet.
+func readCheckpoint(fileName string) (*checkpoint, error) {
+	buf, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cp := &checkpoint{}
+	if err := json.Unmarshal(buf, cp); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return cp, nil
+}
+
+// restoreCheckpoint restores the serial history from the file, and returns
+// the checkpoint, or nil if there is none to resume. A checkpoint which can't
+// be restored is ignored, so that routers are told Cache Reset by the new
+// session instead of being kept from the cache.
+func restoreCheckpoint(mgr *ResourceManager, fileName string) *checkpoint {
+	cp, err := readCheckpoint(fileName)
+	if err == nil && cp != nil {
+		err = mgr.Restore(cp)
+	}
+	if err != nil {
+		log.Warnf("Could not restore the checkpoint, starting a new session: %v", err)
+		return nil
+	}
+	return cp
+}
+
+// writeCheckpoint replaces the file by renaming, so that a crash while
+// writing doesn't break the last checkpoint.
+func writeCheckpoint(fileName string, cp *checkpoint) error {
+	buf, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+func saveCheckpoint(mgr *ResourceManager, sessionID uint16, fileName string) {
+	// The checkpoint needs the current data, which --lazy-load defers
+	if !mgr.HasData() {
+		log.Debugf("Skipped the checkpoint, no data has been loaded")
+		return
+	}
+	cp := mgr.Checkpoint()
+	cp.SessionID = sessionID
+	if err := writeCheckpoint(fileName, cp); err != nil {
+		log.Errorf("Could not write the checkpoint: %v", err)
+		return
+	}
+	log.Debugf("Wrote the checkpoint to %v (SN: %v)", fileName, cp.Serial)
+}
+
+func checkpointLoop(mgr *ResourceManager, sessionID uint16, fileName string, tickCh <-chan time.Time) {
+	for range tickCh {
+		saveCheckpoint(mgr, sessionID, fileName)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/osrg/gobgp/pkg/packet/bgp"
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	routes := func(prefixes ...string) []byte {
+		buf := []byte{}
+		for _, p := range prefixes {
+			buf = append(buf, []byte("route: "+p+"\norigin: AS65001\nsource: TEST\n\n")...)
+		}
+		return buf
+	}
+	file := createFile("TestCheckpoint", nil)
+	defer removeFile(file)
+	cpFile := createFile("TestCheckpoint", nil)
+	removeFile(cpFile)
+	defer removeFile(cpFile)
+
+	cp, err := readCheckpoint(cpFile)
+	assert.Nil(err)
+	assert.Nil(cp)
+
+	ioutil.WriteFile(file, routes("192.168.1.0/24"), 0644)
+	mgr := NewResourceManager(false)
+	assert.Nil(mgr.Load([]string{file}))
+	sn1 := mgr.CurrentSerial()
+	ioutil.WriteFile(file, routes("192.168.1.0/24", "192.168.2.0/24"), 0644)
+	assert.Nil(mgr.Reload())
+	sn2 := mgr.CurrentSerial()
+
+	cp = mgr.Checkpoint()
+	cp.SessionID = 42
+	assert.Nil(writeCheckpoint(cpFile, cp))
+
+	restart := func() *ResourceManager {
+		mgr := NewResourceManager(false)
+		assert.Nil(mgr.Load([]string{file}))
+		cp, err := readCheckpoint(cpFile)
+		assert.Nil(err)
+		assert.Equal(uint16(42), cp.SessionID)
+		assert.Nil(mgr.Restore(cp))
+		return mgr
+	}
+
+	t.Run("unchanged", func(t *testing.T) {
+		mgr := restart()
+		assert.Equal(sn2, mgr.CurrentSerial())
+		assert.True(mgr.HasKey(sn1))
+		delta := mgr.DeltaList(sn1)[bgp.RF_IPv4_UC]
+		assert.Len(delta[rtr.ANNOUNCEMENT], 1)
+		assert.Len(delta[rtr.WITHDRAWAL], 0)
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		ioutil.WriteFile(file, routes("192.168.2.0/24", "192.168.3.0/24"), 0644)
+		mgr := restart()
+		assert.True(serialNewer(mgr.CurrentSerial(), sn2))
+		// Routers at a serial in the checkpoint get a delta
+		assert.True(mgr.HasKey(sn1))
+		delta := mgr.DeltaList(sn1)[bgp.RF_IPv4_UC]
+		assert.Len(delta[rtr.ANNOUNCEMENT], 2)
+		assert.Len(delta[rtr.WITHDRAWAL], 1)
+		// and others get Cache Reset
+		assert.False(mgr.HasKey(sn1 - 1))
+	})
+
+	t.Run("lazy", func(t *testing.T) {
+		ioutil.WriteFile(file, routes("192.168.2.0/24", "192.168.3.0/24", "192.168.4.0/24"), 0644)
+		mgr := NewResourceManager(false)
+		assert.Nil(mgr.LoadLazily([]string{file}))
+		assert.NotNil(restoreCheckpoint(mgr, cpFile))
+		// The checkpoint is served until the first load, which is a delta
+		assert.Equal(sn2, mgr.CurrentSerial())
+		assert.Nil(mgr.Reload())
+		assert.True(serialNewer(mgr.CurrentSerial(), sn2))
+		assert.True(mgr.HasKey(sn2))
+		delta := mgr.DeltaList(sn2)[bgp.RF_IPv4_UC]
+		assert.Len(delta[rtr.ANNOUNCEMENT], 2)
+		assert.Len(delta[rtr.WITHDRAWAL], 1)
+	})
+
+	t.Run("broken", func(t *testing.T) {
+		ioutil.WriteFile(cpFile, []byte("{"), 0644)
+		_, err := readCheckpoint(cpFile)
+		assert.NotNil(err)
+
+		// The daemon starts a new session without the history
+		mgr := NewResourceManager(false)
+		assert.Nil(mgr.Load([]string{file}))
+		currentSN := mgr.CurrentSerial()
+		assert.Nil(restoreCheckpoint(mgr, cpFile))
+		assert.Equal(currentSN, mgr.CurrentSerial())
+	})
+}
+
+func TestCheckpointWithoutCurrentSerial(t *testing.T) {
+	assert := assert.New(t)
+	file := createFile("TestCheckpointWithoutCurrentSerial", []string{
+		"route: 192.168.1.0/24\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(file)
+
+	mgr := NewResourceManager(false)
+	assert.Nil(mgr.Load([]string{file}))
+	currentSN := mgr.CurrentSerial()
+	assert.NotNil(mgr.Restore(&checkpoint{Serial: 1}))
+	assert.Equal(currentSN, mgr.CurrentSerial())
+}
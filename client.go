@@ -0,0 +1,167 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+)
+
+var errCacheReset = errors.New("received Cache Reset PDU")
+
+// rtrClient is a minimal RTR client to talk with any RTR cache.
+type rtrClient struct {
+	conn      net.Conn
+	scanner   *bufio.Scanner
+	sessionId uint16
+	serial    uint32
+}
+
+func dialRTR(addr string) (*rtrClient, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bufio.NewReader(conn))
+	scanner.Split(rtr.SplitRTR)
+	return &rtrClient{conn: conn, scanner: scanner}, nil
+}
+
+func (c *rtrClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *rtrClient) send(msg rtr.RTRMessage) error {
+	pdu, _ := msg.Serialize()
+	_, err := c.conn.Write(pdu)
+	return err
+}
+
+func (c *rtrClient) recv() (rtr.RTRMessage, error) {
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	return rtr.ParseRTR(c.scanner.Bytes())
+}
+
+// query sends a query, and returns Prefix PDUs received until End of Data.
+// It returns errCacheReset if the cache has no incremental update.
+func (c *rtrClient) query(q rtr.RTRMessage) ([]*rtr.RTRIPPrefix, error) {
+	if err := c.send(q); err != nil {
+		return nil, err
+	}
+	prefixes := []*rtr.RTRIPPrefix{}
+	for {
+		m, err := c.recv()
+		if err != nil {
+			return nil, err
+		}
+		switch msg := m.(type) {
+		case *rtr.RTRCacheResponse:
+			c.sessionId = msg.SessionID
+		case *rtr.RTRIPPrefix:
+			prefixes = append(prefixes, msg)
+		case *rtr.RTREndOfData:
+			c.serial = msg.SerialNumber
+			return prefixes, nil
+		case *rtr.RTRCacheReset:
+			return nil, errCacheReset
+		case *rtr.RTRErrorReport:
+			return nil, fmt.Errorf("received Error Report PDU (ErrorCode: %v, Text: %q)", msg.ErrorCode, msg.Text)
+		}
+	}
+}
+
+func (c *rtrClient) resetQuery() ([]*rtr.RTRIPPrefix, error) {
+	return c.query(rtr.NewRTRResetQuery())
+}
+
+func (c *rtrClient) serialQuery() ([]*rtr.RTRIPPrefix, error) {
+	return c.query(rtr.NewRTRSerialQuery(c.sessionId, c.serial))
+}
+
+func printPrefixes(w io.Writer, prefixes []*rtr.RTRIPPrefix) {
+	for _, p := range prefixes {
+		sign := "+"
+		if p.Flags == rtr.WITHDRAWAL {
+			sign = "-"
+		}
+		fmt.Fprintf(w, "%s %v/%v maxlen %v AS%v\n", sign, p.Prefix, p.PrefixLen, p.MaxLen, p.AS)
+	}
+}
+
+// watch prints ROAs of a full synchronization with the cache, and then
+// prints announced and withdrawn ROAs every time the cache notifies.
+func watch(addr string, w io.Writer) error {
+	c, err := dialRTR(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	fullSync := func() error {
+		prefixes, err := c.resetQuery()
+		if err != nil {
+			return err
+		}
+		printPrefixes(w, prefixes)
+		fmt.Fprintf(w, "# Synchronized %d ROA(s) (ID: %v, SN: %v)\n", len(prefixes), c.sessionId, c.serial)
+		return nil
+	}
+
+	if err := fullSync(); err != nil {
+		return err
+	}
+	for {
+		m, err := c.recv()
+		if err != nil {
+			return err
+		}
+		if _, ok := m.(*rtr.RTRSerialNotify); !ok {
+			continue
+		}
+		prefixes, err := c.serialQuery()
+		switch err {
+		case nil:
+			printPrefixes(w, prefixes)
+			fmt.Fprintf(w, "# Updated %d ROA(s) (ID: %v, SN: %v)\n", len(prefixes), c.sessionId, c.serial)
+		case errCacheReset:
+			if err := fullSync(); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+	}
+}
+
+type watchCommand struct{}
+
+func (cmd *watchCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return errors.New("specify an RTR cache to watch as HOST:PORT")
+	}
+	return watch(args[0], os.Stdout)
+}
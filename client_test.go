@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	assert := assert.New(t)
+
+	mgr, f := prepareOn(42424, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, _ := connectRTRServer(42424)
+	r.conn.Close()
+
+	pr, pw := io.Pipe()
+	go watch("127.0.0.1:42424", pw)
+	lines := bufio.NewScanner(pr)
+	readLine := func() string {
+		lines.Scan()
+		return lines.Text()
+	}
+
+	assert.Equal("+ 192.168.0.0/24 maxlen 24 AS65000", readLine())
+	assert.Regexp(`^# Synchronized 1 ROA\(s\) `, readLine())
+
+	addRPSL(f, []string{
+		"route:  192.168.1.0/24\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+	})
+	mgr.Reload()
+
+	assert.Equal("+ 192.168.1.0/24 maxlen 24 AS65001", readLine())
+	assert.Regexp(`^# Updated 1 ROA\(s\) `, readLine())
+}
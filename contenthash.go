@@ -0,0 +1,67 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/osrg/gobgp/pkg/packet/bgp"
+	log "github.com/sirupsen/logrus"
+)
+
+// contentHash returns the SHA-256 of the ROAs and ASPAs of the serial as
+// sorted tuples, to compare the data served by caches. It doesn't depend on
+// the order of sources or the serial number.
+func (rsrc *resource) contentHash(sn uint32) string {
+	lines := []string{}
+	for _, rf := range []bgp.RouteFamily{bgp.RF_IPv4_UC, bgp.RF_IPv6_UC} {
+		if tree, ok := rsrc.table[sn][rf]; ok {
+			for _, item := range treeToSet(tree).ToSlice() {
+				lines = append(lines, item.(string))
+			}
+		}
+	}
+	aspas := rsrc.aspas[sn]
+	for _, c := range aspas.customers() {
+		lines = append(lines, fmt.Sprintf("ASPA %d %v", c, aspas[c]))
+	}
+	sort.Strings(lines)
+	h := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(h[:])
+}
+
+// logContentHash logs the content hash on each load, to compare it across
+// caches.
+func (rsrc *resource) logContentHash() {
+	if rsrc.hash != "" {
+		log.Infof("Content hash is %v (SN: %v)", rsrc.hash, rsrc.currentSN)
+	}
+}
+
+// updateContentHash computes the hash of the current data with
+// --content-hash, and exports it as a metric.
+func (rsrc *resource) updateContentHash() {
+	if !commandOpts.ContentHash {
+		rsrc.hash = ""
+		return
+	}
+	rsrc.hash = rsrc.contentHash(rsrc.currentSN)
+	contentHash.Set(rsrc.hash)
+}
@@ -0,0 +1,57 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+
+	"github.com/osrg/gobgp/pkg/packet/bgp"
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+)
+
+// fullSyncStream is Prefix PDUs of a full synchronization serialized in
+// advance. It is built once per serial and protocol version, and written to
+// every router which sends Reset Query with --cache-full-sync. Cache Response
+// and End of Data PDUs carry the session ID, and are not a part of it.
+type fullSyncStream struct {
+	sn       uint32
+	families map[bgp.RouteFamily][]byte
+	counts   map[bgp.RouteFamily]int
+}
+
+func newFullSyncStream(sn uint32, lists FakeROATable, version uint8) *fullSyncStream {
+	s := &fullSyncStream{
+		sn:       sn,
+		families: map[bgp.RouteFamily][]byte{},
+		counts:   map[bgp.RouteFamily]int{},
+	}
+	for _, rf := range []bgp.RouteFamily{bgp.RF_IPv4_UC, bgp.RF_IPv6_UC} {
+		var buf bytes.Buffer
+		for _, v := range lists[rf][rtr.ANNOUNCEMENT] {
+			pdu, _ := rtr.NewRTRIPPrefix(v.Prefix, v.PrefixLen, v.MaxLen, v.AS, rtr.ANNOUNCEMENT).Serialize()
+			// gobgp builds PDUs of version 0
+			pdu[0] = version
+			buf.Write(pdu)
+		}
+		s.families[rf] = buf.Bytes()
+		s.counts[rf] = len(lists[rf][rtr.ANNOUNCEMENT])
+	}
+	return s
+}
+
+func (s *fullSyncStream) roas() int {
+	return s.counts[bgp.RF_IPv4_UC] + s.counts[bgp.RF_IPv6_UC]
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/osrg/gobgp/pkg/packet/bgp"
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+)
+
+// fuzzMaxLens returns lists with the MaxLen of each ROA replaced by a length
+// from the prefix length to the longest one of the family, to probe route
+// origin validation of routers. A length is chosen by the hash of the ROA and
+// the seed, so that the same seed gives the same lengths across full
+// synchronizations, reloads and runs, and a withdrawal in a delta matches the
+// announcement. ROAs which turn into the same one are sent once.
+func fuzzMaxLens(lists FakeROATable, seed int64) FakeROATable {
+	fuzzed := FakeROATable{}
+	for rf, list := range lists {
+		fuzzed[rf] = map[uint8][]*FakeROA{}
+		for flag, roas := range list {
+			fuzzed[rf][flag] = fuzzList(rf, roas, seed)
+		}
+	}
+	return fuzzed
+}
+
+// fuzzDelta returns the delta between the fuzzed tables of a router and of
+// the current one. ROAs may turn into the same one, which is withdrawn only
+// when none of them is left.
+func fuzzDelta(current, delta FakeROATable, seed int64) FakeROATable {
+	fuzzed := FakeROATable{}
+	for _, rf := range []bgp.RouteFamily{bgp.RF_IPv4_UC, bgp.RF_IPv6_UC} {
+		// The table of the router is the current one before the delta
+		announced := map[string]bool{}
+		for _, v := range delta[rf][rtr.ANNOUNCEMENT] {
+			announced[roaKey(v)] = true
+		}
+		old := []*FakeROA{}
+		for _, v := range current[rf][rtr.ANNOUNCEMENT] {
+			if !announced[roaKey(v)] {
+				old = append(old, v)
+			}
+		}
+		old = append(old, delta[rf][rtr.WITHDRAWAL]...)
+
+		before, after := fuzzList(rf, old, seed), fuzzList(rf, current[rf][rtr.ANNOUNCEMENT], seed)
+		fuzzed[rf] = map[uint8][]*FakeROA{
+			rtr.ANNOUNCEMENT: subtractROAs(after, before),
+			rtr.WITHDRAWAL:   subtractROAs(before, after),
+		}
+	}
+	return fuzzed
+}
+
+// fuzzList returns the ROAs with fuzzed MaxLens. ROAs which turn into the
+// same one are returned once.
+func fuzzList(rf bgp.RouteFamily, roas []*FakeROA, seed int64) []*FakeROA {
+	bits := uint32(32)
+	if rf == bgp.RF_IPv6_UC {
+		bits = 128
+	}
+	seen := map[string]bool{}
+	mutated := []*FakeROA{}
+	for _, v := range roas {
+		h := fnv.New32a()
+		fmt.Fprintf(h, "%d-%v/%v-%v-%v", seed, v.Prefix, v.PrefixLen, v.MaxLen, v.AS)
+		m := &FakeROA{
+			Prefix:    v.Prefix,
+			PrefixLen: v.PrefixLen,
+			MaxLen:    v.PrefixLen + uint8(h.Sum32()%(bits-uint32(v.PrefixLen)+1)),
+			AS:        v.AS,
+		}
+		if key := roaKey(m); !seen[key] {
+			seen[key] = true
+			mutated = append(mutated, m)
+		}
+	}
+	return mutated
+}
+
+// subtractROAs returns ROAs in a but not in b.
+func subtractROAs(a, b []*FakeROA) []*FakeROA {
+	in := map[string]bool{}
+	for _, v := range b {
+		in[roaKey(v)] = true
+	}
+	result := []*FakeROA{}
+	for _, v := range a {
+		if !in[roaKey(v)] {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/osrg/gobgp/pkg/packet/bgp"
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFuzzMaxLens(t *testing.T) {
+	assert := assert.New(t)
+
+	lists := FakeROATable{
+		bgp.RF_IPv4_UC: map[uint8][]*FakeROA{rtr.ANNOUNCEMENT: {}},
+		bgp.RF_IPv6_UC: map[uint8][]*FakeROA{rtr.ANNOUNCEMENT: {}},
+	}
+	for i := 0; i < 100; i++ {
+		lists[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT] = append(lists[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT],
+			&FakeROA{Prefix: net.ParseIP(fmt.Sprintf("10.%d.0.0", i)).To4(), PrefixLen: uint8(8 + i%25), MaxLen: uint8(8 + i%25), AS: 65000})
+		lists[bgp.RF_IPv6_UC][rtr.ANNOUNCEMENT] = append(lists[bgp.RF_IPv6_UC][rtr.ANNOUNCEMENT],
+			&FakeROA{Prefix: net.ParseIP(fmt.Sprintf("2001:db8:%x::", i)), PrefixLen: uint8(32 + i%97), MaxLen: uint8(32 + i%97), AS: 65000})
+	}
+
+	fuzzed := fuzzMaxLens(lists, 42)
+	varied := 0
+	for rf, bits := range map[bgp.RouteFamily]uint8{bgp.RF_IPv4_UC: 32, bgp.RF_IPv6_UC: 128} {
+		roas := fuzzed[rf][rtr.ANNOUNCEMENT]
+		assert.Len(roas, 100)
+		for _, v := range roas {
+			assert.True(v.MaxLen >= v.PrefixLen && v.MaxLen <= bits, "%v/%v maxlen %v", v.Prefix, v.PrefixLen, v.MaxLen)
+			if v.MaxLen != v.PrefixLen {
+				varied++
+			}
+		}
+	}
+	assert.True(varied > 100)
+	// The original ROAs are kept as they are
+	assert.Equal(uint8(8), lists[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT][0].MaxLen)
+
+	// The same seed gives the same lengths, and another seed doesn't
+	assert.Equal(fuzzed, fuzzMaxLens(lists, 42))
+	assert.NotEqual(fuzzed, fuzzMaxLens(lists, 43))
+}
+
+func TestFuzzDelta(t *testing.T) {
+	assert := assert.New(t)
+
+	roa := func(maxLen uint8) *FakeROA {
+		return &FakeROA{Prefix: net.ParseIP("10.0.0.0").To4(), PrefixLen: 30, MaxLen: maxLen, AS: 65000}
+	}
+	table := func(announced, withdrawn []*FakeROA) FakeROATable {
+		return FakeROATable{
+			bgp.RF_IPv4_UC: {rtr.ANNOUNCEMENT: announced, rtr.WITHDRAWAL: withdrawn},
+			bgp.RF_IPv6_UC: {rtr.ANNOUNCEMENT: {}, rtr.WITHDRAWAL: {}},
+		}
+	}
+	// Find a seed which turns both ROAs into the same one
+	a, b := roa(30), roa(31)
+	seed := int64(0)
+	for len(fuzzList(bgp.RF_IPv4_UC, []*FakeROA{a, b}, seed)) != 1 {
+		seed++
+	}
+	shared := fuzzList(bgp.RF_IPv4_UC, []*FakeROA{a}, seed)
+
+	// The fuzzed ROA is kept while a is left
+	delta := fuzzDelta(table([]*FakeROA{a}, nil), table(nil, []*FakeROA{b}), seed)
+	assert.Empty(delta[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT])
+	assert.Empty(delta[bgp.RF_IPv4_UC][rtr.WITHDRAWAL])
+
+	// and withdrawn when both are gone
+	delta = fuzzDelta(table(nil, nil), table(nil, []*FakeROA{a, b}), seed)
+	assert.Empty(delta[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT])
+	assert.Equal(shared, delta[bgp.RF_IPv4_UC][rtr.WITHDRAWAL])
+
+	// A ROA added while the other one backs the fuzzed ROA is not announced
+	// again
+	delta = fuzzDelta(table([]*FakeROA{a, b}, nil), table([]*FakeROA{b}, nil), seed)
+	assert.Empty(delta[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT])
+	assert.Empty(delta[bgp.RF_IPv4_UC][rtr.WITHDRAWAL])
+
+	// The delta is the difference of the fuzzed tables
+	c := roa(32)
+	delta = fuzzDelta(table([]*FakeROA{a, c}, nil), table([]*FakeROA{c}, []*FakeROA{b}), seed)
+	assert.Equal(subtractROAs(fuzzList(bgp.RF_IPv4_UC, []*FakeROA{a, c}, seed), shared), delta[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT])
+	assert.Empty(delta[bgp.RF_IPv4_UC][rtr.WITHDRAWAL])
+}
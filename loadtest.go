@@ -0,0 +1,157 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+)
+
+type loadtestStats struct {
+	sessions  int
+	queries   int
+	roas      int
+	errors    int
+	elapsed   time.Duration
+	latencies []time.Duration
+}
+
+func (s *loadtestStats) merge(o *loadtestStats) {
+	s.sessions += o.sessions
+	s.queries += o.queries
+	s.roas += o.roas
+	s.errors += o.errors
+	s.latencies = append(s.latencies, o.latencies...)
+}
+
+// percentile returns the p-th percentile of the query latencies.
+func (s *loadtestStats) percentile(p int) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	i := len(s.latencies) * p / 100
+	if i >= len(s.latencies) {
+		i = len(s.latencies) - 1
+	}
+	return s.latencies[i]
+}
+
+func (s *loadtestStats) print(w io.Writer) {
+	fmt.Fprintf(w, "Sessions:   %d\n", s.sessions)
+	fmt.Fprintf(w, "Queries:    %d (%.1f/s)\n", s.queries, float64(s.queries)/s.elapsed.Seconds())
+	fmt.Fprintf(w, "ROAs:       %d (%.1f/s)\n", s.roas, float64(s.roas)/s.elapsed.Seconds())
+	fmt.Fprintf(w, "Errors:     %d\n", s.errors)
+	fmt.Fprintf(w, "Latency:    p50 %v, p90 %v, p99 %v, max %v\n", s.percentile(50), s.percentile(90), s.percentile(99), s.percentile(100))
+}
+
+// loadtestSession does a full synchronization, and then sends Serial Queries
+// every interval until the deadline.
+func loadtestSession(target string, deadline time.Time, interval time.Duration) *loadtestStats {
+	stats := &loadtestStats{}
+	c, err := dialRTR(target)
+	if err != nil {
+		stats.errors++
+		return stats
+	}
+	defer c.Close()
+	c.conn.SetDeadline(deadline.Add(10 * time.Second))
+	stats.sessions++
+
+	query := func(fullSync bool) error {
+		start := time.Now()
+		var prefixes []*rtr.RTRIPPrefix
+		var err error
+		if fullSync {
+			prefixes, err = c.resetQuery()
+		} else {
+			prefixes, err = c.serialQuery()
+		}
+		if err != nil {
+			return err
+		}
+		stats.queries++
+		stats.roas += len(prefixes)
+		stats.latencies = append(stats.latencies, time.Since(start))
+		return nil
+	}
+
+	fullSync := true
+	for {
+		switch err := query(fullSync); err {
+		case nil:
+			fullSync = false
+		case errCacheReset:
+			fullSync = true
+			continue
+		default:
+			stats.errors++
+			return stats
+		}
+		wait := interval
+		if d := time.Until(deadline); d < wait {
+			wait = d
+		}
+		if wait <= 0 {
+			return stats
+		}
+		time.Sleep(wait)
+	}
+}
+
+// loadtest runs the given number of RTR sessions concurrently against the
+// target for the duration, and returns the summary of them.
+func loadtest(target string, clients int, duration, interval time.Duration) *loadtestStats {
+	start := time.Now()
+	deadline := start.Add(duration)
+
+	ch := make(chan *loadtestStats, clients)
+	for i := 0; i < clients; i++ {
+		go func() {
+			ch <- loadtestSession(target, deadline, interval)
+		}()
+	}
+
+	stats := &loadtestStats{}
+	for i := 0; i < clients; i++ {
+		stats.merge(<-ch)
+	}
+	stats.elapsed = time.Since(start)
+	sort.Slice(stats.latencies, func(i, j int) bool {
+		return stats.latencies[i] < stats.latencies[j]
+	})
+	return stats
+}
+
+type loadtestCommand struct {
+	Target   string        `long:"target" required:"true" description:"Specify an RTR cache as HOST:PORT"`
+	Clients  int           `long:"clients" default:"10" description:"Specify the number of concurrent RTR sessions"`
+	Duration time.Duration `long:"duration" default:"60s" description:"Specify how long to run the test"`
+	Interval time.Duration `long:"interval" default:"1s" description:"Specify the interval of Serial Queries in each session"`
+}
+
+func (cmd *loadtestCommand) Execute(args []string) error {
+	if cmd.Clients <= 0 {
+		return errors.New("specify a positive number of clients")
+	}
+	loadtest(cmd.Target, cmd.Clients, cmd.Duration, cmd.Interval).print(os.Stdout)
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadtest(t *testing.T) {
+	assert := assert.New(t)
+
+	_, f := prepareOn(42427, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, _ := connectRTRServer(42427)
+	r.conn.Close()
+
+	stats := loadtest("127.0.0.1:42427", 5, 500*time.Millisecond, 100*time.Millisecond)
+
+	assert.Equal(5, stats.sessions)
+	assert.Equal(0, stats.errors)
+	assert.True(stats.queries >= 5*2, "queries: %d", stats.queries)
+	assert.Equal(len(stats.latencies), stats.queries)
+	// Only the full synchronizations carry the ROA
+	assert.Equal(5, stats.roas)
+	assert.True(stats.percentile(50) <= stats.percentile(99))
+
+	var buf bytes.Buffer
+	stats.print(&buf)
+	assert.Contains(buf.String(), "Sessions:   5\n")
+	assert.Contains(buf.String(), "Errors:     0\n")
+}
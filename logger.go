@@ -0,0 +1,106 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// asyncWriter hands log lines over to a goroutine, so that a slow log sink
+// never stalls RTR sessions. Lines are dropped while the buffer is full.
+type asyncWriter struct {
+	w     io.Writer
+	ch    chan []byte
+	flush chan chan struct{}
+}
+
+func newAsyncWriter(w io.Writer, size int) *asyncWriter {
+	a := &asyncWriter{
+		w:     w,
+		ch:    make(chan []byte, size),
+		flush: make(chan chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *asyncWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	select {
+	case a.ch <- buf:
+	default:
+		logDropped.Add(1)
+	}
+	return len(p), nil
+}
+
+// Flush waits for the buffered lines to be written out, but gives up after
+// the timeout if the log sink is stuck.
+func (a *asyncWriter) Flush(timeout time.Duration) {
+	done := make(chan struct{})
+	select {
+	case a.flush <- done:
+	case <-time.After(timeout):
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+func (a *asyncWriter) run() {
+	for {
+		select {
+		case buf := <-a.ch:
+			a.w.Write(buf)
+		case done := <-a.flush:
+			for n := len(a.ch); n > 0; n-- {
+				a.w.Write(<-a.ch)
+			}
+			close(done)
+		}
+	}
+}
+
+// newSessionLogger returns a logger which writes to the same sink as the
+// standard logger but at its own level, to trace a session selected by
+// --debug-ip without the logs of the other sessions.
+func newSessionLogger(level log.Level) *log.Logger {
+	std := log.StandardLogger()
+	l := log.New()
+	l.Out = std.Out
+	l.Formatter = std.Formatter
+	l.Hooks = std.Hooks
+	l.SetLevel(level)
+	return l
+}
+
+// isDebugIP returns true if the address is of --debug-ip.
+func isDebugIP(addr net.Addr) bool {
+	ip := addrIP(addr)
+	for _, s := range commandOpts.DebugIPs {
+		if ip != nil && ip.Equal(net.ParseIP(s)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/osrg/gobgp/pkg/packet/bgp"
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+type blockingWriter struct {
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return len(p), nil
+}
+
+func TestAsyncWriterWithBlockingOutput(t *testing.T) {
+	assert := assert.New(t)
+
+	bw := &blockingWriter{unblock: make(chan struct{})}
+	defer close(bw.unblock)
+	log.SetOutput(newAsyncWriter(bw, 4))
+	log.SetLevel(log.DebugLevel)
+	defer func() {
+		log.SetOutput(ioutil.Discard)
+		log.SetLevel(log.InfoLevel)
+	}()
+
+	lists := FakeROATable{
+		bgp.RF_IPv4_UC: map[uint8][]*FakeROA{},
+		bgp.RF_IPv6_UC: map[uint8][]*FakeROA{},
+	}
+	for i := 0; i < 100; i++ {
+		lists[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT] = append(lists[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT], &FakeROA{
+			Prefix:    net.IPv4(10, byte(i), 0, 0).To4(),
+			PrefixLen: 16,
+			MaxLen:    16,
+			AS:        65000,
+		})
+	}
+
+	r, client := newConnPair()
+	defer r.conn.Close()
+	defer client.Close()
+	go ioutil.ReadAll(client)
+
+	dropped := logDropped.Value()
+	done := make(chan error, 1)
+	go func() {
+		done <- r.cacheResponse(1, lists, nil, 0)
+	}()
+
+	select {
+	case err := <-done:
+		assert.Nil(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("cacheResponse was blocked by the log output")
+	}
+	// 102 lines are logged, and at most 5 of them fit in the buffer and the writer
+	assert.True(logDropped.Value()-dropped >= 97, "dropped %d lines", logDropped.Value()-dropped)
+}
+
+func TestDebugIP(t *testing.T) {
+	assert := assert.New(t)
+
+	commandOpts.DebugIPs = []string{"127.0.0.2"}
+	defer func() { commandOpts.DebugIPs = nil }()
+	_, f := prepareOn(42455, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	traced, traceScanner := dialRTRServerFrom("127.0.0.2", 42455)
+	defer traced.conn.Close()
+	other, otherScanner := dialRTRServerFrom("127.0.0.1", 42455)
+	defer other.conn.Close()
+	// mainLoop in quiet mode has suppressed logs
+	level := log.GetLevel()
+	log.SetLevel(log.InfoLevel)
+	defer log.SetLevel(level)
+
+	resetQuery := func(r *rtrConn, scanner *bufio.Scanner) {
+		r.sendPDU(rtr.NewRTRResetQuery())
+		for scanner.Scan() {
+			if m, _ := rtr.ParseRTR(scanner.Bytes()); m != nil {
+				if _, ok := m.(*rtr.RTREndOfData); ok {
+					return
+				}
+			}
+		}
+	}
+	resetQuery(traced, traceScanner)
+	resetQuery(other, otherScanner)
+
+	entries := map[string]map[log.Level]int{"127.0.0.1:": {}, "127.0.0.2:": {}}
+	for _, e := range hook.AllEntries() {
+		for ip := range entries {
+			if strings.Contains(e.Message, ip) {
+				entries[ip][e.Level]++
+			}
+		}
+	}
+	assert.NotZero(entries["127.0.0.2:"][log.TraceLevel])
+	assert.NotZero(entries["127.0.0.2:"][log.DebugLevel])
+	assert.NotZero(entries["127.0.0.1:"][log.InfoLevel])
+	assert.Zero(entries["127.0.0.1:"][log.TraceLevel])
+	assert.Zero(entries["127.0.0.1:"][log.DebugLevel])
+}
@@ -17,10 +17,13 @@ package main
 
 import (
 	"fmt"
+	"math/rand"
+	"net"
 	"os"
 	"os/signal"
 	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 	log "github.com/sirupsen/logrus"
@@ -29,16 +32,91 @@ import (
 var version string
 
 var commandOpts struct {
-	Debug     bool   `short:"d" long:"debug" description:"Show verbose debug information"`
-	Interval  string `short:"i" long:"interval" default:"" description:"Specify minutes for reloading pseudo ROA table. You can use crontab spec(eg. \"*/5\" and \"3,13,23,33,43,53\")"`
-	UseMaxLen bool   `short:"m" long:"maxlen" description:"Use 32 or 128 as MaxLen value, 32 for IPv4, 128 for IPv6. By default(=false), use the same length to the prefix length"`
-	Port      int    `short:"p" long:"port" default:"323" description:"Specify listen port for RTR"`
-	Quiet     bool   `short:"q" long:"quiet" description:"Quiet mode"`
-	Version   func() `short:"v" long:"version" description:"Show version"`
+	Address        string        `long:"address" default:"" description:"Specify an address to listen on for RTR, eg. 192.0.2.1 or ::1, instead of all addresses"`
+	Admin          string        `long:"admin" default:"" description:"Specify listen address for the admin HTTP API(eg. \"127.0.0.1:8323\"). By default, the admin API is disabled"`
+	AllowFrom      []string      `long:"allow-from" description:"Accept RTR connections only from the CIDR(eg. \"192.0.2.0/24\", \"2001:db8::/32\"). You can use this option multiple times. By default, connections from any address are accepted"`
+	ASNFilter      []asn         `long:"asn-filter" description:"Serve only ROAs of the ASN(eg. 65000, AS65000). You can use this option multiple times"`
+	Blocklist      string        `long:"blocklist" description:"Specify a file of CIDRs never to be served. ROAs of the prefixes and more specifics are dropped"`
+	CacheFullSync  bool          `long:"cache-full-sync" description:"Serialize Prefix PDUs of a full synchronization once per serial, and write them to every router which sends Reset Query. Not used with --full-sync-rate or for canary peers"`
+	ChangesFile    string        `long:"changes-file" description:"Specify a file of ROAs added and withdrawn by lines like \"+ 192.0.2.0/24 24 AS65000\", which are applied since the data loaded from the ROA sources without reloading them. The file is appended to, and read from where it was left off"`
+	ChangeInterval time.Duration `long:"changes-interval" default:"10s" description:"Specify the interval of reading new lines of --changes-file"`
+	Checkpoint     string        `long:"checkpoint" description:"Specify a file to save the serial history and session ID to, and restore them from on startup"`
+	CkptInterval   time.Duration `long:"checkpoint-interval" default:"1m" description:"Specify the interval of saving the checkpoint"`
+	CloseGrace     time.Duration `long:"close-grace" default:"1s" description:"Specify how long to wait for a router to close the connection after the cache has finished the session"`
+	ContentHash    bool          `long:"content-hash" description:"Compute the SHA-256 of the sorted ROAs and ASPAs served, which is logged on each reload and shown by /status and /debug/vars of the admin API, to confirm that caches serve the same data"`
+	Datasets       []string      `long:"dataset" description:"Specify an additional dataset as NAME:RPSLFILE for per-peer views. You can use this option multiple times"`
+	Debug          bool          `short:"d" long:"debug" description:"Show verbose debug information"`
+	DebugIPs       []string      `long:"debug-ip" description:"Log sessions with the router of the source IP address at trace level, including every PDU, while the others keep the level. You can use this option multiple times"`
+	DeltaRate      int           `long:"delta-rate" default:"0" description:"Specify the maximum number of Prefix PDUs sent per second in an incremental update. 0 means unlimited"`
+	ErrorText      string        `long:"error-text" default:"" description:"Specify a text attached to Error Report PDUs. {session}, {serial} and {code} are replaced with the session ID, the serial number and the error code"`
+	Expire         int           `long:"expire-interval" default:"7200" description:"Specify the Expire Interval in seconds sent to routers of version 1"`
+	FamilyDelay    time.Duration `long:"family-delay" default:"0" description:"Specify how long to wait after IPv4 Prefix PDUs before sending IPv6 ones in each response, to simulate a cache which sources the families separately"`
+	FamilyMarker   bool          `long:"family-marker" description:"Log the boundary of IPv4 and IPv6 Prefix PDUs in each response. This is not a part of RTR, and nothing is sent to routers"`
+	FinalSerial    bool          `long:"final-serial" description:"Put the serial number last sent to the router into the text of Error Report PDU when the cache closes the session, eg. for shutdown"`
+	FullSyncJitter time.Duration `long:"full-sync-jitter" default:"0" description:"Specify the maximum random delay before starting each full synchronization to spread the load of routers reconnecting at once(eg. \"2s\"). 0 means disabled"`
+	FullSyncRate   int           `long:"full-sync-rate" default:"0" description:"Specify the maximum number of Prefix PDUs sent per second in a full synchronization. 0 means unlimited"`
+	FutureVers     int           `long:"future-versions" default:"0" description:"Specify the number of protocol versions beyond the latest one, 2, which are answered by Error Report PDU of unsupported protocol version. A PDU of a higher version is taken as from a non-RTR client, and the connection is closed without any PDU"`
+	FuzzMaxLen     int64         `long:"fuzz-maxlen" default:"0" description:"Serve every ROA with a MaxLen from the prefix length to 32 or 128, chosen pseudo-randomly by the seed, to fuzz route origin validation of routers. The same seed gives the same MaxLens. 0 means disabled. This mutates the data served, use it only for testing"`
+	IdleTimeout    time.Duration `long:"idle-timeout" default:"0" description:"Specify how long to wait for a PDU from a router before closing the connection. 0 means the Expire Interval for routers of version 1, and no timeout for version 0"`
+	Interval       string        `short:"i" long:"interval" default:"" description:"Specify minutes for reloading pseudo ROA table. You can use crontab spec(eg. \"*/5\" and \"3,13,23,33,43,53\")"`
+	LazyLoad       bool          `long:"lazy-load" description:"Skip loading RPSLFILES and --roa-file on startup, and load them when the first router connects. The router gets No Data Available until they are loaded"`
+	LoadWorkers    int           `long:"load-workers" default:"0" description:"Specify the number of goroutines to parse sources (0 means GOMAXPROCS)"`
+	LogBuffer      int           `long:"log-buffer" default:"0" description:"Specify the number of log lines buffered for a slow log output, eg. 4096. Lines are dropped while the buffer is full. Logs are unbuffered by default"`
+	MaxASNs        int           `long:"max-asns" default:"0" description:"Specify the maximum number of distinct ASNs per prefix. ROAs beyond it are dropped. 0 means unlimited"`
+	MaxDelta       int           `long:"max-delta" default:"0" description:"Specify the maximum number of Prefix PDUs in an incremental update for memory-limited routers. A larger delta is answered by Cache Reset PDU to force a full synchronization. 0 means unlimited"`
+	MaxErrReports  int           `long:"max-error-reports" default:"100" description:"Specify the maximum number of Error Report PDUs sent to a router without closing the session, eg. for No Data Available. The session is closed without another report beyond it. A protocol error always closes the session after one report. 0 means unlimited"`
+	MaxHistory     int           `long:"max-history" default:"0" description:"Specify the maximum number of past serials to keep for incremental updates. Routers at an older serial get Cache Reset and a full synchronization. Each serial keeps a whole table in memory, so a smaller history saves memory at the cost of full synchronizations. 0 means serials are kept for 24 hours"`
+	MaxPrefixLen4  int           `long:"max-prefixlen4" default:"0" description:"Specify the maximum prefix length of IPv4 ROAs to serve. 0 means unlimited"`
+	MaxPrefixLen6  int           `long:"max-prefixlen6" default:"0" description:"Specify the maximum prefix length of IPv6 ROAs to serve. 0 means unlimited"`
+	MaxQueryRate   int           `long:"max-query-rate" default:"0" description:"Specify the maximum number of query PDUs per second from a router. The session of a router exceeding it is closed. 0 means unlimited"`
+	MaxSessions    int           `long:"max-sessions" default:"0" description:"Specify the maximum number of concurrent RTR sessions. Connections over it are closed right after accepted. 0 means unlimited"`
+	MaxVersion     int           `long:"max-version" default:"1" choice:"0" choice:"1" choice:"2" description:"Specify the highest RTR protocol version to serve. The version of the first PDU from a router is used for the session. Version 2 of draft-ietf-sidrops-8210bis adds ASPA PDUs, which are sent only to routers of version 2"`
+	UseMaxLen      bool          `short:"m" long:"maxlen" description:"Use 32 or 128 as MaxLen value, 32 for IPv4, 128 for IPv6. By default(=false), use the same length to the prefix length"`
+	MergePolicy    string        `long:"merge-policy" default:"union" choice:"union" choice:"primary-wins" choice:"fallback" description:"Specify how to merge RPSLFILES in order of priority. \"primary-wins\" ignores ROAs of a prefix which a preceding file has, and \"fallback\" uses only the first file having any ROA"`
+	MinPrefixLen4  int           `long:"min-prefixlen4" default:"0" description:"Specify the minimum prefix length of IPv4 ROAs to serve"`
+	MinPrefixLen6  int           `long:"min-prefixlen6" default:"0" description:"Specify the minimum prefix length of IPv6 ROAs to serve"`
+	MinVersion     int           `long:"min-version" default:"0" choice:"0" choice:"1" choice:"2" description:"Specify the lowest RTR protocol version to serve, to reject routers of older versions"`
+	NotifyDebounce time.Duration `long:"notify-debounce" default:"0" description:"Specify how long to wait after an update before Serial Notify PDUs to all routers, so that updates in a burst, eg. by a reload, are sent as one notification of the latest serial(eg. \"1s\"). 0 means disabled"`
+	NotifyInterval time.Duration `long:"notify-interval" default:"0" description:"Specify the minimum interval of Serial Notify PDUs to all routers, so that updates in a burst are coalesced(eg. \"500ms\"). 0 means disabled"`
+	OnEmpty        string        `long:"on-empty" default:"delta" choice:"delta" choice:"cache-reset" choice:"no-data" description:"Specify how to tell routers that the table has become empty. \"cache-reset\" sends Cache Reset PDU instead of withdrawing all ROAs, and \"no-data\" sends No Data Available Error Report PDU"`
+	Peers          string        `long:"peers" description:"Specify a file which maps source CIDRs of routers to dataset names. Unmapped routers get the default dataset loaded from RPSLFILES"`
+	PingInterval   time.Duration `long:"ping-interval" default:"0" description:"Specify the interval of sending Serial Notify PDUs to detect dead routers(eg. \"30s\"). 0 means disabled"`
+	Port           int           `short:"p" long:"port" default:"323" description:"Specify listen port for RTR"`
+	Quiet          bool          `short:"q" long:"quiet" description:"Quiet mode"`
+	RawCacheSize   int           `long:"raw-cache-size" default:"1048576" description:"Specify the maximum size in bytes of each source cached as read for /raw of the admin API. 0 means disabled"`
+	ReaddChanged   bool          `long:"readd-changed" description:"Send every changed prefix as a withdrawal of all its old ROAs followed by an announcement of all its new ROAs in incremental updates, for testing routers"`
+	Refresh        int           `long:"refresh-interval" default:"3600" description:"Specify the Refresh Interval in seconds sent to routers of version 1"`
+	RejectASNs     []asnRange    `long:"reject-asn" description:"Drop ROAs of the ASN or the range of ASNs(eg. \"0\", \"64496-64511\"). You can use this option multiple times"`
+	ReloadSummary  string        `long:"reload-summary" default:"info" choice:"info" choice:"debug" choice:"off" description:"Specify the log level of the summary of ROAs added and withdrawn on each reload"`
+	RepeatReset    time.Duration `long:"repeat-reset-window" default:"0" description:"Answer a Reset Query without ROAs if it comes within the duration after the last full synchronization and the serial number is unchanged(eg. \"10s\"). This is not standard, and 0 means disabled"`
+	Retry          int           `long:"retry-interval" default:"600" description:"Specify the Retry Interval in seconds sent to routers of version 1"`
+	ROAFiles       []string      `long:"roa-file" description:"Specify a JSON file of ROAs exported by a validator like routinator or rpki-client, whose ROAs and ASPAs are served in addition to RPSLFILES. You can use this option multiple times"`
+	Schema         string        `long:"schema" description:"Specify a JSON schema file which files of --roa-file are validated against before being loaded. A file not matching it fails the whole load, and the current data is kept"`
+	SerialMode     string        `long:"serial-mode" default:"time" choice:"time" choice:"step" choice:"changes" choice:"random" choice:"random-increment" description:"Specify how to assign a serial number to new data. \"step\" advances it by --serial-step, and \"changes\" by the number of changed ROAs. The others than \"time\" are for testing routers"`
+	SerialStep     int           `long:"serial-step" default:"1" description:"Specify the increment of serial numbers in \"step\" serial mode"`
+	SoRcvbuf       int           `long:"so-rcvbuf" default:"0" description:"Specify the socket receive buffer size of RTR connections in bytes. 0 means the OS default"`
+	SoSndbuf       int           `long:"so-sndbuf" default:"0" description:"Specify the socket send buffer size of RTR connections in bytes. 0 means the OS default"`
+	Sort           string        `long:"sort" default:"prefix" choice:"prefix" choice:"asn" choice:"maxlen" description:"Specify the order of ROAs sent in a full synchronization"`
+	SplitListeners bool          `long:"split-listeners" description:"Listen on IPv4 and IPv6 with separate sockets instead of a dual-stack socket"`
+	SSHAuthKeys    string        `long:"ssh-authorized-keys" description:"Specify an authorized_keys file of routers allowed to connect over SSH"`
+	SSHHostKey     string        `long:"ssh-host-key" description:"Specify a PEM private key file of the SSH host key"`
+	SSHPort        int           `long:"ssh-port" default:"0" description:"Specify listen port for RTR over SSH as RFC 6810, which routers use by the \"rpki-rtr\" subsystem. 0 means not to listen"`
+	Standby        bool          `long:"standby" description:"Load and keep data up to date, but do not accept RTR connections until promoted by SIGUSR1 or the admin API"`
+	StatsInterval  time.Duration `long:"stats-interval" default:"0" description:"Specify the interval of logging stats of sessions, sent PDUs and ROAs(eg. \"1m\"). 0 means disabled"`
+	StopTimeout    time.Duration `long:"stop-timeout" default:"5s" description:"Specify how long to wait for sessions to close, and for a reload in progress to finish before aborting it, on SIGINT or SIGTERM"`
+	TestVectors    bool          `long:"test-vectors" description:"Serve a built-in set of ROAs covering edge cases for conformance testing, in addition to RPSLFILES"`
+	TLSCert        string        `long:"tls-cert" description:"Specify a PEM certificate file to serve RTR over TLS(eg. on port 324 as RFC 6810). Requires --tls-key"`
+	TLSClientCA    string        `long:"tls-client-ca" description:"Specify a PEM file of CA certificates, and require routers to present a client certificate signed by one of them"`
+	TLSKey         string        `long:"tls-key" description:"Specify a PEM private key file of --tls-cert"`
+	Version        func()        `short:"v" long:"version" description:"Show version"`
+	WatchDebounce  time.Duration `long:"watch-debounce" default:"1s" description:"Specify how long to wait for writes to a watched ROA file to settle before reloading"`
+	WatchROAFile   bool          `long:"watch-roa-file" description:"Reload when a file specified by --roa-file is changed, without waiting for SIGHUP or --interval"`
+	WriteRetries   int           `long:"write-retries" default:"0" description:"Specify the number of retries of a write to a router failed by a temporary network error, with a backoff from 10ms doubling up to 1s, before closing the session"`
 }
 
 func init() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
+	rand.Seed(time.Now().UnixNano())
 
 	commandOpts.Version = func() {
 		fmt.Println(version)
@@ -64,14 +142,71 @@ func mainLoop(mgr *ResourceManager, args []string, port int, interval string, de
 		}
 	}
 
-	// Load IRR data
-	err := mgr.Load(args)
+	// Load IRR data, or only find the files with --lazy-load
+	load := mgr.Load
+	if commandOpts.LazyLoad {
+		load = mgr.LoadLazily
+	}
+	err := load(args)
+	checkError(err)
+
+	// Restore the serial history saved before the restart
+	var cp *checkpoint
+	if commandOpts.Checkpoint != "" {
+		cp = restoreCheckpoint(mgr, commandOpts.Checkpoint)
+	}
+
+	// Load datasets for per-peer views
+	views, err := newPeerViews(mgr, commandOpts.Datasets, commandOpts.Peers)
 	checkError(err)
 
 	// Prepare RTR server
 	rtrServer := newRTRServer(port)
+	rtrServer.listenHost = commandOpts.Address
+	if cp != nil {
+		rtrServer.sessionId = cp.SessionID
+	}
+	rtrServer.allowlist, err = parseAllowlist(commandOpts.AllowFrom)
+	checkError(err)
+	rtrServer.tlsConfig, err = loadTLSConfig(commandOpts.TLSCert, commandOpts.TLSKey, commandOpts.TLSClientCA)
+	checkError(err)
+	if rtrServer.tlsConfig != nil {
+		log.Infof("Serving RTR over TLS")
+	}
+	if commandOpts.SSHPort > 0 {
+		rtrServer.sshConfig, err = loadSSHConfig(commandOpts.SSHHostKey, commandOpts.SSHAuthKeys)
+		checkError(err)
+		rtrServer.sshPort = commandOpts.SSHPort
+		log.Infof("Serving RTR over SSH on port %v", commandOpts.SSHPort)
+	}
+	if commandOpts.SplitListeners {
+		rtrServer.networks = []string{"tcp4", "tcp6"}
+	}
 	go rtrServer.run()
 	log.Infof("Daemon started")
+	if mode := commandOpts.SerialMode; mode != "" && mode != "time" {
+		log.Warnf("Serial numbers are assigned in %q mode for testing routers. Do not use it for production!", commandOpts.SerialMode)
+	}
+
+	// Prepare admin API server
+	if commandOpts.Admin != "" {
+		adminServer := newAdminServer(commandOpts.Admin, mgr)
+		adminServer.rtrServer = rtrServer
+		go adminServer.run()
+		log.Infof("Admin API started on %v", commandOpts.Admin)
+	}
+
+	if commandOpts.ChangesFile != "" {
+		go changesLoop(mgr, &changeJournal{fileName: commandOpts.ChangesFile}, time.NewTicker(commandOpts.ChangeInterval).C)
+	}
+
+	if commandOpts.StatsInterval > 0 {
+		go logStats(mgr, time.NewTicker(commandOpts.StatsInterval).C)
+	}
+
+	if commandOpts.Checkpoint != "" && commandOpts.CkptInterval > 0 {
+		go checkpointLoop(mgr, rtrServer.sessionId, commandOpts.Checkpoint, time.NewTicker(commandOpts.CkptInterval).C)
+	}
 
 	// cron for managing time
 	alarmCh := make(chan bool)
@@ -80,23 +215,80 @@ func mainLoop(mgr *ResourceManager, args []string, port int, interval string, de
 		go timeKeeper(alarmCh, cronSpec)
 	}
 
+	// Reload when ROA files are changed
+	watchCh := make(chan bool)
+	if commandOpts.WatchROAFile && len(commandOpts.ROAFiles) > 0 {
+		checkError(watchFiles(commandOpts.ROAFiles, commandOpts.WatchDebounce, watchCh))
+	}
+
+	reloads := newReloader()
+	// pendingLoad is set until the first load of --lazy-load, and firstLoad
+	// is closed when it finishes
+	pendingLoad := commandOpts.LazyLoad
+	var firstLoad <-chan struct{}
 	for {
 		select {
 		case conn := <-rtrServer.connCh:
 			log.Infof("Accepted a new connection from %v", conn.remoteAddr)
-			go handleRTR(conn, mgr)
+			if pendingLoad {
+				log.Infof("Loading the resource for the first connection")
+				pendingLoad = false
+				firstLoad = reloads.reload(views)
+			}
+			conn.loaded = firstLoad
+			conn.fullSyncOnly = views.fullSyncOnly(conn.remoteAddr)
+			if conn.pinnedVersion, conn.pinned = views.pinnedVersion(conn.remoteAddr); conn.pinned {
+				log.Infof("Pinning protocol version %v for %v", conn.pinnedVersion, conn.remoteAddr)
+			}
+			if conn.canary = views.canary(conn.remoteAddr); conn.canary > 0 {
+				log.Infof("Serving %d%% of ROAs to %v as a canary", conn.canary, conn.remoteAddr)
+			}
+			if isDebugIP(conn.remoteAddr) {
+				conn.logger = newSessionLogger(log.TraceLevel)
+				log.Infof("Logging the session with %v at trace level", conn.remoteAddr)
+			}
+			rtrServer.handle(conn, views.managerFor(conn.remoteAddr))
 		case <-alarmCh:
 			log.Infof("Alarm triggered")
-			err := mgr.Reload()
-			checkError(err)
+			if pendingLoad {
+				log.Infof("Skipped the reload, no router has connected yet")
+				continue
+			}
+			reloads.reload(views)
+		case <-watchCh:
+			log.Infof("ROA file changed")
+			if pendingLoad {
+				log.Infof("Skipped the reload, no router has connected yet")
+				continue
+			}
+			reloads.reload(views)
 		case sig := <-sigCh:
 			{
 				switch sig {
 				case syscall.SIGHUP:
 					log.Infof("SIGHUP received")
-					err := mgr.Reload()
-					checkError(err)
+					done := reloads.reload(views)
+					if pendingLoad {
+						// Hold routers connecting until it finishes as well
+						pendingLoad = false
+						firstLoad = done
+					}
+				case syscall.SIGUSR1:
+					log.Infof("SIGUSR1 received")
+					rtrServer.promote()
 				case syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL:
+					log.Infof("Stopping, waiting for sessions to close")
+					if !rtrServer.Stop(commandOpts.StopTimeout) {
+						log.Warnf("Some sessions are still open after %v", commandOpts.StopTimeout)
+					}
+					// A reload blocks the checkpoint until it finishes
+					if !reloads.stop(commandOpts.StopTimeout) {
+						log.Warnf("A reload is still running, exiting without the checkpoint")
+						return
+					}
+					if commandOpts.Checkpoint != "" {
+						saveCheckpoint(mgr, rtrServer.sessionId, commandOpts.Checkpoint)
+					}
 					return
 				}
 			}
@@ -106,7 +298,7 @@ func mainLoop(mgr *ResourceManager, args []string, port int, interval string, de
 
 func main() {
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 
 	log.SetFormatter(&log.TextFormatter{
 		FullTimestamp:   true,
@@ -116,12 +308,22 @@ func main() {
 	// Parse options
 	parser := flags.NewParser(&commandOpts, flags.Default)
 	parser.Usage = "[OPTIONS] [RPSLFILES]..."
+	parser.SubcommandsOptional = true
+	parser.AddCommand("watch", "Watch an RTR cache", "Print ROAs of an RTR cache specified as HOST:PORT, and keep printing changes", &watchCommand{})
+	parser.AddCommand("loadtest", "Run a load test against an RTR cache", "Open concurrent RTR sessions to an RTR cache, and report throughput, latency and errors", &loadtestCommand{})
 	args, err := parser.Parse()
 	if err != nil {
+		if parser.Active != nil {
+			// The error has already been printed by the subcommand parser
+			os.Exit(1)
+		}
 		log.Errorf("%v", err)
 		parser.WriteHelp(os.Stdout)
 		os.Exit(1)
 	}
+	if parser.Active != nil {
+		return
+	}
 
 	if commandOpts.Interval != "" {
 		if err = parseIntervalMinute(commandOpts.Interval); err != nil {
@@ -130,6 +332,35 @@ func main() {
 		}
 	}
 
+	if err = checkTimers(commandOpts.Refresh, commandOpts.Retry, commandOpts.Expire); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+
+	if commandOpts.MinVersion > commandOpts.MaxVersion {
+		log.Errorf("--min-version must not be higher than --max-version")
+		os.Exit(1)
+	}
+
+	if commandOpts.FutureVers < 0 || commandOpts.FutureVers > 255-latestProtocolVersion {
+		log.Errorf("--future-versions must be from 0 to %d", 255-latestProtocolVersion)
+		os.Exit(1)
+	}
+
+	for _, ip := range commandOpts.DebugIPs {
+		if net.ParseIP(ip) == nil {
+			log.Errorf("invalid --debug-ip %q", ip)
+			os.Exit(1)
+		}
+	}
+
+	if commandOpts.LogBuffer > 0 {
+		w := newAsyncWriter(os.Stderr, commandOpts.LogBuffer)
+		log.SetOutput(w)
+		log.RegisterExitHandler(func() { w.Flush(time.Second) })
+		defer w.Flush(time.Second)
+	}
+
 	mgr := NewResourceManager(commandOpts.UseMaxLen)
 	mainLoop(mgr, args, commandOpts.Port, commandOpts.Interval, commandOpts.Debug, commandOpts.Quiet, sigCh)
 	log.Infof("Daemon stopped")
@@ -0,0 +1,41 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"expvar"
+	"time"
+)
+
+// Metrics are exported via expvar, and served at /debug/vars of the admin API.
+var (
+	logDropped = expvar.NewInt("log_dropped")
+	pdusSent   = expvar.NewInt("pdus_sent")
+	// sessionsRejected is the number of connections closed by --max-sessions
+	sessionsRejected = expvar.NewInt("sessions_rejected")
+	// sessionsClosed is the number of sessions ended by each cause
+	sessionsClosed = expvar.NewMap("sessions_closed")
+	// writeRetries is the number of writes retried by --write-retries
+	writeRetries = expvar.NewInt("write_retries")
+	// multiASNPrefixes is the number of prefixes having ROAs for multiple
+	// ASNs in the data loaded last.
+	multiASNPrefixes = expvar.NewInt("multi_asn_prefixes")
+	// contentHash is the content hash of the data loaded last with
+	// --content-hash
+	contentHash = expvar.NewString("content_hash")
+)
+
+var startedAt = time.Now()
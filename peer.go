@@ -0,0 +1,265 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultDataset = "default"
+
+type peerEntry struct {
+	prefix  *net.IPNet
+	dataset string
+	// fullSyncOnly answers Serial Queries with Cache Reset instead of a
+	// delta, for routers which mishandle incremental updates.
+	fullSyncOnly bool
+	// canary is the percentage of ROAs served for canary testing, or 0 to
+	// serve all.
+	canary int
+	// pinned is set if the protocol version of the routers is pinned to
+	// version, for routers which misbehave with the version they send.
+	pinned  bool
+	version uint8
+}
+
+// peerMap is a list of source prefixes read from a file like below.
+// The most specific prefix which covers the source address wins.
+// Options are separated by commas.
+//
+//	# source-CIDR    dataset  options
+//	192.0.2.0/24     lab
+//	192.0.2.1/32     lab      full-sync-only
+//	192.0.2.2/32     default  canary=10
+//	192.0.2.3/32     default  version=0
+//	2001:db8::/32    lab
+type peerMap struct {
+	entries []*peerEntry
+}
+
+func loadPeerMap(fileName string) (*peerMap, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &peerMap{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected \"CIDR DATASET [OPTIONS]\"", fileName, n)
+		}
+		_, prefix, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fileName, n, err)
+		}
+		e := &peerEntry{prefix: prefix, dataset: fields[1]}
+		if len(fields) == 3 {
+			for _, opt := range strings.Split(fields[2], ",") {
+				switch {
+				case opt == "full-sync-only":
+					e.fullSyncOnly = true
+				case strings.HasPrefix(opt, "canary="):
+					percent, err := strconv.Atoi(strings.TrimPrefix(opt, "canary="))
+					if err != nil || percent < 1 || percent > 100 {
+						return nil, fmt.Errorf("%s:%d: canary must be a percentage from 1 to 100", fileName, n)
+					}
+					e.canary = percent
+				case strings.HasPrefix(opt, "version="):
+					version, err := strconv.Atoi(strings.TrimPrefix(opt, "version="))
+					if err != nil || version < 0 || version > latestProtocolVersion {
+						return nil, fmt.Errorf("%s:%d: version must be from 0 to %d", fileName, n, latestProtocolVersion)
+					}
+					e.pinned, e.version = true, uint8(version)
+				default:
+					return nil, fmt.Errorf("%s:%d: unknown option %q", fileName, n, opt)
+				}
+			}
+		}
+		p.entries = append(p.entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *peerMap) lookup(addr net.Addr) *peerEntry {
+	ip := addrIP(addr)
+	if p == nil || ip == nil {
+		return nil
+	}
+	var found *peerEntry
+	foundLen := -1
+	for _, e := range p.entries {
+		if l, _ := e.prefix.Mask.Size(); e.prefix.Contains(ip) && l > foundLen {
+			found, foundLen = e, l
+		}
+	}
+	return found
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	// A link-local address may have a zone like "fe80::1%eth0", which is
+	// kept in logs but can't be matched against CIDRs
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+// peerViews selects a dataset for each router based on its source address.
+type peerViews struct {
+	peers    *peerMap
+	datasets map[string]*ResourceManager
+}
+
+func newPeerViews(mgr *ResourceManager, datasets []string, peersFile string) (*peerViews, error) {
+	v := &peerViews{
+		datasets: map[string]*ResourceManager{defaultDataset: mgr},
+	}
+
+	files := map[string][]string{}
+	names := []string{}
+	for _, d := range datasets {
+		arr := strings.SplitN(d, ":", 2)
+		if len(arr) != 2 || arr[0] == "" || arr[1] == "" {
+			return nil, fmt.Errorf("invalid dataset %q, expected NAME:RPSLFILE", d)
+		}
+		if arr[0] == defaultDataset {
+			return nil, fmt.Errorf("dataset name %q is reserved", defaultDataset)
+		}
+		if _, ok := files[arr[0]]; !ok {
+			names = append(names, arr[0])
+		}
+		files[arr[0]] = append(files[arr[0]], arr[1])
+	}
+	for _, name := range names {
+		m := NewResourceManager(mgr.useMaxLen)
+		if err := m.Load(files[name]); err != nil {
+			return nil, err
+		}
+		log.Infof("Dataset %v has been loaded.", name)
+		v.datasets[name] = m
+	}
+
+	if peersFile != "" {
+		peers, err := loadPeerMap(peersFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range peers.entries {
+			if _, ok := v.datasets[e.dataset]; !ok {
+				return nil, fmt.Errorf("unknown dataset %q for %v", e.dataset, e.prefix)
+			}
+		}
+		v.peers = peers
+	}
+	return v, nil
+}
+
+func (v *peerViews) managerFor(addr net.Addr) *ResourceManager {
+	if e := v.peers.lookup(addr); e != nil {
+		log.Infof("Selected dataset %v for %v", e.dataset, addr)
+		return v.datasets[e.dataset]
+	}
+	return v.datasets[defaultDataset]
+}
+
+func (v *peerViews) fullSyncOnly(addr net.Addr) bool {
+	if e := v.peers.lookup(addr); e != nil {
+		return e.fullSyncOnly
+	}
+	return false
+}
+
+// pinnedVersion returns the protocol version pinned for the router, and
+// false if it is negotiated.
+func (v *peerViews) pinnedVersion(addr net.Addr) (uint8, bool) {
+	if e := v.peers.lookup(addr); e != nil && e.pinned {
+		return e.version, true
+	}
+	return 0, false
+}
+
+func (v *peerViews) canary(addr net.Addr) int {
+	if e := v.peers.lookup(addr); e != nil {
+		return e.canary
+	}
+	return 0
+}
+
+// sampleROAs returns the percentage of ROAs in lists. A ROA is chosen by the
+// hash of it, so that the same ROAs are chosen across reloads, and a delta of
+// the sample is the sample of the delta.
+func sampleROAs(lists FakeROATable, percent int) FakeROATable {
+	sampled := FakeROATable{}
+	for rf, list := range lists {
+		sampled[rf] = map[uint8][]*FakeROA{}
+		for flag, roas := range list {
+			chosen := []*FakeROA{}
+			for _, v := range roas {
+				h := fnv.New32a()
+				fmt.Fprintf(h, "%v/%v-%v-%v", v.Prefix, v.PrefixLen, v.MaxLen, v.AS)
+				if int(h.Sum32()%100) < percent {
+					chosen = append(chosen, v)
+				}
+			}
+			sampled[rf][flag] = chosen
+		}
+	}
+	return sampled
+}
+
+// Reload reloads all datasets, and returns the first error if any. A dataset
+// which failed to reload or was aborted by ctx keeps its current data.
+func (v *peerViews) Reload(ctx context.Context) error {
+	var firstErr error
+	for _, mgr := range v.datasets {
+		if err := mgr.ReloadContext(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerMapLookup(t *testing.T) {
+	assert := assert.New(t)
+	fileName := createFile("peers", []string{
+		"# source-CIDR dataset\n",
+		"192.0.2.0/24     lab\n",
+		"192.0.2.128/25   canary # more specific\n",
+		"2001:db8::/32    lab\n",
+	})
+	defer removeFile(fileName)
+
+	p, err := loadPeerMap(fileName)
+	assert.Nil(err)
+
+	examples := map[string]string{
+		"192.0.2.1":     "lab",
+		"192.0.2.129":   "canary",
+		"2001:db8::1":   "lab",
+		"198.51.100.1":  "",
+		"2001:db8:1::1": "lab",
+	}
+	for addr, dataset := range examples {
+		e := p.lookup(&net.TCPAddr{IP: net.ParseIP(addr), Port: 323})
+		if dataset == "" {
+			assert.Nil(e, addr)
+			continue
+		}
+		assert.Equal(dataset, e.dataset, addr)
+	}
+
+	badFile := createFile("peers", []string{"192.0.2.0/33 lab\n"})
+	defer removeFile(badFile)
+	_, err = loadPeerMap(badFile)
+	assert.NotNil(err)
+
+	optFile := createFile("peers", []string{
+		"192.0.2.0/24 lab\n",
+		"192.0.2.1/32 lab full-sync-only\n",
+	})
+	defer removeFile(optFile)
+	p, err = loadPeerMap(optFile)
+	assert.Nil(err)
+	assert.False(p.lookup(&net.TCPAddr{IP: net.ParseIP("192.0.2.2")}).fullSyncOnly)
+	assert.True(p.lookup(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}).fullSyncOnly)
+
+	canaryFile := createFile("peers", []string{"192.0.2.0/24 lab full-sync-only,canary=10\n"})
+	defer removeFile(canaryFile)
+	p, err = loadPeerMap(canaryFile)
+	assert.Nil(err)
+	assert.Equal(10, p.lookup(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}).canary)
+	assert.True(p.lookup(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}).fullSyncOnly)
+
+	versionFile := createFile("peers", []string{"192.0.2.0/24 lab version=0\n"})
+	defer removeFile(versionFile)
+	p, err = loadPeerMap(versionFile)
+	assert.Nil(err)
+	assert.True(p.lookup(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}).pinned)
+	assert.Equal(uint8(0), p.lookup(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}).version)
+
+	for _, opt := range []string{"canary=0", "canary=101", "canary=ten", "version=3", "version=v1"} {
+		badCanaryFile := createFile("peers", []string{"192.0.2.0/24 lab " + opt + "\n"})
+		defer removeFile(badCanaryFile)
+		_, err = loadPeerMap(badCanaryFile)
+		assert.NotNil(err, opt)
+	}
+
+	badOptFile := createFile("peers", []string{"192.0.2.0/24 lab no-such-option\n"})
+	defer removeFile(badOptFile)
+	_, err = loadPeerMap(badOptFile)
+	assert.NotNil(err)
+}
+
+func dialRTRServerFrom(localIP string, port int) (*rtrConn, *bufio.Scanner) {
+	laddr := &net.TCPAddr{IP: net.ParseIP(localIP)}
+	raddr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+	for {
+		conn, err := net.DialTCP("tcp", laddr, raddr)
+		if err == nil {
+			r := &rtrConn{conn: conn}
+			scanner := bufio.NewScanner(bufio.NewReader(conn))
+			scanner.Split(rtr.SplitRTR)
+			return r, scanner
+		}
+	}
+}
+
+func TestPeerMapLookupZone(t *testing.T) {
+	assert := assert.New(t)
+	fileName := createFile("peers", []string{
+		"fe80::/64 lab\n",
+	})
+	defer removeFile(fileName)
+
+	p, err := loadPeerMap(fileName)
+	assert.Nil(err)
+
+	for _, addr := range []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 323, Zone: "eth0"},
+		&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 323, Zone: "eth0"},
+		&net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"},
+	} {
+		e := p.lookup(addr)
+		if assert.NotNil(e, addr.String()) {
+			assert.Equal("lab", e.dataset, addr.String())
+		}
+	}
+}
+
+func TestPeerViews(t *testing.T) {
+	assert := assert.New(t)
+
+	labFile := createFile("lab.db", []string{
+		"route:  10.0.0.0/8\n",
+		"origin: AS65010\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(labFile)
+	peersFile := createFile("peers", []string{"127.0.0.2/32 lab\n"})
+	defer removeFile(peersFile)
+
+	commandOpts.Datasets = []string{"lab:" + labFile}
+	commandOpts.Peers = peersFile
+	defer func() {
+		commandOpts.Datasets = nil
+		commandOpts.Peers = ""
+	}()
+
+	_, f := prepareOn(42422, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+
+	for localIP, expectedAS := range map[string]uint32{"127.0.0.1": 65000, "127.0.0.2": 65010} {
+		r, scanner := dialRTRServerFrom(localIP, 42422)
+		r.sendPDU(rtr.NewRTRResetQuery())
+
+		scanner.Scan()
+		m, _ := rtr.ParseRTR(scanner.Bytes())
+		_, ok := m.(*rtr.RTRCacheResponse)
+		assert.True(ok, localIP)
+
+		scanner.Scan()
+		m, _ = rtr.ParseRTR(scanner.Bytes())
+		prefix, ok := m.(*rtr.RTRIPPrefix)
+		if assert.True(ok, localIP) {
+			assert.Equal(expectedAS, prefix.AS, localIP)
+		}
+		r.conn.Close()
+	}
+}
+
+func TestFullSyncOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	peersFile := createFile("peers", []string{"127.0.0.3/32 default full-sync-only\n"})
+	defer removeFile(peersFile)
+	commandOpts.Peers = peersFile
+	defer func() { commandOpts.Peers = "" }()
+
+	mgr, f := prepareOn(42432, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+
+	r, scanner := dialRTRServerFrom("127.0.0.3", 42432)
+	defer r.conn.Close()
+	exchange := func(pdu rtr.RTRMessage) ([]*rtr.RTRIPPrefix, *rtr.RTREndOfData) {
+		r.sendPDU(pdu)
+		prefixes := []*rtr.RTRIPPrefix{}
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			switch msg := m.(type) {
+			case *rtr.RTRIPPrefix:
+				prefixes = append(prefixes, msg)
+			case *rtr.RTREndOfData:
+				return prefixes, msg
+			case *rtr.RTRCacheReset:
+				return prefixes, nil
+			}
+		}
+		return prefixes, nil
+	}
+
+	prefixes, endOfData := exchange(rtr.NewRTRResetQuery())
+	assert.Len(prefixes, 1)
+
+	addRPSL(f, []string{
+		"route:  192.168.1.0/24\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+	})
+	mgr.Reload()
+
+	// Cache Reset is sent instead of the delta with only 192.168.1.0/24
+	prefixes, endOfData = exchange(rtr.NewRTRSerialQuery(endOfData.SessionID, endOfData.SerialNumber))
+	assert.Len(prefixes, 0)
+	assert.Nil(endOfData)
+
+	// and then the router gets all ROAs by a full synchronization
+	prefixes, _ = exchange(rtr.NewRTRResetQuery())
+	assert.Len(prefixes, 2)
+	for _, p := range prefixes {
+		assert.Equal(rtr.ANNOUNCEMENT, p.Flags)
+	}
+}
+
+func TestPinnedVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	peersFile := createFile("peers", []string{"127.0.0.5/32 default version=0\n"})
+	defer removeFile(peersFile)
+	commandOpts.Peers = peersFile
+	commandOpts.MaxVersion = 1
+	defer func() { commandOpts.Peers, commandOpts.MaxVersion = "", 0 }()
+
+	_, f := prepareOn(42458, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+
+	resetQuery := func(localIP string, version uint8) []byte {
+		r, scanner := dialRTRServerFrom(localIP, 42458)
+		defer r.conn.Close()
+		pdu, _ := rtr.NewRTRResetQuery().Serialize()
+		pdu[0] = version
+		r.conn.Write(pdu)
+		for scanner.Scan() {
+			if t := scanner.Bytes()[1]; t == rtr.RTR_END_OF_DATA || t == rtr.RTR_ERROR_REPORT {
+				return append([]byte{}, scanner.Bytes()...)
+			}
+		}
+		return nil
+	}
+
+	// Other routers negotiate version 1
+	assert.Equal([]byte{1, rtr.RTR_END_OF_DATA}, resetQuery("127.0.0.1", 1)[:2])
+	// The pinned router is rejected with version 1
+	pdu := resetQuery("127.0.0.5", 1)
+	assert.Equal([]byte{0, rtr.RTR_ERROR_REPORT}, pdu[:2])
+	assert.Equal(rtr.UNSUPPORTED_PROTOCOL_VERSION, binary.BigEndian.Uint16(pdu[2:4]))
+	// and served with version 0
+	assert.Equal([]byte{0, rtr.RTR_END_OF_DATA}, resetQuery("127.0.0.5", 0)[:2])
+}
+
+func TestCanary(t *testing.T) {
+	assert := assert.New(t)
+
+	peersFile := createFile("peers", []string{"127.0.0.4/32 default canary=10\n"})
+	defer removeFile(peersFile)
+	commandOpts.Peers = peersFile
+	defer func() { commandOpts.Peers = "" }()
+
+	content := []string{}
+	for i := 0; i < 500; i++ {
+		content = append(content, fmt.Sprintf("route: 10.%d.%d.0/24\norigin: AS65000\nsource: TEST\n\n", i/256, i%256))
+	}
+	mgr, f := prepareOn(42452, "", content)
+	defer os.Remove(f.Name())
+
+	resetQuery := func(localIP string) map[string]bool {
+		r, scanner := dialRTRServerFrom(localIP, 42452)
+		defer r.conn.Close()
+		r.sendPDU(rtr.NewRTRResetQuery())
+		prefixes := map[string]bool{}
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			switch msg := m.(type) {
+			case *rtr.RTRIPPrefix:
+				prefixes[fmt.Sprintf("%v/%v", msg.Prefix, msg.PrefixLen)] = true
+			case *rtr.RTREndOfData:
+				return prefixes
+			}
+		}
+		return prefixes
+	}
+
+	all := resetQuery("127.0.0.1")
+	canary := resetQuery("127.0.0.4")
+	assert.Len(all, 500)
+	assert.True(len(canary) >= 25 && len(canary) <= 75, len(canary))
+	for p := range canary {
+		assert.True(all[p], p)
+	}
+
+	// The same ROAs are chosen after a reload
+	addRPSL(f, []string{"route: 10.255.0.0/24\norigin: AS65000\nsource: TEST\n\n"})
+	assert.Nil(mgr.Reload())
+	reloaded := resetQuery("127.0.0.4")
+	delete(reloaded, "10.255.0.0/24")
+	assert.Equal(canary, reloaded)
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "sync"
+
+// rawCache keeps the payload of each source as fetched last, before any
+// filter is applied, for comparing with the served ROAs.
+type rawCache struct {
+	mu       sync.Mutex
+	payloads map[string]*rawPayload
+}
+
+type rawPayload struct {
+	data      []byte
+	size      int
+	truncated bool
+}
+
+var rawSources = &rawCache{payloads: map[string]*rawPayload{}}
+
+// put caches data up to --raw-cache-size bytes.
+func (c *rawCache) put(source string, data []byte) {
+	limit := commandOpts.RawCacheSize
+	if limit <= 0 {
+		return
+	}
+	p := &rawPayload{size: len(data)}
+	if len(data) > limit {
+		data = data[:limit]
+		p.truncated = true
+	}
+	p.data = append([]byte{}, data...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.payloads[source] = p
+}
+
+func (c *rawCache) get(source string) *rawPayload {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.payloads[source]
+}
+
+func (c *rawCache) sources() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sources := []string{}
+	for s := range c.payloads {
+		sources = append(sources, s)
+	}
+	return sources
+}
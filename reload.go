@@ -0,0 +1,76 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reloader runs reloads in the background, so that the main loop keeps
+// handling signals during a long reload, and the shutdown can wait for it.
+type reloader struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newReloader() *reloader {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &reloader{ctx: ctx, cancel: cancel}
+}
+
+// reload starts a reload, and returns a channel closed when it finishes.
+func (r *reloader) reload(views *peerViews) <-chan struct{} {
+	done := make(chan struct{})
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer close(done)
+		// The current data is kept if the reload fails
+		views.Reload(r.ctx)
+	}()
+	return done
+}
+
+// stop waits for reloads in progress to finish until the timeout, and then
+// aborts them and waits for another timeout. It returns false if they are
+// still running, eg. blocked on reading a source.
+func (r *reloader) stop(timeout time.Duration) bool {
+	if r.wait(timeout) {
+		return true
+	}
+	log.Warnf("Aborting the reload in progress")
+	r.cancel()
+	return r.wait(timeout)
+}
+
+func (r *reloader) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloaderStop(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir(os.TempDir(), "TestReloaderStop")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "irr.db")
+	ioutil.WriteFile(file, []byte("route: 192.168.0.0/24\norigin: AS65001\nsource: TEST\n\n"), 0644)
+	// Reading a FIFO blocks until it's written, like a slow source
+	fifo := filepath.Join(dir, "slow.db")
+	assert.Nil(syscall.Mkfifo(fifo, 0644))
+	writeFIFO := func() {
+		go ioutil.WriteFile(fifo, []byte("route: 192.168.1.0/24\norigin: AS65001\nsource: TEST\n\n"), 0644)
+	}
+
+	writeFIFO()
+	mgr := NewResourceManager(false)
+	assert.Nil(mgr.Load([]string{file, fifo}))
+	views, err := newPeerViews(mgr, nil, "")
+	assert.Nil(err)
+	currentSN := mgr.CurrentSerial()
+	ioutil.WriteFile(file, []byte("route: 192.168.2.0/24\norigin: AS65001\nsource: TEST\n\n"), 0644)
+
+	// A reload blocked on a source is aborted once the source is read
+	r := newReloader()
+	r.reload(views)
+	assert.False(r.stop(100 * time.Millisecond))
+	writeFIFO()
+	assert.True(r.stop(time.Second))
+	assert.Equal(currentSN, mgr.CurrentSerial())
+
+	// A reload finishing in time is waited for
+	writeFIFO()
+	r = newReloader()
+	r.reload(views)
+	assert.True(r.stop(time.Second))
+	assert.NotEqual(currentSN, mgr.CurrentSerial())
+}
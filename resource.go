@@ -17,18 +17,24 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"net"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/armon/go-radix"
 	"github.com/martinolsen/go-rpsl"
 	"github.com/osrg/gobgp/pkg/packet/bgp"
+	log "github.com/sirupsen/logrus"
 )
 
 type subResource struct {
@@ -42,60 +48,371 @@ type prefixResource struct {
 	values    []*subResource
 }
 
+func (p *prefixResource) hasASN(asn uint32) bool {
+	for _, r := range p.values {
+		for _, v := range r.asns {
+			if v == asn {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *prefixResource) countASNs() int {
+	asns := map[uint32]bool{}
+	for _, r := range p.values {
+		for _, v := range r.asns {
+			asns[v] = true
+		}
+	}
+	return len(asns)
+}
+
 type resource struct {
 	files     []string
 	currentSN uint32
 	table     map[uint32]map[bgp.RouteFamily]*radix.Tree
+	loadedAt  map[uint32]time.Time
 	useMaxLen bool
+	blocklist []*net.IPNet
+	// reloadedAt is the time of the last successful load, even if the data
+	// was not changed.
+	reloadedAt time.Time
+	// changeToken is the token of the last changes applied by applyChanges
+	changeToken string
+	// changes is the source of the changes, which are applied again to the
+	// files reloaded
+	changes changeSource
+	// fullSync is Prefix PDUs of the current serial serialized by protocol
+	// version, and dropped when the current serial is changed.
+	fullSync map[uint8]*fullSyncStream
+	// aspas is ASPAs by serial as table is ROAs. A serial without ASPAs may
+	// be missing.
+	aspas map[uint32]aspaTable
+	// hash is the content hash of the current data with --content-hash
+	hash string
 }
 
 func newResource(files []string, useMaxLen bool) (*resource, error) {
 	rsrc := &resource{
 		files:     files,
 		table:     make(map[uint32]map[bgp.RouteFamily]*radix.Tree),
+		loadedAt:  make(map[uint32]time.Time),
+		aspas:     make(map[uint32]aspaTable),
 		useMaxLen: useMaxLen,
 	}
 
-	rsrc.currentSN = uint32(time.Now().Unix())
-	rsrc, err := rsrc.loadAs(rsrc.currentSN)
+	rsrc.currentSN = nextSerial(0, 0)
+	rsrc, err := rsrc.loadAs(context.Background(), rsrc.currentSN)
 	if err != nil {
 		return nil, err
 	}
+	rsrc.loadedAt[rsrc.currentSN] = time.Now()
+	rsrc.reloadedAt = rsrc.loadedAt[rsrc.currentSN]
+	rsrc.updateContentHash()
 	return rsrc, nil
 }
 
-func (rsrc *resource) loadAs(sn uint32) (*resource, error) {
+// newLazyResource returns a resource which has no data until the files are
+// read by the first reload.
+func newLazyResource(files []string, useMaxLen bool) *resource {
+	return &resource{
+		files:     files,
+		currentSN: nextSerial(0, 0),
+		table:     make(map[uint32]map[bgp.RouteFamily]*radix.Tree),
+		loadedAt:  make(map[uint32]time.Time),
+		aspas:     make(map[uint32]aspaTable),
+		useMaxLen: useMaxLen,
+	}
+}
+
+// oldestSerial returns the serial of the data loaded first in the history.
+func (rsrc *resource) oldestSerial() uint32 {
+	oldest := rsrc.currentSN
+	for sn := range rsrc.table {
+		if rsrc.loadedAt[sn].Before(rsrc.loadedAt[oldest]) {
+			oldest = sn
+		}
+	}
+	return oldest
+}
+
+// sources returns the files and --roa-file files which the data is loaded
+// from.
+func (rsrc *resource) sources() []string {
+	return append(append([]string{}, rsrc.files...), commandOpts.ROAFiles...)
+}
+
+// nextSerial returns the serial number for the data next to currentSN, which
+// has the number of changed ROAs. The serial number is the current time
+// unless --serial-mode is specified for testing how routers handle serial
+// numbers.
+func nextSerial(currentSN uint32, changes int) uint32 {
+	switch commandOpts.SerialMode {
+	case "step":
+		step := commandOpts.SerialStep
+		if step <= 0 {
+			step = 1
+		}
+		return currentSN + uint32(step)
+	case "changes":
+		// The serial must advance even by a change of ASPAs alone, or it
+		// would collide with the current one
+		if changes < 1 {
+			changes = 1
+		}
+		return currentSN + uint32(changes)
+	case "random":
+		// Deliberately ignores the order defined by RFC 1982
+		for {
+			if sn := rand.Uint32(); sn != currentSN {
+				return sn
+			}
+		}
+	case "random-increment":
+		// Jumps forward by 1 to 2^31-1, which is still greater than
+		// currentSN in terms of RFC 1982
+		return currentSN + 1 + uint32(rand.Int31n(math.MaxInt32))
+	default:
+		sn := uint32(time.Now().Unix())
+		// Serial numbers must advance even if reloaded within a second, or
+		// the current one is ahead of the clock, eg. after it has wrapped
+		if !serialNewer(sn, currentSN) {
+			sn = currentSN + 1
+		}
+		return sn
+	}
+}
+
+// serialNewer returns true if a is newer than b in terms of RFC 1982.
+func serialNewer(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// loadAs loads the sources as the serial. It stops between the sources if
+// ctx is done.
+func (rsrc *resource) loadAs(ctx context.Context, sn uint32) (*resource, error) {
 	var err error
-	for _, f := range rsrc.files {
-		rsrc, err = rsrc.loadFromIRRdb(sn, f)
+	// The blocklist is read on every load as well as the files
+	rsrc.blocklist, err = loadBlocklist(commandOpts.Blocklist)
+	if err != nil {
+		return nil, err
+	}
+	// The test vectors are added to the table before the files
+	if commandOpts.TestVectors {
+		rsrc, err = rsrc.loadTestVectors(sn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The files are sources in order of priority, merged by --merge-policy
+	for i, f := range rsrc.files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if i > 0 && commandOpts.MergePolicy == "fallback" && countPrefixes(rsrc.table[sn]) > 0 {
+			log.Debugf("Skipped %v, the preceding source has ROAs", f)
+			break
+		}
+		if i > 0 && commandOpts.MergePolicy == "primary-wins" {
+			err = rsrc.mergeFromIRRdb(sn, f)
+		} else {
+			rsrc, err = rsrc.loadFromIRRdb(sn, f)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	// ROAs of validators are added to the ones of the files
+	for _, f := range commandOpts.ROAFiles {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		rsrc, err = rsrc.loadFromROAFile(sn, f)
 		if err != nil {
 			return nil, err
 		}
 	}
+	multiASNPrefixes.Set(int64(countMultiASNPrefixes(rsrc.table[sn])))
 
 	return rsrc, nil
 }
 
-func (rsrc *resource) loadFromIRRdb(sn uint32, irrDBFileName string) (*resource, error) {
-	byObjects := regexp.MustCompile("\n\n")
-	maxLength := regexp.MustCompile(`\s*[Mm]axLength\s*(\d+)`)
+func countMultiASNPrefixes(trees map[bgp.RouteFamily]*radix.Tree) int {
+	n := 0
+	for _, tree := range trees {
+		tree.Walk(func(_ string, v interface{}) bool {
+			if v.(*prefixResource).countASNs() > 1 {
+				n++
+			}
+			return false
+		})
+	}
+	return n
+}
 
+// mergeFromIRRdb loads a file, and adds ROAs of the prefixes which are not in
+// the table yet, so that the sources loaded earlier win on conflicts.
+func (rsrc *resource) mergeFromIRRdb(sn uint32, irrDBFileName string) error {
+	src := &resource{
+		table:     make(map[uint32]map[bgp.RouteFamily]*radix.Tree),
+		useMaxLen: rsrc.useMaxLen,
+		blocklist: rsrc.blocklist,
+	}
+	src, err := src.loadFromIRRdb(sn, irrDBFileName)
+	if err != nil {
+		return err
+	}
+	for rf, tree := range src.table[sn] {
+		tree.Walk(func(key string, v interface{}) bool {
+			if _, ok := rsrc.table[sn][rf].Get(key); !ok {
+				rsrc.table[sn][rf].Insert(key, v)
+			} else {
+				log.Debugf("Ignored ROAs of %v/%v in %v, the prefix is in a preceding source", v.(*prefixResource).prefix, v.(*prefixResource).prefixLen, irrDBFileName)
+			}
+			return false
+		})
+	}
+	return nil
+}
+
+func countPrefixes(trees map[bgp.RouteFamily]*radix.Tree) int {
+	n := 0
+	for _, tree := range trees {
+		n += tree.Len()
+	}
+	return n
+}
+
+// stage loads all files into a new table and ASPAs without touching the
+// current tables, so that the resource is kept as is if any of the files is
+// broken.
+func (rsrc *resource) stage(ctx context.Context, sn uint32) (map[bgp.RouteFamily]*radix.Tree, aspaTable, error) {
+	staged := &resource{
+		files:     rsrc.files,
+		table:     make(map[uint32]map[bgp.RouteFamily]*radix.Tree),
+		useMaxLen: rsrc.useMaxLen,
+	}
+	staged, err := staged.loadAs(ctx, sn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return staged.table[sn], staged.aspaTable(sn), nil
+}
+
+// advance makes the next table and ASPAs, which have the number of changed
+// ROAs and ASPAs, current with a new serial number.
+func (rsrc *resource) advance(next map[bgp.RouteFamily]*radix.Tree, aspas aspaTable, changes int) {
+	nextSN := nextSerial(rsrc.currentSN, changes)
+	for _, ok := rsrc.table[nextSN]; ok; _, ok = rsrc.table[nextSN] {
+		nextSN = nextSerial(nextSN, changes)
+	}
+	rsrc.table[nextSN] = next
+	rsrc.aspas[nextSN] = aspas
+	rsrc.loadedAt[nextSN] = time.Now()
+	log.Infof("Resource has been updated. (SN: %v -> %v)", rsrc.currentSN, nextSN)
+	rsrc.currentSN = nextSN
+	rsrc.fullSync = nil
+	rsrc.updateContentHash()
+	rsrc.trimHistory()
+}
+
+// trimHistory drops the oldest serials beyond --max-history, so that routers
+// at them get Cache Reset instead of a delta. Each serial retains a whole
+// table, which is the memory traded for deltas.
+func (rsrc *resource) trimHistory() {
+	max := commandOpts.MaxHistory
+	if max <= 0 {
+		return
+	}
+	// The current serial is not counted as a past one
+	for len(rsrc.table) > max+1 {
+		sn := rsrc.oldestSerial()
+		if sn == rsrc.currentSN {
+			return
+		}
+		log.Infof("Resource as of %v was dropped beyond --max-history. (SN: %v)", rsrc.loadedAt[sn].Format("2006/01/02 15:04:05"), sn)
+		delete(rsrc.table, sn)
+		delete(rsrc.aspas, sn)
+		delete(rsrc.loadedAt, sn)
+	}
+}
+
+// initTable makes empty trees for sn unless they exist.
+func (rsrc *resource) initTable(sn uint32) {
 	if _, ok := rsrc.table[sn]; !ok {
 		rsrc.table[sn] = make(map[bgp.RouteFamily]*radix.Tree)
 		for _, rf := range []bgp.RouteFamily{bgp.RF_IPv4_UC, bgp.RF_IPv6_UC} {
 			rsrc.table[sn][rf] = radix.New()
 		}
 	}
+}
+
+type parsedObject struct {
+	object *rpsl.Object
+	maxLen int
+	err    error
+}
+
+// parseObjects parses RPSL objects with the given number of workers, or
+// GOMAXPROCS if not positive. The results are in the same order as objects.
+func parseObjects(objects []string, workers int) []parsedObject {
+	maxLength := regexp.MustCompile(`\s*[Mm]axLength\s*(\d+)`)
+	findMaxLen := func(object *rpsl.Object) int {
+		vs, ok := object.Values[strings.ToLower("remarks")]
+		if ok {
+			for _, v := range vs {
+				result := maxLength.FindStringSubmatch(v)
+				if len(result) == 0 {
+					continue
+				}
+				num, _ := strconv.Atoi(result[1])
+				return num
+			}
+		}
+		return -1
+	}
+
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	results := make([]parsedObject, len(objects))
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(objects); i += workers {
+				object, err := rpsl.NewReader(strings.NewReader(objects[i])).Read()
+				results[i] = parsedObject{object: object, maxLen: -1, err: err}
+				if err == nil {
+					results[i].maxLen = findMaxLen(object)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	return results
+}
+
+func (rsrc *resource) loadFromIRRdb(sn uint32, irrDBFileName string) (*resource, error) {
+	byObjects := regexp.MustCompile("\n\n")
+
+	rsrc.initTable(sn)
 
 	irrDb, err := ioutil.ReadFile(irrDBFileName)
 	if err != nil {
 		return nil, err
 	}
+	rawSources.put(irrDBFileName, irrDb)
 
-	irrObjects := byObjects.Split(string(irrDb), -1)
+	irrObjects := parseObjects(byObjects.Split(string(irrDb), -1), commandOpts.LoadWorkers)
 
+	// ROAs are added in the order of the file, so that the result doesn't
+	// depend on the parallel parsing
 	for i := 0; i < len(irrObjects); i++ {
-		object, err := rpsl.NewReader(strings.NewReader(irrObjects[i])).Read()
+		object, err := irrObjects[i].object, irrObjects[i].err
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -105,25 +422,11 @@ func (rsrc *resource) loadFromIRRdb(sn uint32, irrDBFileName string) (*resource,
 		}
 		switch object.Class {
 		case "route", "route6":
-			findMaxLen := func() int {
-				vs, ok := object.Values[strings.ToLower("remarks")]
-				if ok {
-					for _, v := range vs {
-						result := maxLength.FindStringSubmatch(v)
-						if len(result) == 0 {
-							continue
-						}
-						num, _ := strconv.Atoi(result[1])
-						return num
-					}
-				}
-				return -1
-			}
 			rsrc, err = rsrc.addValidInfo(
 				sn,
 				object.Get("origin"),
 				object.Get(object.Class),
-				findMaxLen(),
+				irrObjects[i].maxLen,
 			)
 		}
 		if err != nil {
@@ -151,11 +454,30 @@ func generateKey(rf bgp.RouteFamily, addr net.IP, prefixLen uint8) string {
 }
 
 func (rsrc *resource) addValidInfo(sn uint32, as string, prefix string, mLenFromObj int) (*resource, error) {
-	a, _ := strconv.ParseUint(strings.TrimLeft(as, "AS"), 10, 32)
+	a, err := parseASN(as)
+	if err != nil {
+		return nil, fmt.Errorf("%v of %v", err, prefix)
+	}
 	rf, ip, maskLen, maxLen, err := parsePrefix(prefix)
 	if err != nil {
 		return nil, err
 	}
+	if blocked := rsrc.blockedBy(ip, maskLen); blocked != nil {
+		log.Warnf("Dropped %v AS%v, the prefix is blocked by %v", prefix, a, blocked)
+		return rsrc, nil
+	}
+	if asnRejected(uint32(a)) {
+		log.Warnf("Dropped %v AS%v, the ASN is rejected", prefix, a)
+		return rsrc, nil
+	}
+	if !asnAllowed(uint32(a)) {
+		log.Debugf("Dropped %v AS%v, the ASN is not in the filter", prefix, a)
+		return rsrc, nil
+	}
+	if !prefixLenInRange(rf, maskLen) {
+		log.Debugf("Dropped %v AS%v, the prefix length is out of range", prefix, a)
+		return rsrc, nil
+	}
 	if !rsrc.useMaxLen {
 		maxLen = maskLen
 	}
@@ -192,6 +514,14 @@ func (rsrc *resource) addValidInfo(sn uint32, as string, prefix string, mLenFrom
 		rsrc.table[sn][rf].Insert(key, b)
 	} else {
 		bucket := b.(*prefixResource)
+		if max := commandOpts.MaxASNs; max > 0 && !bucket.hasASN(uint32(a)) && bucket.countASNs() >= max {
+			log.Warnf("Dropped %v AS%v, the prefix already has %d ASN(s)", prefix, a, max)
+			return rsrc, nil
+		}
+		// Legitimate for anycast or migration, but sometimes a data bug
+		if !bucket.hasASN(uint32(a)) && bucket.countASNs() == 1 {
+			log.Warnf("Prefix %v has ROAs for multiple ASNs (AS%v, AS%v)", prefix, bucket.values[0].asns[0], a)
+		}
 		for _, r := range bucket.values {
 			if r.maxLen == maxLen {
 				for _, asn := range r.asns {
@@ -212,6 +542,126 @@ func (rsrc *resource) addValidInfo(sn uint32, as string, prefix string, mLenFrom
 	return rsrc, nil
 }
 
+// loadBlocklist reads CIDRs, one per line, never to be served.
+func loadBlocklist(fileName string) ([]*net.IPNet, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	blocklist := []*net.IPNet{}
+	for n, line := range strings.Split(string(buf), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		_, prefix, err := net.ParseCIDR(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fileName, n+1, err)
+		}
+		blocklist = append(blocklist, prefix)
+	}
+	return blocklist, nil
+}
+
+// blockedBy returns the blocklist entry which covers the prefix if any.
+func (rsrc *resource) blockedBy(ip net.IP, prefixLen uint8) *net.IPNet {
+	for _, b := range rsrc.blocklist {
+		if l, _ := b.Mask.Size(); b.Contains(ip) && int(prefixLen) >= l {
+			return b
+		}
+	}
+	return nil
+}
+
+// parseASN parses an ASN of any source. Sources written by hand or by other
+// tools may have spaces, "as" in lower case or leading zeros, which are
+// normalized.
+func parseASN(s string) (uint32, error) {
+	digits := strings.TrimSpace(s)
+	if len(digits) >= 2 && strings.EqualFold(digits[:2], "AS") {
+		digits = digits[2:]
+	}
+	n, err := strconv.ParseUint(digits, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ASN %q", s)
+	}
+	return uint32(n), nil
+}
+
+// asn is an ASN specified as "65000" or "AS65000".
+type asn uint32
+
+func (a *asn) UnmarshalFlag(value string) error {
+	n, err := parseASN(value)
+	if err != nil {
+		return err
+	}
+	*a = asn(n)
+	return nil
+}
+
+// asnRange is a range of ASNs specified as "ASN" or "FIRST-LAST".
+type asnRange struct {
+	first, last uint32
+}
+
+func (r *asnRange) UnmarshalFlag(value string) error {
+	arr := strings.SplitN(value, "-", 2)
+	first, err := parseASN(arr[0])
+	if err != nil {
+		return fmt.Errorf("invalid ASN range %q", value)
+	}
+	last := first
+	if len(arr) == 2 {
+		last, err = parseASN(arr[1])
+		if err != nil || last < first {
+			return fmt.Errorf("invalid ASN range %q", value)
+		}
+	}
+	r.first, r.last = first, last
+	return nil
+}
+
+// asnRejected returns whether the ASN is in any range of --reject-asn.
+func asnRejected(asn uint32) bool {
+	for _, r := range commandOpts.RejectASNs {
+		if r.first <= asn && asn <= r.last {
+			return true
+		}
+	}
+	return false
+}
+
+// asnAllowed returns whether ROAs of the ASN are served by --asn-filter.
+// All ASNs are allowed if no filter is specified.
+func asnAllowed(asn uint32) bool {
+	if len(commandOpts.ASNFilter) == 0 {
+		return true
+	}
+	for _, v := range commandOpts.ASNFilter {
+		if uint32(v) == asn {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixLenInRange returns whether the prefix length is within the range
+// specified by --min-prefixlen4 and so on. 0 as the maximum means unlimited.
+func prefixLenInRange(rf bgp.RouteFamily, prefixLen uint8) bool {
+	min, max := commandOpts.MinPrefixLen4, commandOpts.MaxPrefixLen4
+	if rf == bgp.RF_IPv6_UC {
+		min, max = commandOpts.MinPrefixLen6, commandOpts.MaxPrefixLen6
+	}
+	return int(prefixLen) >= min && (max == 0 || int(prefixLen) <= max)
+}
+
 func parsePrefix(prefix string) (bgp.RouteFamily, net.IP, uint8, uint8, error) {
 	rf := bgp.RF_IPv6_UC
 	maskLenMax := uint8(net.IPv6len * 8)
@@ -16,10 +16,12 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"path/filepath"
-	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,7 +29,6 @@ import (
 
 	"github.com/armon/go-radix"
 	set "github.com/deckarep/golang-set"
-	"github.com/grafov/bcast"
 	"github.com/osrg/gobgp/pkg/packet/bgp"
 	"github.com/osrg/gobgp/pkg/packet/rtr"
 	log "github.com/sirupsen/logrus"
@@ -43,6 +44,16 @@ const (
 	REQ_IF_SERIAL_EXISTS
 	REQ_BEGIN_TRANSACTION
 	REQ_END_TRANSACTION
+	REQ_STATUS
+	REQ_APPLY_CHANGES
+	REQ_CHECKPOINT
+	REQ_RESTORE
+	REQ_HAS_DATA
+	REQ_OLDEST_SERIAL
+	REQ_FULL_SYNC
+	REQ_LOAD_LAZILY
+	REQ_CURRENT_ASPAS
+	REQ_DELTA_ASPAS
 )
 
 type RequestType int
@@ -64,6 +75,16 @@ type FakeROA struct {
 
 type FakeROATable map[bgp.RouteFamily]map[uint8][]*FakeROA
 
+func countROAs(lists FakeROATable) int {
+	n := 0
+	for _, list := range lists {
+		for _, roas := range list {
+			n += len(roas)
+		}
+	}
+	return n
+}
+
 type Response struct {
 	Error error
 	Data  interface{}
@@ -71,7 +92,8 @@ type Response struct {
 
 type ResourceManager struct {
 	ch           chan Request
-	serialNotify *bcast.Group
+	serialNotify *notifyGroup
+	notifyCh     chan struct{}
 	useMaxLen    bool
 	init         sync.Once
 }
@@ -80,13 +102,63 @@ func NewResourceManager(useMaxLen bool) *ResourceManager {
 	return &ResourceManager{
 		ch:           make(chan Request),
 		useMaxLen:    useMaxLen,
-		serialNotify: bcast.NewGroup(),
+		serialNotify: newNotifyGroup(),
+		notifyCh:     make(chan struct{}, 1),
+	}
+}
+
+// notify tells all sessions that the serial has been updated. With
+// --notify-interval or --notify-debounce, broadcasts are throttled by
+// throttleNotify.
+func (mgr *ResourceManager) notify() {
+	if commandOpts.NotifyInterval <= 0 && commandOpts.NotifyDebounce <= 0 {
+		mgr.serialNotify.Send()
+		return
+	}
+	select {
+	case mgr.notifyCh <- struct{}{}:
+	default:
+		// A broadcast is already pending
+	}
+}
+
+// throttleNotify broadcasts at most once per --notify-interval, and
+// --notify-debounce after the first update of a burst. Updates while waiting
+// are coalesced into one broadcast, since sessions send the serial current at
+// the time of the broadcast.
+func (mgr *ResourceManager) throttleNotify() {
+	var last time.Time
+	for range mgr.notifyCh {
+		// Unlike the interval, the first update waits for the rest of the
+		// burst too
+		if d := commandOpts.NotifyDebounce; d > 0 {
+			time.Sleep(d)
+		}
+		if wait := commandOpts.NotifyInterval - time.Since(last); wait > 0 {
+			time.Sleep(wait)
+		}
+		select {
+		case <-mgr.notifyCh:
+		default:
+		}
+		mgr.serialNotify.Send()
+		last = time.Now()
 	}
 }
 
 func (mgr *ResourceManager) Load(args []string) error {
+	return mgr.load(REQ_LOAD, args)
+}
+
+// LoadLazily finds the files without reading them. They are read by the
+// first Reload, for --lazy-load.
+func (mgr *ResourceManager) LoadLazily(args []string) error {
+	return mgr.load(REQ_LOAD_LAZILY, args)
+}
+
+func (mgr *ResourceManager) load(reqType RequestType, args []string) error {
 	mgr.init.Do(func() {
-		go mgr.serialNotify.Broadcast()
+		go mgr.throttleNotify()
 		mgr.ch = make(chan Request)
 		go mgr.run()
 	})
@@ -98,14 +170,29 @@ func (mgr *ResourceManager) Load(args []string) error {
 			extracted_files = append(extracted_files, f)
 		}
 	}
-	mgr.ch <- Request{RequestType: REQ_LOAD, Key: extracted_files, Response: result}
+	mgr.ch <- Request{RequestType: reqType, Key: extracted_files, Response: result}
 	res := <-result
 	return res.Error
 }
 
 func (mgr *ResourceManager) Reload() error {
+	return mgr.ReloadContext(context.Background())
+}
+
+// ReloadContext reloads the sources unless ctx is done before the new data
+// is made current. An aborted reload keeps the current data.
+func (mgr *ResourceManager) ReloadContext(ctx context.Context) error {
 	result := make(chan *Response)
-	mgr.ch <- Request{RequestType: REQ_RELOAD, Response: result}
+	mgr.ch <- Request{RequestType: REQ_RELOAD, Key: ctx, Response: result}
+	res := <-result
+	return res.Error
+}
+
+// ApplyChanges updates the resource with changes from the source, instead of
+// reloading all files.
+func (mgr *ResourceManager) ApplyChanges(src changeSource) error {
+	result := make(chan *Response)
+	mgr.ch <- Request{RequestType: REQ_APPLY_CHANGES, Key: src, Response: result}
 	res := <-result
 	return res.Error
 }
@@ -131,6 +218,22 @@ func (mgr *ResourceManager) DeltaList(sn uint32) FakeROATable {
 	return res.Data.(FakeROATable)
 }
 
+// CurrentASPAs returns all ASPAs of the current serial.
+func (mgr *ResourceManager) CurrentASPAs() []*FakeASPA {
+	result := make(chan *Response)
+	mgr.ch <- Request{RequestType: REQ_CURRENT_ASPAS, Response: result}
+	res := <-result
+	return res.Data.([]*FakeASPA)
+}
+
+// DeltaASPAs returns ASPAs changed since the serial.
+func (mgr *ResourceManager) DeltaASPAs(sn uint32) []*FakeASPA {
+	result := make(chan *Response)
+	mgr.ch <- Request{RequestType: REQ_DELTA_ASPAS, Key: sn, Response: result}
+	res := <-result
+	return res.Data.([]*FakeASPA)
+}
+
 func (mgr *ResourceManager) HasKey(sn uint32) bool {
 	result := make(chan *Response)
 	mgr.ch <- Request{RequestType: REQ_IF_SERIAL_EXISTS, Key: sn, Response: result}
@@ -138,6 +241,66 @@ func (mgr *ResourceManager) HasKey(sn uint32) bool {
 	return res.Data.(bool)
 }
 
+// HasData returns false until ROAs have been loaded, eg. if no source is
+// given.
+func (mgr *ResourceManager) HasData() bool {
+	result := make(chan *Response)
+	mgr.ch <- Request{RequestType: REQ_HAS_DATA, Response: result}
+	res := <-result
+	return res.Data.(bool)
+}
+
+// OldestSerial returns the serial of the oldest data retained in the
+// history. Routers at older serials can't get a delta.
+func (mgr *ResourceManager) OldestSerial() uint32 {
+	result := make(chan *Response)
+	mgr.ch <- Request{RequestType: REQ_OLDEST_SERIAL, Response: result}
+	res := <-result
+	return res.Data.(uint32)
+}
+
+// FullSync returns Prefix PDUs of the current ROAs serialized for the
+// protocol version, which are built on the first call for each serial.
+func (mgr *ResourceManager) FullSync(version uint8) *fullSyncStream {
+	result := make(chan *Response)
+	mgr.ch <- Request{RequestType: REQ_FULL_SYNC, Key: version, Response: result}
+	res := <-result
+	return res.Data.(*fullSyncStream)
+}
+
+// managerStatus tells where the current data came from, and when it was
+// successfully loaded for the last time.
+type managerStatus struct {
+	Serial     uint32
+	ReloadedAt time.Time
+	Sources    []string
+	// Hash is the content hash with --content-hash
+	Hash string
+}
+
+func (mgr *ResourceManager) Status() *managerStatus {
+	result := make(chan *Response)
+	mgr.ch <- Request{RequestType: REQ_STATUS, Response: result}
+	res := <-result
+	return res.Data.(*managerStatus)
+}
+
+// Checkpoint returns the serial history to save, without the session ID.
+func (mgr *ResourceManager) Checkpoint() *checkpoint {
+	result := make(chan *Response)
+	mgr.ch <- Request{RequestType: REQ_CHECKPOINT, Response: result}
+	res := <-result
+	return res.Data.(*checkpoint)
+}
+
+// Restore replaces the serial history with the checkpoint after Load.
+func (mgr *ResourceManager) Restore(cp *checkpoint) error {
+	result := make(chan *Response)
+	mgr.ch <- Request{RequestType: REQ_RESTORE, Key: cp, Response: result}
+	res := <-result
+	return res.Error
+}
+
 func (mgr *ResourceManager) BeginTransaction() *ResourceManager {
 	result := make(chan *Response)
 	trans := make(chan Request)
@@ -159,56 +322,110 @@ func handleRequests(mgr *ResourceManager, rsrc *resource) {
 		req := <-mgr.ch
 		switch req.RequestType {
 		case REQ_LOAD:
-			rsrc, err = newResource(req.Key.([]string), mgr.useMaxLen)
+			var loaded *resource
+			if loaded, err = newResource(req.Key.([]string), mgr.useMaxLen); err != nil {
+				req.Response <- &Response{Error: err}
+				break
+			}
+			rsrc = loaded
 			log.Infof("Resource has been loaded. (SN: %v)", rsrc.currentSN)
-			req.Response <- &Response{Error: err}
+			rsrc.logContentHash()
+			req.Response <- &Response{}
+		case REQ_LOAD_LAZILY:
+			rsrc = newLazyResource(req.Key.([]string), mgr.useMaxLen)
+			log.Infof("Resource will be loaded on the first connection. (SN: %v)", rsrc.currentSN)
+			req.Response <- &Response{}
 		case REQ_CURRENT_SERIAL:
 			req.Response <- &Response{Data: rsrc.currentSN}
 		case REQ_RELOAD:
 			serialNotify := false
-			nextSN := uint32(time.Now().Unix())
-			rsrc, err = rsrc.loadAs(nextSN)
+			ctx := req.Key.(context.Context)
+			next, nextASPAs, err := rsrc.stage(ctx, 0)
+			if err == nil {
+				// Aborted after all sources have been read
+				err = ctx.Err()
+			}
 			if err != nil {
 				req.Response <- &Response{Error: err}
-				log.Errorf("Could not load: %v", err)
+				log.Errorf("Could not load, keeping the current resource (SN: %v): %v", rsrc.currentSN, err)
+				break
+			}
+			// The files don't have the changes applied so far
+			if rsrc.changes != nil {
+				var token string
+				if next, token, err = rsrc.replayChanges(next); err != nil {
+					req.Response <- &Response{Error: err}
+					log.Errorf("Could not apply changes, keeping the current resource (SN: %v): %v", rsrc.currentSN, err)
+					break
+				}
+				rsrc.changeToken = token
+			}
+			if _, ok := rsrc.table[rsrc.currentSN]; !ok {
+				// The first load of --lazy-load has nothing to compare
+				rsrc.table[rsrc.currentSN] = next
+				rsrc.aspas[rsrc.currentSN] = nextASPAs
+				rsrc.loadedAt[rsrc.currentSN] = time.Now()
+				rsrc.reloadedAt = rsrc.loadedAt[rsrc.currentSN]
+				rsrc.updateContentHash()
+				log.Infof("Resource has been loaded. (SN: %v)", rsrc.currentSN)
+				rsrc.logContentHash()
+				mgr.notify()
+				req.Response <- &Response{Error: nil}
 				break
 			}
 
 			for _, rf := range []bgp.RouteFamily{bgp.RF_IPv4_UC, bgp.RF_IPv6_UC} {
-				log.Infof("%v current table size is %v, next table size is %v.", rf, rsrc.table[rsrc.currentSN][rf].Len(), rsrc.table[nextSN][rf].Len())
+				log.Infof("%v current table size is %v, next table size is %v.", rf, rsrc.table[rsrc.currentSN][rf].Len(), next[rf].Len())
 			}
-			if eql := reflect.DeepEqual(rsrc.table[rsrc.currentSN], rsrc.table[nextSN]); !eql {
-				log.Infof("Resource has been updated. (SN: %v -> %v)", rsrc.currentSN, nextSN)
-				rsrc.currentSN = nextSN
+			// Counted as deltas are, by ROA rather than by prefix
+			added, removed := countDiff(rsrc.table[rsrc.currentSN], next)
+			prevSN := rsrc.currentSN
+			aspaChanges := countASPAChanges(rsrc.aspas[rsrc.currentSN], nextASPAs)
+			// The trees may differ in order alone, eg. of ASNs, which is no change
+			if added+removed+aspaChanges > 0 {
+				rsrc.advance(next, nextASPAs, added+removed+aspaChanges)
 				serialNotify = true
-			} else {
-				delete(rsrc.table, nextSN)
 			}
+			logReloadSummary(fmt.Sprintf("reload: +%d added, -%d withdrawn, serial %v→%v, source=%s", added, removed, prevSN, rsrc.currentSN, strings.Join(rsrc.sources(), ",")))
+			rsrc.reloadedAt = time.Now()
+			rsrc.logContentHash()
 
 			for k, _ := range rsrc.table {
 				if rsrc.currentSN != k {
 					t := time.Now()
-					if int64(k) < t.Add(-24*time.Hour).Unix() {
+					if loadedAt := rsrc.loadedAt[k]; loadedAt.Before(t.Add(-24 * time.Hour)) {
 						delete(rsrc.table, k)
-						log.Infof("Resource as of %v was expired. (SN: %v)", time.Unix(int64(k), 0).Format("2006/01/02 15:04:05"), k)
+						delete(rsrc.aspas, k)
+						delete(rsrc.loadedAt, k)
+						log.Infof("Resource as of %v was expired. (SN: %v)", loadedAt.Format("2006/01/02 15:04:05"), k)
 					}
 				}
 			}
 			if serialNotify {
-				mgr.serialNotify.Send(true)
+				mgr.notify()
 			}
 
 			req.Response <- &Response{Error: nil}
 		case REQ_CURRENT_LIST:
-			lists := FakeROATable{
-				bgp.RF_IPv4_UC: map[uint8][]*FakeROA{},
-				bgp.RF_IPv6_UC: map[uint8][]*FakeROA{},
+			req.Response <- &Response{Data: currentList(rsrc)}
+		case REQ_FULL_SYNC:
+			version := req.Key.(uint8)
+			s, ok := rsrc.fullSync[version]
+			if !ok {
+				lists := currentList(rsrc)
+				sortFakeROATable(lists, commandOpts.Sort)
+				s = newFullSyncStream(rsrc.currentSN, lists, version)
+				if rsrc.fullSync == nil {
+					rsrc.fullSync = map[uint8]*fullSyncStream{}
+				}
+				rsrc.fullSync[version] = s
+				log.Infof("Serialized %d ROA(s) for full synchronizations of version %v (SN: %v)", s.roas(), version, rsrc.currentSN)
 			}
-
-			lists[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT] = fakeROALists(rsrc, treeToSet(rsrc.table[rsrc.currentSN][bgp.RF_IPv4_UC]))
-			lists[bgp.RF_IPv6_UC][rtr.ANNOUNCEMENT] = fakeROALists(rsrc, treeToSet(rsrc.table[rsrc.currentSN][bgp.RF_IPv6_UC]))
-
-			req.Response <- &Response{Data: lists}
+			req.Response <- &Response{Data: s}
+		case REQ_CURRENT_ASPAS:
+			req.Response <- &Response{Data: currentASPAs(rsrc)}
+		case REQ_DELTA_ASPAS:
+			req.Response <- &Response{Data: deltaASPAs(rsrc, req.Key.(uint32))}
 		case REQ_DELTA_LIST:
 			k := req.Key.(uint32)
 			lists := FakeROATable{
@@ -216,15 +433,55 @@ func handleRequests(mgr *ResourceManager, rsrc *resource) {
 				bgp.RF_IPv6_UC: map[uint8][]*FakeROA{},
 			}
 
+			if commandOpts.ReaddChanged {
+				for _, rf := range []bgp.RouteFamily{bgp.RF_IPv4_UC, bgp.RF_IPv6_UC} {
+					announced, withdrawn := readdChanged(treeToSet(rsrc.table[rsrc.currentSN][rf]), treeToSet(rsrc.table[k][rf]))
+					lists[rf][rtr.ANNOUNCEMENT] = fakeROALists(rsrc, announced)
+					lists[rf][rtr.WITHDRAWAL] = fakeROALists(rsrc, withdrawn)
+				}
+				req.Response <- &Response{Data: lists}
+				break
+			}
+
 			lists[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT] = fakeROALists(rsrc, treeToSet(rsrc.table[rsrc.currentSN][bgp.RF_IPv4_UC]).Difference(treeToSet(rsrc.table[k][bgp.RF_IPv4_UC])))
 			lists[bgp.RF_IPv6_UC][rtr.ANNOUNCEMENT] = fakeROALists(rsrc, treeToSet(rsrc.table[rsrc.currentSN][bgp.RF_IPv6_UC]).Difference(treeToSet(rsrc.table[k][bgp.RF_IPv6_UC])))
 			lists[bgp.RF_IPv4_UC][rtr.WITHDRAWAL] = fakeROALists(rsrc, treeToSet(rsrc.table[k][bgp.RF_IPv4_UC]).Difference(treeToSet(rsrc.table[rsrc.currentSN][bgp.RF_IPv4_UC])))
 			lists[bgp.RF_IPv6_UC][rtr.WITHDRAWAL] = fakeROALists(rsrc, treeToSet(rsrc.table[k][bgp.RF_IPv6_UC]).Difference(treeToSet(rsrc.table[rsrc.currentSN][bgp.RF_IPv6_UC])))
 
 			req.Response <- &Response{Data: lists}
+		case REQ_HAS_DATA:
+			req.Response <- &Response{Data: rsrc != nil && rsrc.table[rsrc.currentSN] != nil}
+		case REQ_OLDEST_SERIAL:
+			req.Response <- &Response{Data: rsrc.oldestSerial()}
 		case REQ_IF_SERIAL_EXISTS:
 			_, ok := rsrc.table[req.Key.(uint32)]
 			req.Response <- &Response{Data: ok}
+		case REQ_APPLY_CHANGES:
+			if rsrc.table[rsrc.currentSN] == nil {
+				// The changes are since the data loaded from files
+				log.Infof("Skipped changes, no data has been loaded yet")
+				req.Response <- &Response{}
+				break
+			}
+			changed, err := rsrc.applyChanges(req.Key.(changeSource))
+			if err != nil {
+				log.Errorf("Could not apply changes, keeping the current resource (SN: %v): %v", rsrc.currentSN, err)
+			}
+			if changed {
+				mgr.notify()
+			}
+			req.Response <- &Response{Error: err}
+		case REQ_STATUS:
+			req.Response <- &Response{Data: &managerStatus{
+				Serial:     rsrc.currentSN,
+				ReloadedAt: rsrc.reloadedAt,
+				Sources:    rsrc.sources(),
+				Hash:       rsrc.hash,
+			}}
+		case REQ_CHECKPOINT:
+			req.Response <- &Response{Data: rsrc.checkpoint()}
+		case REQ_RESTORE:
+			req.Response <- &Response{Error: rsrc.restore(req.Key.(*checkpoint))}
 		case REQ_BEGIN_TRANSACTION:
 			transaction := &ResourceManager{ch: req.transaction}
 			handleRequests(transaction, rsrc)
@@ -234,6 +491,17 @@ func handleRequests(mgr *ResourceManager, rsrc *resource) {
 	}
 }
 
+func currentList(rsrc *resource) FakeROATable {
+	lists := FakeROATable{
+		bgp.RF_IPv4_UC: map[uint8][]*FakeROA{},
+		bgp.RF_IPv6_UC: map[uint8][]*FakeROA{},
+	}
+
+	lists[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT] = fakeROALists(rsrc, treeToSet(rsrc.table[rsrc.currentSN][bgp.RF_IPv4_UC]))
+	lists[bgp.RF_IPv6_UC][rtr.ANNOUNCEMENT] = fakeROALists(rsrc, treeToSet(rsrc.table[rsrc.currentSN][bgp.RF_IPv6_UC]))
+	return lists
+}
+
 func fakeROALists(rsrc *resource, list set.Set) []*FakeROA {
 	fakeROAs := make([]*FakeROA, 0)
 	for _, item := range list.ToSlice() {
@@ -248,6 +516,101 @@ func fakeROALists(rsrc *resource, list set.Set) []*FakeROA {
 	return fakeROAs
 }
 
+func comparePrefix(a, b *FakeROA) int {
+	if c := bytes.Compare(a.Prefix.To16(), b.Prefix.To16()); c != 0 {
+		return c
+	}
+	switch {
+	case a.PrefixLen != b.PrefixLen:
+		return int(a.PrefixLen) - int(b.PrefixLen)
+	case a.MaxLen != b.MaxLen:
+		return int(a.MaxLen) - int(b.MaxLen)
+	case a.AS < b.AS:
+		return -1
+	case a.AS > b.AS:
+		return 1
+	}
+	return 0
+}
+
+// sortFakeROAs sorts ROAs by the key("prefix", "asn" or "maxlen"), and ROAs
+// which have the same key are sorted in prefix order.
+func sortFakeROAs(roas []*FakeROA, key string) {
+	sort.Slice(roas, func(i, j int) bool {
+		a, b := roas[i], roas[j]
+		switch {
+		case key == "asn" && a.AS != b.AS:
+			return a.AS < b.AS
+		case key == "maxlen" && a.MaxLen != b.MaxLen:
+			return a.MaxLen < b.MaxLen
+		}
+		return comparePrefix(a, b) < 0
+	})
+}
+
+func sortFakeROATable(lists FakeROATable, key string) {
+	for _, byFlag := range lists {
+		for _, roas := range byFlag {
+			sortFakeROAs(roas, key)
+		}
+	}
+}
+
+// readdChanged returns all ROAs of the prefixes changed between the sets, as
+// a withdrawal of the old ROAs and an announcement of the current ones.
+func readdChanged(current, old set.Set) (set.Set, set.Set) {
+	prefixOf := func(item interface{}) string {
+		return strings.SplitN(item.(string), "-", 2)[0]
+	}
+	changed := map[string]bool{}
+	for _, item := range current.SymmetricDifference(old).ToSlice() {
+		changed[prefixOf(item)] = true
+	}
+	announced, withdrawn := set.NewSet(), set.NewSet()
+	for _, item := range current.ToSlice() {
+		if changed[prefixOf(item)] {
+			announced.Add(item)
+		}
+	}
+	for _, item := range old.ToSlice() {
+		if changed[prefixOf(item)] {
+			withdrawn.Add(item)
+		}
+	}
+	return announced, withdrawn
+}
+
+// logReloadSummary logs the summary of a reload at the level specified by
+// --reload-summary.
+func logReloadSummary(summary string) {
+	switch commandOpts.ReloadSummary {
+	case "off":
+	case "debug":
+		log.Debug(summary)
+	default:
+		log.Info(summary)
+	}
+}
+
+// countChanges returns the number of ROAs announced or withdrawn between
+// the tables.
+func countChanges(current, next map[bgp.RouteFamily]*radix.Tree) int {
+	added, removed := countDiff(current, next)
+	return added + removed
+}
+
+// countDiff returns the numbers of ROAs added and removed from the current
+// table to the next.
+func countDiff(current, next map[bgp.RouteFamily]*radix.Tree) (int, int) {
+	added, removed := 0, 0
+	for _, rf := range []bgp.RouteFamily{bgp.RF_IPv4_UC, bgp.RF_IPv6_UC} {
+		c, n := treeToSet(current[rf]), treeToSet(next[rf])
+		added += n.Difference(c).Cardinality()
+		removed += c.Difference(n).Cardinality()
+	}
+	return added, removed
+}
+
 func treeToSet(table *radix.Tree) set.Set {
 	i := 0
 	tableMap := make([]*prefixResource, table.Len())
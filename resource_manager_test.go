@@ -0,0 +1,472 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/osrg/gobgp/pkg/packet/bgp"
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortFakeROAs(t *testing.T) {
+	newROA := func(prefix string, maxLen uint8, as uint32) *FakeROA {
+		_, ip, plen, _, _ := parsePrefix(prefix)
+		return &FakeROA{Prefix: ip, PrefixLen: plen, MaxLen: maxLen, AS: as}
+	}
+	roas := func() []*FakeROA {
+		return []*FakeROA{
+			newROA("192.168.2.0/24", 24, 65001),
+			newROA("192.168.1.0/24", 26, 65002),
+			newROA("10.0.0.0/8", 16, 65002),
+			newROA("192.168.0.0/24", 24, 65001),
+		}
+	}
+	toStrings := func(roas []*FakeROA) []string {
+		result := []string{}
+		for _, v := range roas {
+			result = append(result, (&net.IPNet{IP: v.Prefix, Mask: net.CIDRMask(int(v.PrefixLen), 32)}).String())
+		}
+		return result
+	}
+
+	examples := map[string][]string{
+		"prefix": {"10.0.0.0/8", "192.168.0.0/24", "192.168.1.0/24", "192.168.2.0/24"},
+		"asn":    {"192.168.0.0/24", "192.168.2.0/24", "10.0.0.0/8", "192.168.1.0/24"},
+		"maxlen": {"10.0.0.0/8", "192.168.0.0/24", "192.168.2.0/24", "192.168.1.0/24"},
+	}
+	for key, expected := range examples {
+		t.Run(key, func(t *testing.T) {
+			list := roas()
+			sortFakeROAs(list, key)
+			assert.Equal(t, expected, toStrings(list))
+		})
+	}
+}
+
+func TestReloadRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	route := func(prefix string) []string {
+		return []string{
+			"route: " + prefix + "\n",
+			"origin: AS65001\n",
+			"source: TEST\n",
+			"\n",
+		}
+	}
+	file1 := createFile("TestReloadRollback", route("192.168.1.0/24"))
+	defer removeFile(file1)
+	file2 := createFile("TestReloadRollback", route("192.168.2.0/24"))
+	defer removeFile(file2)
+
+	mgr := NewResourceManager(false)
+	assert.Nil(mgr.Load([]string{file1, file2}))
+	currentSN := mgr.CurrentSerial()
+
+	// The first file is updated, but the second one is broken
+	ioutil.WriteFile(file1, []byte("route: 192.168.3.0/24\norigin: AS65001\nsource: TEST\n\n"), 0644)
+	ioutil.WriteFile(file2, []byte("route: 192.168.300.0/24\norigin: AS65001\nsource: TEST\n\n"), 0644)
+	assert.NotNil(mgr.Reload())
+
+	assert.Equal(currentSN, mgr.CurrentSerial())
+	list := mgr.CurrentList()[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT]
+	prefixes := []string{}
+	for _, v := range list {
+		prefixes = append(prefixes, v.Prefix.String())
+	}
+	assert.ElementsMatch([]string{"192.168.1.0", "192.168.2.0"}, prefixes)
+
+	// Reloading within the same second still gets a new serial number
+	ioutil.WriteFile(file2, []byte("route: 192.168.4.0/24\norigin: AS65001\nsource: TEST\n\n"), 0644)
+	assert.Nil(mgr.Reload())
+	assert.NotEqual(currentSN, mgr.CurrentSerial())
+	assert.Len(mgr.CurrentList()[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT], 2)
+	assert.True(mgr.HasKey(currentSN))
+}
+
+func TestLoadError(t *testing.T) {
+	assert := assert.New(t)
+
+	file := createFile("TestLoadError", []string{
+		"route: 192.168.1.0/24\n",
+		"origin: ASX\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(file)
+
+	// The error is reported rather than crashing the manager
+	mgr := NewResourceManager(false)
+	assert.NotNil(mgr.Load([]string{file}))
+
+	ioutil.WriteFile(file, []byte("route: 192.168.1.0/24\norigin: AS65001\nsource: TEST\n\n"), 0644)
+	assert.Nil(mgr.Load([]string{file}))
+	assert.Len(mgr.CurrentList()[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT], 1)
+}
+
+func TestSerialMode(t *testing.T) {
+	assert := assert.New(t)
+	defer func() { commandOpts.SerialMode = "" }()
+
+	for _, mode := range []string{"random", "random-increment"} {
+		t.Run(mode, func(t *testing.T) {
+			commandOpts.SerialMode = mode
+			file := createFile("TestSerialMode", []string{
+				"route: 192.168.1.0/24\n",
+				"origin: AS65001\n",
+				"source: TEST\n",
+				"\n",
+			})
+			defer removeFile(file)
+
+			mgr := NewResourceManager(false)
+			assert.Nil(mgr.Load([]string{file}))
+			for i := 0; i < 5; i++ {
+				currentSN := mgr.CurrentSerial()
+				ioutil.WriteFile(file, []byte(fmt.Sprintf("route: 10.%d.0.0/16\norigin: AS65001\nsource: TEST\n\n", i)), 0644)
+				assert.Nil(mgr.Reload())
+
+				nextSN := mgr.CurrentSerial()
+				assert.NotEqual(currentSN, nextSN)
+				if mode == "random-increment" {
+					// nextSN is greater than currentSN in terms of RFC 1982
+					assert.True(nextSN-currentSN > 0 && nextSN-currentSN < 1<<31)
+				}
+				assert.True(mgr.HasKey(currentSN))
+				delta := mgr.DeltaList(currentSN)[bgp.RF_IPv4_UC]
+				assert.Len(delta[rtr.ANNOUNCEMENT], 1)
+				assert.Len(delta[rtr.WITHDRAWAL], 1)
+			}
+		})
+	}
+}
+
+func TestSerialStep(t *testing.T) {
+	assert := assert.New(t)
+	defer func() {
+		commandOpts.SerialMode = ""
+		commandOpts.SerialStep = 0
+	}()
+
+	examples := map[string]struct {
+		step     int
+		expected []uint32
+	}{
+		// 192.168.0.0/24 is replaced, and then 10.0.0.0/8 is added
+		"step":    {10, []uint32{10, 10}},
+		"changes": {0, []uint32{2, 1}},
+	}
+	for mode, example := range examples {
+		commandOpts.SerialMode = mode
+		commandOpts.SerialStep = example.step
+		file := createFile("TestSerialStep", []string{"route: 192.168.0.0/24\norigin: AS65001\nsource: TEST\n\n"})
+		defer removeFile(file)
+
+		mgr := NewResourceManager(false)
+		assert.Nil(mgr.Load([]string{file}))
+		for i, content := range []string{
+			"route: 192.168.1.0/24\norigin: AS65001\nsource: TEST\n\n",
+			"route: 192.168.1.0/24\norigin: AS65001\nsource: TEST\n\nroute: 10.0.0.0/8\norigin: AS65001\nsource: TEST\n\n",
+		} {
+			currentSN := mgr.CurrentSerial()
+			ioutil.WriteFile(file, []byte(content), 0644)
+			assert.Nil(mgr.Reload())
+			assert.Equal(example.expected[i], mgr.CurrentSerial()-currentSN, mode)
+		}
+	}
+}
+
+func TestReloadReordered(t *testing.T) {
+	assert := assert.New(t)
+	commandOpts.SerialMode = "changes"
+	defer func() { commandOpts.SerialMode = "" }()
+
+	route := func(asn int) string {
+		return fmt.Sprintf("route: 192.168.0.0/24\norigin: AS%d\nsource: TEST\n\n", asn)
+	}
+	file := createFile("TestReloadReordered", []string{route(65001), route(65002)})
+	defer removeFile(file)
+	mgr := NewResourceManager(false)
+	assert.Nil(mgr.Load([]string{file}))
+	currentSN := mgr.CurrentSerial()
+
+	// The same ROAs in another order are no change
+	ioutil.WriteFile(file, []byte(route(65002)+route(65001)), 0644)
+	done := make(chan error, 1)
+	go func() { done <- mgr.Reload() }()
+	select {
+	case err := <-done:
+		assert.Nil(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reload didn't return")
+	}
+	assert.Equal(currentSN, mgr.CurrentSerial())
+
+	// A change of ASPAs alone still advances the serial
+	assert.Equal(currentSN+1, nextSerial(currentSN, 0))
+}
+
+func TestMaxHistory(t *testing.T) {
+	assert := assert.New(t)
+	commandOpts.MaxHistory = 2
+	defer func() { commandOpts.MaxHistory = 0 }()
+
+	file := createFile("TestMaxHistory", []string{"route: 192.168.0.0/24\norigin: AS65001\nsource: TEST\n\n"})
+	defer removeFile(file)
+	mgr := NewResourceManager(false)
+	assert.Nil(mgr.Load([]string{file}))
+	serials := []uint32{mgr.CurrentSerial()}
+	for i := 1; i <= 3; i++ {
+		ioutil.WriteFile(file, []byte(fmt.Sprintf("route: 192.168.%d.0/24\norigin: AS65001\nsource: TEST\n\n", i)), 0644)
+		assert.Nil(mgr.Reload())
+		serials = append(serials, mgr.CurrentSerial())
+	}
+
+	// The oldest serial is evicted, and routers at it get Cache Reset
+	assert.False(mgr.HasKey(serials[0]))
+	assert.True(mgr.HasKey(serials[1]))
+	assert.True(mgr.HasKey(serials[2]))
+	assert.Equal(serials[1], mgr.OldestSerial())
+	delta := mgr.DeltaList(serials[1])[bgp.RF_IPv4_UC]
+	assert.Len(delta[rtr.ANNOUNCEMENT], 1)
+	assert.Len(delta[rtr.WITHDRAWAL], 1)
+}
+
+func TestContentHash(t *testing.T) {
+	assert := assert.New(t)
+	commandOpts.ContentHash = true
+	defer func() { commandOpts.ContentHash = false }()
+
+	route := func(prefix string, asn int) string {
+		return fmt.Sprintf("route: %s\norigin: AS%d\nsource: TEST\n\n", prefix, asn)
+	}
+	file1 := createFile("TestContentHash", []string{route("192.168.0.0/24", 65001), route("2001:db8::/32", 65002)})
+	defer removeFile(file1)
+	file2 := createFile("TestContentHash", []string{route("2001:db8::/32", 65002), route("192.168.0.0/24", 65001)})
+	defer removeFile(file2)
+
+	mgr1 := NewResourceManager(false)
+	assert.Nil(mgr1.Load([]string{file1}))
+	mgr2 := NewResourceManager(false)
+	assert.Nil(mgr2.Load([]string{file2}))
+	// The same data in another order has the same hash
+	hash := mgr1.Status().Hash
+	assert.Len(hash, 64)
+	assert.Equal(hash, mgr2.Status().Hash)
+
+	// and a change of the data changes it
+	ioutil.WriteFile(file2, []byte(route("192.168.0.0/24", 65001)+route("2001:db8::/32", 65003)), 0644)
+	assert.Nil(mgr2.Reload())
+	assert.NotEqual(hash, mgr2.Status().Hash)
+	assert.Equal(mgr2.Status().Hash, contentHash.Value())
+
+	// back to the same data, the same hash again
+	ioutil.WriteFile(file2, []byte(route("2001:db8::/32", 65002)+route("192.168.0.0/24", 65001)), 0644)
+	assert.Nil(mgr2.Reload())
+	assert.Equal(hash, mgr2.Status().Hash)
+
+	commandOpts.ContentHash = false
+	mgr3 := NewResourceManager(false)
+	assert.Nil(mgr3.Load([]string{file1}))
+	assert.Equal("", mgr3.Status().Hash)
+}
+
+func TestSerialWrap(t *testing.T) {
+	assert := assert.New(t)
+	defer func() {
+		commandOpts.SerialMode = ""
+		commandOpts.SerialStep = 0
+	}()
+
+	// Steps within 2^31-1 allowed by RFC 1982, which hit 0xFFFFFFFF
+	commandOpts.SerialMode = "step"
+	commandOpts.SerialStep = math.MaxUint32 / 3
+	file := createFile("TestSerialWrap", []string{"route: 10.0.0.0/16\norigin: AS65001\nsource: TEST\n\n"})
+	defer removeFile(file)
+
+	mgr := NewResourceManager(false)
+	assert.Nil(mgr.Load([]string{file}))
+	serials := []uint32{mgr.CurrentSerial()}
+	for i := 1; i <= 3; i++ {
+		ioutil.WriteFile(file, []byte(fmt.Sprintf("route: 10.%d.0.0/16\norigin: AS65001\nsource: TEST\n\n", i)), 0644)
+		assert.Nil(mgr.Reload())
+		serials = append(serials, mgr.CurrentSerial())
+	}
+	assert.Equal([]uint32{0x55555555, 0xAAAAAAAA, math.MaxUint32, 0x55555554}, serials)
+	for i := 1; i < len(serials); i++ {
+		assert.True(serialNewer(serials[i], serials[i-1]))
+	}
+	// A router at the serial before the wrap still gets a delta
+	assert.True(mgr.HasKey(math.MaxUint32))
+	delta := mgr.DeltaList(math.MaxUint32)[bgp.RF_IPv4_UC]
+	assert.Len(delta[rtr.ANNOUNCEMENT], 1)
+	assert.Len(delta[rtr.WITHDRAWAL], 1)
+
+	// A serial ahead of the clock, eg. wrapped from the far future, still
+	// advances in time mode
+	commandOpts.SerialMode = ""
+	for _, currentSN := range []uint32{math.MaxUint32, 0, uint32(time.Now().Unix()) + 100} {
+		assert.True(serialNewer(nextSerial(currentSN, 1), currentSN), currentSN)
+	}
+}
+
+func TestNotifyInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	commandOpts.NotifyInterval = 200 * time.Millisecond
+	defer func() { commandOpts.NotifyInterval = 0 }()
+
+	file := createFile("TestNotifyInterval", []string{"route: 192.168.0.0/24\norigin: AS65001\nsource: TEST\n\n"})
+	defer removeFile(file)
+	mgr := NewResourceManager(false)
+	assert.Nil(mgr.Load([]string{file}))
+	receiver := mgr.serialNotify.Join()
+	defer receiver.Close()
+
+	reload := func(i int) {
+		ioutil.WriteFile(file, []byte(fmt.Sprintf("route: 192.168.%d.0/24\norigin: AS65001\nsource: TEST\n\n", i)), 0644)
+		assert.Nil(mgr.Reload())
+	}
+	receive := func(d time.Duration) []time.Time {
+		received := []time.Time{}
+		timeout := time.After(d)
+		for {
+			select {
+			case <-receiver.In:
+				received = append(received, time.Now())
+			case <-timeout:
+				return received
+			}
+		}
+	}
+
+	// The first update is broadcast at once
+	reload(1)
+	first := receive(100 * time.Millisecond)
+	assert.Len(first, 1)
+
+	// and the following updates in a burst are coalesced
+	for i := 2; i <= 5; i++ {
+		reload(i)
+	}
+	rest := receive(400 * time.Millisecond)
+	assert.Len(rest, 1)
+	if len(first) == 1 && len(rest) == 1 {
+		assert.True(rest[0].Sub(first[0]) >= 150*time.Millisecond)
+	}
+}
+
+func TestNotifyDebounce(t *testing.T) {
+	assert := assert.New(t)
+
+	commandOpts.NotifyDebounce = 200 * time.Millisecond
+	defer func() { commandOpts.NotifyDebounce = 0 }()
+
+	file := createFile("TestNotifyDebounce", []string{"route: 192.168.0.0/24\norigin: AS65001\nsource: TEST\n\n"})
+	defer removeFile(file)
+	mgr := NewResourceManager(false)
+	assert.Nil(mgr.Load([]string{file}))
+	receiver := mgr.serialNotify.Join()
+	defer receiver.Close()
+
+	// A burst of updates is broadcast once after the window
+	start := time.Now()
+	for i := 1; i <= 5; i++ {
+		ioutil.WriteFile(file, []byte(fmt.Sprintf("route: 192.168.%d.0/24\norigin: AS65001\nsource: TEST\n\n", i)), 0644)
+		assert.Nil(mgr.Reload())
+	}
+	latestSN := mgr.CurrentSerial()
+	received := 0
+	timeout := time.After(600 * time.Millisecond)
+LOOP:
+	for {
+		select {
+		case <-receiver.In:
+			received++
+			assert.True(time.Since(start) >= 150*time.Millisecond)
+			// Sessions send the serial current at the broadcast
+			assert.Equal(latestSN, mgr.CurrentSerial())
+		case <-timeout:
+			break LOOP
+		}
+	}
+	assert.Equal(1, received)
+}
+
+func TestNotifySlowReceiver(t *testing.T) {
+	assert := assert.New(t)
+
+	file := createFile("TestNotifySlowReceiver", []string{"route: 192.168.0.0/24\norigin: AS65001\nsource: TEST\n\n"})
+	defer removeFile(file)
+	mgr := NewResourceManager(false)
+	assert.Nil(mgr.Load([]string{file}))
+	// A receiver which never reads, like a session blocked on a slow router
+	blocked := mgr.serialNotify.Join()
+	defer blocked.Close()
+	receiver := mgr.serialNotify.Join()
+	defer receiver.Close()
+
+	for i := 1; i <= 3; i++ {
+		ioutil.WriteFile(file, []byte(fmt.Sprintf("route: 192.168.%d.0/24\norigin: AS65001\nsource: TEST\n\n", i)), 0644)
+		assert.Nil(mgr.Reload())
+		select {
+		case <-receiver.In:
+		case <-time.After(time.Second):
+			t.Fatalf("notify #%d was not received", i)
+		}
+	}
+	// and the blocked one has the latest pending
+	assert.Len(blocked.In, 1)
+}
+
+func TestReloadSummary(t *testing.T) {
+	assert := assert.New(t)
+
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.InfoLevel)
+	defer logrus.SetLevel(level)
+
+	route := func(prefix string, origin int) string {
+		return fmt.Sprintf("route: %s\norigin: AS%d\nsource: TEST\n\n", prefix, origin)
+	}
+	file := createFile("TestReloadSummary", []string{route("192.168.0.0/24", 65001), route("192.168.1.0/24", 65001)})
+	defer removeFile(file)
+	mgr := NewResourceManager(false)
+	assert.Nil(mgr.Load([]string{file}))
+	receiver := mgr.serialNotify.Join()
+	defer receiver.Close()
+
+	// A changed prefix is counted as both added and removed
+	ioutil.WriteFile(file, []byte(route("192.168.0.0/24", 65002)+route("192.168.2.0/24", 65001)+route("192.168.3.0/24", 65001)), 0644)
+	prevSN := mgr.CurrentSerial()
+	hook.Reset()
+	assert.Nil(mgr.Reload())
+	assert.Equal(fmt.Sprintf("reload: +3 added, -2 withdrawn, serial %v→%v, source=%s", prevSN, mgr.CurrentSerial(), file), hook.LastEntry().Message)
+	select {
+	case <-receiver.In:
+	case <-time.After(time.Second):
+		t.Error("routers were not notified of the reload")
+	}
+
+	currentSN := mgr.CurrentSerial()
+	hook.Reset()
+	assert.Nil(mgr.Reload())
+	assert.Equal(fmt.Sprintf("reload: +0 added, -0 withdrawn, serial %v→%v, source=%s", currentSN, currentSN, file), hook.LastEntry().Message)
+
+	commandOpts.ReloadSummary = "off"
+	defer func() { commandOpts.ReloadSummary = "" }()
+	hook.Reset()
+	assert.Nil(mgr.Reload())
+	for _, e := range hook.AllEntries() {
+		assert.NotContains(e.Message, "reload:")
+	}
+}
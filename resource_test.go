@@ -1,11 +1,18 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"sort"
 	"testing"
 
 	"github.com/osrg/gobgp/pkg/packet/bgp"
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -169,6 +176,301 @@ func TestResource(t *testing.T) {
 	}
 }
 
+func TestMaxASNs(t *testing.T) {
+	assert := assert.New(t)
+	commandOpts.MaxASNs = 2
+	defer func() { commandOpts.MaxASNs = 0 }()
+
+	tmpFile := createFile("TestMaxASNs", []string{
+		"route: 192.168.1.0/24\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+		"route: 192.168.1.0/24\n",
+		"origin: AS65002\n",
+		"remarks: maxLength 26\n",
+		"source: TEST\n",
+		"\n",
+		"route: 192.168.1.0/24\n",
+		"origin: AS65001\n",
+		"remarks: maxLength 26\n",
+		"source: TEST\n",
+		"\n",
+		"route: 192.168.1.0/24\n",
+		"origin: AS65003\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(tmpFile)
+
+	r, err := newResource([]string{tmpFile}, false)
+	assert.Nil(err)
+
+	rf, addr, maskLen, _, _ := parsePrefix("192.168.1.0/24")
+	b, _ := r.table[r.currentSN][rf].Get(generateKey(rf, addr, maskLen))
+	bucket := b.(*prefixResource)
+	assert.Equal(2, bucket.countASNs())
+	assert.True(bucket.hasASN(65001))
+	assert.True(bucket.hasASN(65002))
+	assert.False(bucket.hasASN(65003))
+}
+
+func TestPrefixLenRange(t *testing.T) {
+	assert := assert.New(t)
+	commandOpts.MinPrefixLen4, commandOpts.MaxPrefixLen4 = 8, 16
+	commandOpts.MinPrefixLen6 = 32
+	defer func() {
+		commandOpts.MinPrefixLen4, commandOpts.MaxPrefixLen4 = 0, 0
+		commandOpts.MinPrefixLen6 = 0
+	}()
+
+	tmpFile := createFile("TestPrefixLenRange", []string{
+		"route: 10.0.0.0/8\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+		"route: 172.16.0.0/12\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+		"route: 192.168.1.0/24\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+		"route6: 2001:db8::/32\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+		"route6: 2001::/16\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+		"route6: 2001:db8:1::/48\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(tmpFile)
+
+	r, err := newResource([]string{tmpFile}, false)
+	assert.Nil(err)
+
+	for prefix, expected := range map[string]bool{
+		"10.0.0.0/8":      true,
+		"172.16.0.0/12":   true,
+		"192.168.1.0/24":  false,
+		"2001:db8::/32":   true,
+		"2001::/16":       false,
+		"2001:db8:1::/48": true,
+	} {
+		rf, addr, maskLen, _, _ := parsePrefix(prefix)
+		_, ok := r.table[r.currentSN][rf].Get(generateKey(rf, addr, maskLen))
+		assert.Equal(expected, ok, prefix)
+	}
+}
+
+func TestASNFilter(t *testing.T) {
+	assert := assert.New(t)
+	commandOpts.ASNFilter = make([]asn, 2)
+	for i, v := range []string{"AS65001", "65003"} {
+		assert.Nil(commandOpts.ASNFilter[i].UnmarshalFlag(v))
+	}
+	defer func() { commandOpts.ASNFilter = nil }()
+	var a asn
+	assert.NotNil(a.UnmarshalFlag("ASX"))
+
+	tmpFile := createFile("TestASNFilter", []string{
+		"route: 192.168.1.0/24\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+		"route: 192.168.1.0/24\n",
+		"origin: AS65002\n",
+		"source: TEST\n",
+		"\n",
+		"route: 192.168.2.0/24\n",
+		"origin: AS65002\n",
+		"source: TEST\n",
+		"\n",
+		"route6: 2001:db8::/32\n",
+		"origin: AS65003\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(tmpFile)
+
+	r, err := newResource([]string{tmpFile}, false)
+	assert.Nil(err)
+
+	get := func(prefix string) *prefixResource {
+		rf, addr, maskLen, _, _ := parsePrefix(prefix)
+		b, _ := r.table[r.currentSN][rf].Get(generateKey(rf, addr, maskLen))
+		if b == nil {
+			return nil
+		}
+		return b.(*prefixResource)
+	}
+	assert.True(get("192.168.1.0/24").hasASN(65001))
+	assert.False(get("192.168.1.0/24").hasASN(65002))
+	assert.Nil(get("192.168.2.0/24"))
+	assert.True(get("2001:db8::/32").hasASN(65003))
+}
+
+func TestRejectASNs(t *testing.T) {
+	assert := assert.New(t)
+	defer func() { commandOpts.RejectASNs = nil }()
+
+	tmpFile := createFile("TestRejectASNs", []string{
+		"route: 192.168.0.0/24\n",
+		"origin: AS0\n",
+		"source: TEST\n",
+		"\n",
+		"route: 192.168.1.0/24\n",
+		"origin: AS23456\n",
+		"source: TEST\n",
+		"\n",
+		"route: 192.168.2.0/24\n",
+		"origin: AS64500\n",
+		"source: TEST\n",
+		"\n",
+		"route: 192.168.3.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(tmpFile)
+
+	loaded := func() map[string]bool {
+		r, err := newResource([]string{tmpFile}, false)
+		assert.Nil(err)
+		result := map[string]bool{}
+		for _, prefix := range []string{"192.168.0.0/24", "192.168.1.0/24", "192.168.2.0/24", "192.168.3.0/24"} {
+			rf, addr, maskLen, _, _ := parsePrefix(prefix)
+			_, result[prefix] = r.table[r.currentSN][rf].Get(generateKey(rf, addr, maskLen))
+		}
+		return result
+	}
+
+	// AS0 ROAs are legitimate, and served by default
+	assert.Equal(map[string]bool{
+		"192.168.0.0/24": true,
+		"192.168.1.0/24": true,
+		"192.168.2.0/24": true,
+		"192.168.3.0/24": true,
+	}, loaded())
+
+	commandOpts.RejectASNs = make([]asnRange, 3)
+	for i, v := range []string{"0", "AS23456", "64496-64511"} {
+		assert.Nil(commandOpts.RejectASNs[i].UnmarshalFlag(v))
+	}
+	assert.Equal(map[string]bool{
+		"192.168.0.0/24": false,
+		"192.168.1.0/24": false,
+		"192.168.2.0/24": false,
+		"192.168.3.0/24": true,
+	}, loaded())
+
+	var r asnRange
+	assert.NotNil(r.UnmarshalFlag("64511-64496"))
+	assert.NotNil(r.UnmarshalFlag("foo"))
+}
+
+func TestParseASN(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, s := range []string{"AS65000", "65000", "as65000", "AS0065000", "65000 ", " AS65000\t", "065000"} {
+		asn, err := parseASN(s)
+		assert.Nil(err, s)
+		assert.Equal(uint32(65000), asn, s)
+	}
+	for _, s := range []string{"", "AS", "ASX", "AS 65000", "AS-1", "+65000", "65000.1", "AS4294967296"} {
+		_, err := parseASN(s)
+		assert.NotNil(err, s)
+	}
+}
+
+func TestLoadMalformedASN(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpFile := createFile("TestLoadMalformedASN", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: as065001\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(tmpFile)
+	roaFile := createFile("TestLoadMalformedASN", []string{`{"roas":[
+		{"prefix":"10.0.0.0/8","maxLength":24,"asn":"AS0065000"},
+		{"prefix":"2001:db8::/32","maxLength":48,"asn":"65002 "}
+	]}`})
+	defer removeFile(roaFile)
+	commandOpts.ROAFiles = []string{roaFile}
+	defer func() { commandOpts.ROAFiles = nil }()
+
+	rsrc, err := newResource([]string{tmpFile}, false)
+	if assert.Nil(err) {
+		asns := []uint32{}
+		for _, list := range currentList(rsrc) {
+			for _, v := range list[rtr.ANNOUNCEMENT] {
+				asns = append(asns, v.AS)
+			}
+		}
+		assert.ElementsMatch([]uint32{65000, 65001, 65002}, asns)
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	assert := assert.New(t)
+
+	blocklist := createFile("TestBlocklist", []string{
+		"# special-use\n",
+		"192.168.0.0/16\n",
+		"2001:db8::/32\n",
+	})
+	defer removeFile(blocklist)
+	commandOpts.Blocklist = blocklist
+	defer func() { commandOpts.Blocklist = "" }()
+
+	tmpFile := createFile("TestBlocklist", []string{
+		"route: 192.168.0.0/16\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+		"route: 192.168.1.0/24\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+		"route: 192.0.0.0/8\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+		"route: 10.0.0.0/8\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+		"route6: 2001:db8:1::/48\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(tmpFile)
+
+	r, err := newResource([]string{tmpFile}, false)
+	assert.Nil(err)
+
+	for prefix, expected := range map[string]bool{
+		"192.168.0.0/16":  false,
+		"192.168.1.0/24":  false,
+		"192.0.0.0/8":     true,
+		"10.0.0.0/8":      true,
+		"2001:db8:1::/48": false,
+	} {
+		rf, addr, maskLen, _, _ := parsePrefix(prefix)
+		_, ok := r.table[r.currentSN][rf].Get(generateKey(rf, addr, maskLen))
+		assert.Equal(expected, ok, prefix)
+	}
+}
+
 func TestParseCIDR(t *testing.T) {
 	examples := map[string]struct {
 		RouteFamily bgp.RouteFamily
@@ -201,3 +503,160 @@ func TestParseCIDR(t *testing.T) {
 		})
 	}
 }
+
+func TestMergePolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	primary := createFile("TestMergePolicy", []string{
+		"route: 192.168.0.0/24\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(primary)
+	secondary := createFile("TestMergePolicy", []string{
+		"route: 192.168.0.0/24\n",
+		"origin: AS65002\n",
+		"source: TEST\n",
+		"\n",
+		"route: 192.168.1.0/24\n",
+		"origin: AS65002\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(secondary)
+	empty := createFile("TestMergePolicy", []string{})
+	defer removeFile(empty)
+	defer func() { commandOpts.MergePolicy = "union" }()
+
+	loaded := func(files ...string) []string {
+		r, err := newResource(files, false)
+		assert.Nil(err)
+		roas := []string{}
+		for _, roa := range fakeROALists(r, treeToSet(r.table[r.currentSN][bgp.RF_IPv4_UC])) {
+			roas = append(roas, fmt.Sprintf("%v/%v AS%v", roa.Prefix, roa.PrefixLen, roa.AS))
+		}
+		sort.Strings(roas)
+		return roas
+	}
+
+	commandOpts.MergePolicy = "union"
+	assert.Equal([]string{
+		"192.168.0.0/24 AS65001",
+		"192.168.0.0/24 AS65002",
+		"192.168.1.0/24 AS65002",
+	}, loaded(primary, secondary))
+
+	commandOpts.MergePolicy = "primary-wins"
+	assert.Equal([]string{
+		"192.168.0.0/24 AS65001",
+		"192.168.1.0/24 AS65002",
+	}, loaded(primary, secondary))
+
+	commandOpts.MergePolicy = "fallback"
+	assert.Equal([]string{
+		"192.168.0.0/24 AS65001",
+	}, loaded(primary, secondary))
+	assert.Equal([]string{
+		"192.168.0.0/24 AS65002",
+		"192.168.1.0/24 AS65002",
+	}, loaded(empty, secondary))
+}
+
+func TestMultiASNPrefixes(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpFile := createFile("TestMultiASNPrefixes", []string{
+		"route: 192.168.0.0/24\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+		"route: 192.168.0.0/24\n",
+		"origin: AS65002\n",
+		"remarks: maxLength 26\n",
+		"source: TEST\n",
+		"\n",
+		"route: 192.168.1.0/24\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+		"route: 192.168.1.0/24\n",
+		"origin: AS65001\n",
+		"remarks: maxLength 26\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(tmpFile)
+
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	// mainLoop in quiet mode may have suppressed logs
+	level := log.GetLevel()
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(level)
+
+	_, err := newResource([]string{tmpFile}, false)
+	assert.Nil(err)
+
+	warnings := []string{}
+	for _, e := range hook.AllEntries() {
+		warnings = append(warnings, e.Message)
+	}
+	assert.Equal([]string{"Prefix 192.168.0.0/24 has ROAs for multiple ASNs (AS65001, AS65002)"}, warnings)
+	assert.Equal(int64(1), multiASNPrefixes.Value())
+}
+
+func TestSerialNewer(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(serialNewer(2, 1))
+	assert.False(serialNewer(1, 2))
+	assert.False(serialNewer(1, 1))
+	// Wraps around
+	assert.True(serialNewer(0, math.MaxUint32))
+	assert.False(serialNewer(math.MaxUint32, 0))
+}
+
+func TestParseObjects(t *testing.T) {
+	assert := assert.New(t)
+	objects := []string{}
+	for i := 0; i < 100; i++ {
+		objects = append(objects, fmt.Sprintf("route: 10.0.%d.0/24\norigin: AS%d\nremarks: maxLength %d\n", i, 65000+i, i))
+	}
+	objects = append(objects, "")
+
+	for _, workers := range []int{1, 3, 0} {
+		results := parseObjects(objects, workers)
+		assert.Equal(len(objects), len(results))
+		for i := 0; i < 100; i++ {
+			assert.Nil(results[i].err)
+			assert.Equal(fmt.Sprintf("AS%d", 65000+i), results[i].object.Get("origin"))
+			assert.Equal(i, results[i].maxLen)
+		}
+		assert.Equal(io.EOF, results[100].err)
+	}
+}
+
+func BenchmarkLoad(b *testing.B) {
+	content := []string{}
+	for i := 0; i < 100000; i++ {
+		content = append(content, fmt.Sprintf("route: %d.%d.%d.0/24\norigin: AS%d\nremarks: maxLength 24\nsource: TEST\n\n", 10+i/65536, i/256%256, i%256, 65000+i%1000))
+	}
+	tmpFile := createFile("BenchmarkLoad", content)
+	defer removeFile(tmpFile)
+	defer func() { commandOpts.LoadWorkers = 0 }()
+
+	for _, workers := range []int{1, 0} {
+		name := "single"
+		if workers == 0 {
+			name = "gomaxprocs"
+		}
+		b.Run(name, func(b *testing.B) {
+			commandOpts.LoadWorkers = workers
+			for i := 0; i < b.N; i++ {
+				if _, err := newResource([]string{tmpFile}, true); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
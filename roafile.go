@@ -0,0 +1,135 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+)
+
+// roaFile is a JSON file of validated ROAs, as exported by validators like
+// routinator or rpki-client. ASPAs are read if the file has them.
+//
+//	{"roas":[{"prefix":"10.0.0.0/8","maxLength":24,"asn":"AS65000"}],
+//	 "aspas":[{"customer":"AS65000","providers":["AS65001","AS65002"]}]}
+type roaFile struct {
+	ROAs  []*roaFileEntry  `json:"roas"`
+	ASPAs []*aspaFileEntry `json:"aspas"`
+}
+
+// aspaFileEntry is an ASPA, whose customer is "customer" in routinator, or
+// "customer_asid" in rpki-client.
+type aspaFileEntry struct {
+	Customer     *roaASN  `json:"customer"`
+	CustomerASID *roaASN  `json:"customer_asid"`
+	Providers    []roaASN `json:"providers"`
+}
+
+type roaFileEntry struct {
+	Prefix    string `json:"prefix"`
+	MaxLength int    `json:"maxLength"`
+	ASN       roaASN `json:"asn"`
+}
+
+// roaASN is an ASN written as "AS65000" by routinator, or as 65000 by
+// rpki-client.
+type roaASN uint32
+
+func (a *roaASN) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	n, err := parseASN(s)
+	if err != nil {
+		return err
+	}
+	*a = roaASN(n)
+	return nil
+}
+
+// loadFromROAFile adds ROAs in a JSON file specified by --roa-file to the
+// table. The file is rejected if any prefix is malformed, or if it does not
+// match --schema.
+func (rsrc *resource) loadFromROAFile(sn uint32, fileName string) (*resource, error) {
+	rsrc.initTable(sn)
+
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	rawSources.put(fileName, buf)
+	if commandOpts.Schema != "" {
+		// A payload in an unexpected format is rejected as a whole
+		schema, err := loadSchema(commandOpts.Schema)
+		if err != nil {
+			return nil, err
+		}
+		if err := schema.validatePayload(buf); err != nil {
+			return nil, fmt.Errorf("%s: does not match the schema: %v", fileName, err)
+		}
+	}
+	f := &roaFile{}
+	if err := json.Unmarshal(buf, f); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	for i, e := range f.ROAs {
+		ip, n, err := net.ParseCIDR(e.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("%s: ROA #%d: invalid prefix %q", fileName, i+1, e.Prefix)
+		}
+		if !ip.Equal(n.IP) {
+			return nil, fmt.Errorf("%s: ROA #%d: prefix %q has host bits set", fileName, i+1, e.Prefix)
+		}
+		prefixLen, bits := n.Mask.Size()
+		maxLen := e.MaxLength
+		if maxLen == 0 {
+			// maxLength is optional as in ROAs
+			maxLen = prefixLen
+		}
+		if maxLen < prefixLen || maxLen > bits {
+			return nil, fmt.Errorf("%s: ROA #%d: invalid maxLength %d for %v", fileName, i+1, e.MaxLength, e.Prefix)
+		}
+		rsrc, err = rsrc.addValidInfo(sn, fmt.Sprintf("AS%d", e.ASN), e.Prefix, maxLen)
+		if err != nil {
+			return nil, fmt.Errorf("%s: ROA #%d: %v", fileName, i+1, err)
+		}
+	}
+	for i, e := range f.ASPAs {
+		customer := e.Customer
+		if customer == nil {
+			customer = e.CustomerASID
+		}
+		if customer == nil || *customer == 0 {
+			return nil, fmt.Errorf("%s: ASPA #%d: no customer ASN", fileName, i+1)
+		}
+		providers := []uint32{}
+		for _, p := range e.Providers {
+			if p == *customer {
+				return nil, fmt.Errorf("%s: ASPA #%d: AS%d is a provider of itself", fileName, i+1, p)
+			}
+			providers = append(providers, uint32(p))
+		}
+		if len(providers) == 0 {
+			return nil, fmt.Errorf("%s: ASPA #%d: no provider ASN", fileName, i+1)
+		}
+		rsrc.aspaTable(sn).add(uint32(*customer), providers)
+	}
+	return rsrc, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/osrg/gobgp/pkg/packet/bgp"
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadFromROAFile(t *testing.T) {
+	assert := assert.New(t)
+
+	file := createFile("TestLoadFromROAFile", []string{`{"roas":[
+		{"prefix":"10.0.0.0/8","maxLength":24,"asn":"AS65000"},
+		{"prefix":"2001:db8::/32","maxLength":48,"asn":65001},
+		{"prefix":"192.0.2.0/24","asn":"as65002"}
+	]}`})
+	defer removeFile(file)
+	commandOpts.ROAFiles = []string{file}
+	defer func() { commandOpts.ROAFiles = nil }()
+
+	mgr := NewResourceManager(false)
+	assert.Nil(mgr.Load(nil))
+	lists := mgr.CurrentList()
+	v4, v6 := lists[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT], lists[bgp.RF_IPv6_UC][rtr.ANNOUNCEMENT]
+	if assert.Len(v4, 2) && assert.Len(v6, 1) {
+		sortFakeROAs(v4, "prefix")
+		assert.Equal("10.0.0.0", v4[0].Prefix.String())
+		assert.Equal(uint8(24), v4[0].MaxLen)
+		assert.Equal(uint32(65000), v4[0].AS)
+		assert.Equal(uint8(24), v4[1].MaxLen)
+		assert.Equal(uint32(65002), v4[1].AS)
+		assert.Equal(uint8(48), v6[0].MaxLen)
+		assert.Equal(uint32(65001), v6[0].AS)
+	}
+
+	// A reload of the changed file bumps the serial
+	currentSN := mgr.CurrentSerial()
+	ioutil.WriteFile(file, []byte(`{"roas":[{"prefix":"10.0.0.0/8","maxLength":8,"asn":"AS65000"}]}`), 0644)
+	assert.Nil(mgr.Reload())
+	assert.True(serialNewer(mgr.CurrentSerial(), currentSN))
+	assert.Equal(1, countROAs(mgr.CurrentList()))
+
+	// and a broken one keeps the current data
+	currentSN = mgr.CurrentSerial()
+	for _, content := range []string{
+		`{"roas":[{"prefix":"10.0.0.256/24","maxLength":24,"asn":"AS65000"}]}`,
+		`{"roas":[{"prefix":"10.0.0.1/24","maxLength":24,"asn":"AS65000"}]}`,
+		`{"roas":[{"prefix":"10.0.0.0/24","maxLength":16,"asn":"AS65000"}]}`,
+		`{"roas":[{"prefix":"10.0.0.0/24","maxLength":33,"asn":"AS65000"}]}`,
+		`{"roas":[{"prefix":"10.0.0.0/24","maxLength":24,"asn":"ASX"}]}`,
+		`{"roas":[`,
+	} {
+		ioutil.WriteFile(file, []byte(content), 0644)
+		assert.NotNil(mgr.Reload(), content)
+		assert.Equal(currentSN, mgr.CurrentSerial())
+	}
+}
+
+func TestLoadASPAsFromROAFile(t *testing.T) {
+	assert := assert.New(t)
+
+	file := createFile("TestLoadASPAsFromROAFile", []string{`{"roas":[],"aspas":[
+		{"customer":"AS65000","providers":["AS65002","AS65001"]},
+		{"customer_asid":65010,"providers":[65011]},
+		{"customer":"AS65000","providers":["AS65003","AS65001"]}
+	]}`})
+	defer removeFile(file)
+	commandOpts.ROAFiles = []string{file}
+	defer func() { commandOpts.ROAFiles = nil }()
+
+	mgr := NewResourceManager(false)
+	assert.Nil(mgr.Load(nil))
+	// ASPAs of the same customer are merged
+	assert.Equal([]*FakeASPA{
+		{Customer: 65000, Providers: []uint32{65001, 65002, 65003}, Flags: 1},
+		{Customer: 65010, Providers: []uint32{65011}, Flags: 1},
+	}, mgr.CurrentASPAs())
+
+	// A change of ASPAs bumps the serial, and the delta replaces the
+	// providers of a customer
+	oldSN := mgr.CurrentSerial()
+	ioutil.WriteFile(file, []byte(`{"roas":[],"aspas":[{"customer":"AS65000","providers":["AS65001"]}]}`), 0644)
+	assert.Nil(mgr.Reload())
+	assert.True(serialNewer(mgr.CurrentSerial(), oldSN))
+	assert.Equal([]*FakeASPA{
+		{Customer: 65000, Providers: []uint32{65001}, Flags: 1},
+		{Customer: 65010, Flags: 0},
+	}, mgr.DeltaASPAs(oldSN))
+	assert.Equal([]*FakeASPA{}, mgr.DeltaASPAs(mgr.CurrentSerial()))
+
+	currentSN := mgr.CurrentSerial()
+	for _, content := range []string{
+		`{"aspas":[{"providers":["AS65001"]}]}`,
+		`{"aspas":[{"customer":"AS0","providers":["AS65001"]}]}`,
+		`{"aspas":[{"customer":"AS65000","providers":[]}]}`,
+		`{"aspas":[{"customer":"AS65000","providers":["AS65000"]}]}`,
+		`{"aspas":[{"customer":"AS65000","providers":["ASX"]}]}`,
+	} {
+		ioutil.WriteFile(file, []byte(content), 0644)
+		assert.NotNil(mgr.Reload(), content)
+		assert.Equal(currentSN, mgr.CurrentSerial())
+	}
+}
+
+func TestROAFileSchema(t *testing.T) {
+	assert := assert.New(t)
+
+	schema := createFile("TestROAFileSchema", []string{`{
+		"type": "object",
+		"required": ["roas"],
+		"properties": {"roas": {"type": "array", "items": {
+			"type": "object",
+			"required": ["prefix", "maxLength", "asn"],
+			"properties": {
+				"prefix": {"type": "string"},
+				"maxLength": {"type": "integer", "minimum": 0, "maximum": 128},
+				"asn": {"type": ["string", "integer"]}
+			}
+		}}}
+	}`})
+	defer removeFile(schema)
+	file := createFile("TestROAFileSchema", []string{`{"roas":[
+		{"prefix":"10.0.0.0/8","maxLength":24,"asn":"AS65000"}
+	]}`})
+	defer removeFile(file)
+	commandOpts.ROAFiles = []string{file}
+	commandOpts.Schema = schema
+	defer func() { commandOpts.ROAFiles, commandOpts.Schema = nil, "" }()
+
+	mgr := NewResourceManager(false)
+	assert.Nil(mgr.Load(nil))
+	currentSN := mgr.CurrentSerial()
+
+	// Payloads which the loader would take are rejected by the schema, and
+	// the current data is kept
+	for _, content := range []string{
+		`{"roas":[{"prefix":"10.0.0.0/8","maxLength":24}]}`,
+		`{"roas":[{"prefix":"10.0.0.0/8","maxLength":24.5,"asn":"AS65000"}]}`,
+		`{"roas":[{"prefix":"10.0.0.0/8","maxLength":24,"asn":true}]}`,
+		`{"roas":{}}`,
+		`{"aspas":[]}`,
+	} {
+		ioutil.WriteFile(file, []byte(content), 0644)
+		assert.NotNil(mgr.Reload(), content)
+		assert.Equal(currentSN, mgr.CurrentSerial())
+		assert.Equal(1, countROAs(mgr.CurrentList()))
+	}
+
+	ioutil.WriteFile(file, []byte(`{"roas":[{"prefix":"10.0.0.0/8","maxLength":8,"asn":65001}]}`), 0644)
+	assert.Nil(mgr.Reload())
+	assert.NotEqual(currentSN, mgr.CurrentSerial())
+}
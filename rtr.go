@@ -17,114 +17,937 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/osrg/gobgp/pkg/packet/bgp"
 	"github.com/osrg/gobgp/pkg/packet/rtr"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
 )
 
-const rtrProtocolVersion uint8 = 0
-
 type rtrConn struct {
-	conn       *net.TCPConn
+	conn       rtrStream
 	sessionId  uint16
+	serial     uint32
 	remoteAddr net.Addr
+	// inSync is set from a Reset Query PDU being read until the full
+	// synchronization for it is finished.
+	inSync       int32
+	fullSyncOnly bool
+	// pinned is set if the peers file pins the protocol version of the
+	// router to pinnedVersion
+	pinned        bool
+	pinnedVersion uint8
+	// loaded is closed when the first load of --lazy-load finishes, which
+	// the session waits for rather than answering No Data Available, as the
+	// router would wait out its Retry Interval
+	loaded <-chan struct{}
+	// canary is the percentage of ROAs served to the router, or 0 for all
+	canary int
+	// queryTimes holds the times of query PDUs received in the last second.
+	queryTimes []time.Time
+	// onFamilySent hooks the boundary of address families in a response
+	onFamilySent func(rf bgp.RouteFamily)
+	// fullSyncAt is the time when the last full synchronization finished
+	fullSyncAt time.Time
+	// version is the protocol version negotiated by the first PDU
+	version    int32
+	negotiated sync.Once
+	// stats are counters of the session, which can be reset by the admin API
+	stats       sessionStats
+	connectedAt time.Time
+	// stopCh is closed when the server is stopping
+	stopCh <-chan struct{}
+	// clock waits for --family-delay. nil means the real time.
+	clock clock
+	// closing is set by shutdown, so that the idle timeout doesn't extend
+	// the grace period.
+	deadlineMu sync.Mutex
+	closing    bool
+	// logger logs the session at its own level for --debug-ip. nil means
+	// the standard logger.
+	logger *log.Logger
+	// w buffers PDUs written to conn
+	w *bufio.Writer
+	// errorReports counts Error Report PDUs sent without closing the
+	// session, which --max-error-reports limits
+	errorReports int
+}
+
+// writeBufferSize is the size of the buffer of PDUs sent to a router, which
+// holds about 3,000 IPv4 Prefix PDUs.
+const writeBufferSize = 64 * 1024
+
+// writeRetryBackoff is the first wait before retrying a write with
+// --write-retries, which doubles up to maxWriteRetryBackoff.
+const (
+	writeRetryBackoff    = 10 * time.Millisecond
+	maxWriteRetryBackoff = time.Second
+)
+
+func (r *rtrConn) log() *log.Logger {
+	if r.logger == nil {
+		return log.StandardLogger()
+	}
+	return r.logger
+}
+
+// clock abstracts waiting so that tests don't actually sleep.
+type clock interface {
+	Sleep(d time.Duration)
+}
+
+func (r *rtrConn) sleep(d time.Duration) {
+	if r.clock == nil {
+		time.Sleep(d)
+		return
+	}
+	r.clock.Sleep(d)
+}
+
+type sessionStats struct {
+	PDUsSent      int64 `json:"pdus_sent"`
+	BytesSent     int64 `json:"bytes_sent"`
+	PrefixesSent  int64 `json:"prefixes_sent"`
+	ResetQueries  int64 `json:"reset_queries"`
+	SerialQueries int64 `json:"serial_queries"`
+	// LastSerial is the serial last sent by End of Data PDU, which is kept
+	// by resetStats
+	LastSerial uint32 `json:"last_serial"`
+	// Duration is how long the session has been connected
+	Duration string `json:"duration,omitempty"`
+}
+
+func (r *rtrConn) loadStats() *sessionStats {
+	s := &sessionStats{
+		PDUsSent:      atomic.LoadInt64(&r.stats.PDUsSent),
+		BytesSent:     atomic.LoadInt64(&r.stats.BytesSent),
+		PrefixesSent:  atomic.LoadInt64(&r.stats.PrefixesSent),
+		ResetQueries:  atomic.LoadInt64(&r.stats.ResetQueries),
+		SerialQueries: atomic.LoadInt64(&r.stats.SerialQueries),
+		LastSerial:    atomic.LoadUint32(&r.stats.LastSerial),
+	}
+	if !r.connectedAt.IsZero() {
+		s.Duration = time.Since(r.connectedAt).Round(time.Second).String()
+	}
+	return s
+}
+
+func (r *rtrConn) resetStats() {
+	atomic.StoreInt64(&r.stats.PDUsSent, 0)
+	atomic.StoreInt64(&r.stats.BytesSent, 0)
+	atomic.StoreInt64(&r.stats.PrefixesSent, 0)
+	atomic.StoreInt64(&r.stats.ResetQueries, 0)
+	atomic.StoreInt64(&r.stats.SerialQueries, 0)
 }
 
 type rtrServer struct {
 	connCh     chan *rtrConn
+	listenHost string
 	listenPort int
+	networks   []string
+	sessionId  uint16
+	// promoteCh is closed to start accepting connections in standby mode
+	promoteCh chan struct{}
+	promoted  sync.Once
+	// stopCh is closed by Stop to close the listeners and all sessions
+	stopCh    chan struct{}
+	stopped   sync.Once
+	mu        sync.Mutex
+	listeners []net.Listener
+	// conns counts sessions being handled
+	conns sync.WaitGroup
+	// active is the number of sessions accepted and not finished yet, which
+	// is limited by --max-sessions
+	active int32
+	// allowlist is the prefixes of routers allowed to connect, or nil to
+	// allow all
+	allowlist []*net.IPNet
+	// tlsConfig serves RTR over TLS unless nil
+	tlsConfig *tls.Config
+	// sshConfig serves RTR over SSH on sshPort unless nil
+	sshConfig *ssh.ServerConfig
+	sshPort   int
 }
 
 func newRTRServer(port int) *rtrServer {
 	s := &rtrServer{
 		connCh:     make(chan *rtrConn, 1),
 		listenPort: port,
+		networks:   []string{"tcp"},
+		// Session ID is per cache instance, and changes on every restart
+		// unless restored by --checkpoint
+		sessionId: uint16(rand.Intn(math.MaxUint16 + 1)),
+		promoteCh: make(chan struct{}),
+		stopCh:    make(chan struct{}),
 	}
 	return s
 }
 
+// handle handles the session in a goroutine, which Stop waits for.
+func (s *rtrServer) handle(c *rtrConn, mgr *ResourceManager) {
+	s.conns.Add(1)
+	go func() {
+		defer s.conns.Done()
+		defer s.release()
+		if c.loaded != nil {
+			select {
+			case <-c.loaded:
+			case <-c.stopCh:
+				c.conn.Close()
+				return
+			}
+		}
+		if !c.handshake() {
+			return
+		}
+		handleRTR(c, mgr)
+	}()
+}
+
+// acquire counts a new session, and returns false if --max-sessions
+// sessions are already open.
+func (s *rtrServer) acquire(remoteAddr net.Addr) bool {
+	for {
+		n := atomic.LoadInt32(&s.active)
+		if max := commandOpts.MaxSessions; max > 0 && int(n) >= max {
+			sessionsRejected.Add(1)
+			log.Warnf("Rejected the connection from %v, %d sessions are open (--max-sessions)", remoteAddr, n)
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&s.active, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (s *rtrServer) release() {
+	atomic.AddInt32(&s.active, -1)
+}
+
+// Stop closes the listeners and tells all sessions to close, and waits for
+// them up to the timeout. It returns false if some sessions are still open.
+func (s *rtrServer) Stop(timeout time.Duration) bool {
+	s.stopped.Do(func() {
+		close(s.stopCh)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, l := range s.listeners {
+			l.Close()
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// promote makes the server in standby mode start accepting connections.
+func (s *rtrServer) promote() {
+	s.promoted.Do(func() {
+		close(s.promoteCh)
+	})
+}
+
 func (s *rtrServer) run() {
-	service := ":" + strconv.Itoa(s.listenPort)
-	addr, _ := net.ResolveTCPAddr("tcp", service)
+	if commandOpts.Standby {
+		// Data is loaded and kept up to date, but routers can't connect
+		log.Infof("Standing by until promoted")
+		select {
+		case <-s.promoteCh:
+		case <-s.stopCh:
+			return
+		}
+		log.Infof("Promoted, accepting connections on port %v", s.listenPort)
+	}
+	// An empty host listens on all addresses
+	service := net.JoinHostPort(s.listenHost, strconv.Itoa(s.listenPort))
+
+	listeners := []net.Listener{}
+	for _, network := range listenNetworks(s.listenHost, s.networks) {
+		addr, err := net.ResolveTCPAddr(network, service)
+		checkError(err)
+		l, err := net.ListenTCP(network, addr)
+		checkError(err)
+		listeners = append(listeners, l)
+	}
+	// Stop closes the SSH listener as well
+	all := listeners
+	var sshListener net.Listener
+	if s.sshConfig != nil {
+		addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(s.listenHost, strconv.Itoa(s.sshPort)))
+		checkError(err)
+		l, err := net.ListenTCP("tcp", addr)
+		checkError(err)
+		sshListener = l
+		all = append(all, l)
+	}
+	s.mu.Lock()
+	s.listeners = all
+	s.mu.Unlock()
+	select {
+	case <-s.stopCh:
+		// Stopped while opening the listeners
+		for _, l := range all {
+			l.Close()
+		}
+		return
+	default:
+	}
+
+	if sshListener != nil {
+		go s.serveSSH(sshListener)
+	}
+	for _, l := range listeners[1:] {
+		go s.serve(l)
+	}
+	s.serve(listeners[0])
+}
 
-	l, err := net.ListenTCP("tcp", addr)
-	checkError(err)
+// listenNetworks returns the networks to listen on for host. An IP address
+// is in one family, so --split-listeners listens only on the network of it.
+func listenNetworks(host string, networks []string) []string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return networks
+	}
+	matched := []string{}
+	for _, network := range networks {
+		switch {
+		case network == "tcp4" && ip.To4() == nil, network == "tcp6" && ip.To4() != nil:
+			log.Infof("Not listening on %v, which doesn't match the address %v", network, host)
+		default:
+			matched = append(matched, network)
+		}
+	}
+	return matched
+}
 
-	for i := 0; ; {
-		conn, err := l.AcceptTCP()
+func (s *rtrServer) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
 		if err != nil {
+			select {
+			case <-s.stopCh:
+				return
+			default:
+			}
 			continue
 		}
-		i++
+		if !s.allowed(conn.RemoteAddr()) || !s.acquire(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		tuneConn(conn)
+		stream := newRTRStream(conn)
+		if s.tlsConfig != nil {
+			stream = tls.Server(conn, s.tlsConfig)
+		}
 		c := &rtrConn{
-			conn:       conn,
-			sessionId:  uint16(i),
+			conn:       stream,
+			sessionId:  s.sessionId,
 			remoteAddr: conn.RemoteAddr(),
+			stopCh:     s.stopCh,
 		}
 		s.connCh <- c
 	}
 }
 
+// parseAllowlist parses CIDRs of --allow-from.
+func parseAllowlist(cidrs []string) ([]*net.IPNet, error) {
+	var allowlist []*net.IPNet
+	for _, c := range cidrs {
+		_, prefix, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --allow-from %q: %v", c, err)
+		}
+		allowlist = append(allowlist, prefix)
+	}
+	return allowlist, nil
+}
+
+// allowed returns whether the router is allowed to connect by --allow-from.
+func (s *rtrServer) allowed(remoteAddr net.Addr) bool {
+	if len(s.allowlist) == 0 {
+		return true
+	}
+	if ip := addrIP(remoteAddr); ip != nil {
+		for _, prefix := range s.allowlist {
+			if prefix.Contains(ip) {
+				return true
+			}
+		}
+	}
+	log.Warnf("Rejected the connection from %v, which is not in --allow-from", remoteAddr)
+	return false
+}
+
+// tuneConn applies the TCP options to an accepted connection. Other kinds of
+// connections, eg. over a Unix domain socket, are left as they are.
+func tuneConn(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		log.Debugf("Skipped TCP options for %v, which is not a TCP connection (%T)", conn.RemoteAddr(), conn)
+		return
+	}
+	setSocketBuffers(tcpConn)
+}
+
+type socketBuffers interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// setSocketBuffers sets the socket buffer sizes specified by --so-rcvbuf and
+// --so-sndbuf, for full synchronizations over a long fat network.
+func setSocketBuffers(conn socketBuffers) {
+	if n := commandOpts.SoRcvbuf; n > 0 {
+		if err := conn.SetReadBuffer(n); err != nil {
+			log.Warnf("Could not set the receive buffer size to %d: %v", n, err)
+		}
+	}
+	if n := commandOpts.SoSndbuf; n > 0 {
+		if err := conn.SetWriteBuffer(n); err != nil {
+			log.Warnf("Could not set the send buffer size to %d: %v", n, err)
+		}
+	}
+}
+
+// sendPDU sends a PDU at once.
 func (r *rtrConn) sendPDU(msg rtr.RTRMessage) error {
+	if err := r.bufferPDU(msg); err != nil {
+		return err
+	}
+	return r.writer().Flush()
+}
+
+// bufferPDU writes a PDU into the buffer of the connection, so that Prefix
+// PDUs of a response are sent by a few large writes rather than a syscall
+// each. The buffer is sent when it is full or flushed.
+func (r *rtrConn) bufferPDU(msg rtr.RTRMessage) error {
 	pdu, _ := msg.Serialize()
-	_, err := r.conn.Write(pdu)
+	// gobgp builds PDUs of version 0
+	if v := r.peerVersion(); v != 0 {
+		pdu[0] = v
+	}
+	_, err := r.writer().Write(pdu)
 	if err != nil {
 		return err
 	}
+	r.log().Tracef("Sent %d byte(s) to %v: %x", len(pdu), r.remoteAddr, pdu)
+	pdusSent.Add(1)
+	atomic.AddInt64(&r.stats.PDUsSent, 1)
+	atomic.AddInt64(&r.stats.BytesSent, int64(len(pdu)))
+	return nil
+}
+
+func (r *rtrConn) writer() *bufio.Writer {
+	if r.w == nil {
+		var w io.Writer = r.conn
+		if commandOpts.WriteRetries > 0 {
+			w = &retryWriter{r: r}
+		}
+		r.w = bufio.NewWriterSize(w, writeBufferSize)
+	}
+	return r.w
+}
+
+// retryWriter writes to the connection, and retries a write failed by a
+// temporary network error, eg. under brief congestion, instead of breaking
+// the session. bufio.Writer never writes again after an error, so the
+// retries must be under it.
+type retryWriter struct {
+	r *rtrConn
+}
+
+func (w *retryWriter) Write(p []byte) (int, error) {
+	written := 0
+	backoff := writeRetryBackoff
+	for retries := 0; ; retries++ {
+		n, err := w.r.conn.Write(p[written:])
+		written += n
+		if err == nil {
+			return written, nil
+		}
+		if e, ok := err.(net.Error); !ok || !(e.Temporary() || e.Timeout()) || retries >= commandOpts.WriteRetries {
+			return written, err
+		}
+		w.r.log().Warnf("Write to %v failed temporarily, retrying in %v (ID: %v): %v", w.r.remoteAddr, backoff, w.r.sessionId, err)
+		writeRetries.Add(1)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxWriteRetryBackoff {
+			backoff = maxWriteRetryBackoff
+		}
+	}
+}
+
+// negotiate records the protocol version of the first PDU from the router,
+// and returns false if the version is out of --min-version and --max-version
+// or differs from the negotiated one.
+func (r *rtrConn) negotiate(version uint8) bool {
+	// A pinned version overrides what the router sends
+	if r.pinned && version != r.pinnedVersion {
+		r.negotiated.Do(func() {
+			atomic.StoreInt32(&r.version, int32(r.pinnedVersion))
+			r.log().Infof("Pinned protocol version %v for %v, which sent version %v", r.pinnedVersion, r.remoteAddr, version)
+		})
+		return false
+	}
+	if int(version) > commandOpts.MaxVersion || int(version) < commandOpts.MinVersion {
+		// Error Report PDU to the first PDU tells the version we serve
+		r.negotiated.Do(func() {
+			atomic.StoreInt32(&r.version, int32(commandOpts.MaxVersion))
+		})
+		return false
+	}
+	r.negotiated.Do(func() {
+		atomic.StoreInt32(&r.version, int32(version))
+		r.log().Infof("Negotiated protocol version %v with %v", version, r.remoteAddr)
+	})
+	return r.peerVersion() == version
+}
+
+func (r *rtrConn) peerVersion() uint8 {
+	return uint8(atomic.LoadInt32(&r.version))
+}
+
+// rtrEndOfDataV1 is End of Data PDU of version 1 defined in RFC 8210, which
+// gobgp doesn't support.
+type rtrEndOfDataV1 struct {
+	SessionID       uint16
+	SerialNumber    uint32
+	RefreshInterval uint32
+	RetryInterval   uint32
+	ExpireInterval  uint32
+}
+
+const rtrEndOfDataV1Len = 24
+
+func (m *rtrEndOfDataV1) DecodeFromBytes(data []byte) error {
+	if len(data) < rtrEndOfDataV1Len {
+		return fmt.Errorf("End of Data PDU of version 1 is too short (%d bytes)", len(data))
+	}
+	m.SessionID = binary.BigEndian.Uint16(data[2:4])
+	m.SerialNumber = binary.BigEndian.Uint32(data[8:12])
+	m.RefreshInterval = binary.BigEndian.Uint32(data[12:16])
+	m.RetryInterval = binary.BigEndian.Uint32(data[16:20])
+	m.ExpireInterval = binary.BigEndian.Uint32(data[20:24])
+	return nil
+}
+
+func (m *rtrEndOfDataV1) Serialize() ([]byte, error) {
+	data := make([]byte, rtrEndOfDataV1Len)
+	data[0] = 1
+	data[1] = rtr.RTR_END_OF_DATA
+	binary.BigEndian.PutUint16(data[2:4], m.SessionID)
+	binary.BigEndian.PutUint32(data[4:8], rtrEndOfDataV1Len)
+	binary.BigEndian.PutUint32(data[8:12], m.SerialNumber)
+	binary.BigEndian.PutUint32(data[12:16], m.RefreshInterval)
+	binary.BigEndian.PutUint32(data[16:20], m.RetryInterval)
+	binary.BigEndian.PutUint32(data[20:24], m.ExpireInterval)
+	return data, nil
+}
+
+// endOfData returns End of Data PDU of the negotiated version.
+func (r *rtrConn) endOfData(currentSN uint32) rtr.RTRMessage {
+	if r.peerVersion() == 0 {
+		return rtr.NewRTREndOfData(r.sessionId, currentSN)
+	}
+	return &rtrEndOfDataV1{
+		SessionID:       r.sessionId,
+		SerialNumber:    currentSN,
+		RefreshInterval: uint32(commandOpts.Refresh),
+		RetryInterval:   uint32(retryInterval()),
+		ExpireInterval:  uint32(commandOpts.Expire),
+	}
+}
+
+// retryOverride is the Retry Interval set by the admin API in place of
+// --retry-interval, or 0 for none. Raising it makes routers back off while
+// the cache is under stress.
+var retryOverride int32
+
+// retryInterval returns the Retry Interval to send to routers of version 1.
+func retryInterval() int {
+	if v := atomic.LoadInt32(&retryOverride); v > 0 {
+		return int(v)
+	}
+	return commandOpts.Retry
+}
+
+// checkTimers validates the timing parameters sent in End of Data PDU of
+// version 1, and warns about values out of the ranges in RFC 8210.
+func checkTimers(refresh, retry, expire int) error {
+	if expire <= refresh || expire <= retry {
+		return errors.New("expire interval must be longer than refresh and retry intervals")
+	}
+	for _, t := range []struct {
+		name          string
+		value, lo, hi int
+	}{
+		{"Refresh", refresh, 1, 86400},
+		{"Retry", retry, 1, 7200},
+		{"Expire", expire, 600, 172800},
+	} {
+		if t.value < t.lo || t.value > t.hi {
+			log.Warnf("%s interval %d is out of the range recommended by RFC 8210 (%d-%d)", t.name, t.value, t.lo, t.hi)
+		}
+	}
 	return nil
 }
 
-func (r *rtrConn) cacheResponse(currentSN uint32, lists FakeROATable) error {
+// pacer paces sending PDUs at the rate per second. nil pacer doesn't wait.
+type pacer struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newPacer(rate int) *pacer {
+	if rate <= 0 {
+		return nil
+	}
+	return &pacer{interval: time.Second / time.Duration(rate)}
+}
+
+func (p *pacer) wait() {
+	if p == nil {
+		return
+	}
+	now := time.Now()
+	if p.next.After(now) {
+		time.Sleep(p.next.Sub(now))
+		now = p.next
+	}
+	p.next = now.Add(p.interval)
+}
+
+// cacheResponse sends lists and aspas between Cache Response and End of Data
+// PDUs. Prefix PDUs are paced at rate per second unless rate is 0.
+func (r *rtrConn) cacheResponse(currentSN uint32, lists FakeROATable, aspas []*FakeASPA, rate int) error {
+	flags := []uint8{rtr.ANNOUNCEMENT, rtr.WITHDRAWAL}
+	if commandOpts.ReaddChanged {
+		flags = []uint8{rtr.WITHDRAWAL, rtr.ANNOUNCEMENT}
+	}
+	p := newPacer(rate)
+	return r.respond(currentSN, func(rf bgp.RouteFamily) error {
+		return r.sendFamily(rf, lists[rf], flags, p)
+	}, aspas)
+}
+
+// cachedResponse answers Reset Query with Prefix PDUs serialized in advance
+// by --cache-full-sync.
+func (r *rtrConn) cachedResponse(s *fullSyncStream, aspas []*FakeASPA) error {
+	return r.respond(s.sn, func(rf bgp.RouteFamily) error {
+		return r.writeFamily(rf, s)
+	}, aspas)
+}
+
+// respond sends Cache Response PDU, Prefix PDUs of each address family by
+// sendFamily, ASPA PDUs if the router supports them, and End of Data PDU.
+func (r *rtrConn) respond(currentSN uint32, sendFamily func(bgp.RouteFamily) error, aspas []*FakeASPA) error {
 	if err := r.sendPDU(rtr.NewRTRCacheResponse(r.sessionId)); err != nil {
 		return err
 	}
-	log.Infof("Sent Cache Response PDU to %v (ID: %v)", r.remoteAddr, r.sessionId)
+	r.log().Infof("Sent Cache Response PDU to %v (ID: %v)", r.remoteAddr, r.sessionId)
 
 	for _, rf := range []bgp.RouteFamily{bgp.RF_IPv4_UC, bgp.RF_IPv6_UC} {
-		for _, flag := range []uint8{rtr.ANNOUNCEMENT, rtr.WITHDRAWAL} {
-			for _, v := range lists[rf][flag] {
-				if err := r.sendPDU(rtr.NewRTRIPPrefix(v.Prefix, v.PrefixLen, v.MaxLen, v.AS, flag)); err != nil {
-					return err
-				}
-				log.Debugf("Sent %s Prefix PDU to %v (Prefix: %v/%v, Maxlen: %v, AS: %v, flags: %v)", RFToIPVer(rf), r.remoteAddr, v.Prefix, v.PrefixLen, v.MaxLen, v.AS, flag)
-			}
-			prefixes := len(lists[rf][flag])
-			if !commandOpts.Debug && prefixes != 0 {
-				log.Infof("Sent %s Prefix PDU(s) to %v (%d ROA(s), flags: %v)", RFToIPVer(rf), r.remoteAddr, prefixes, flag)
-			}
+		if err := sendFamily(rf); err != nil {
+			return err
+		}
+		if err := r.writer().Flush(); err != nil {
+			return err
+		}
+		r.familySent(rf)
+		if rf == bgp.RF_IPv4_UC && commandOpts.FamilyDelay > 0 {
+			r.log().Infof("Waiting %v before sending IPv6 Prefix PDUs to %v", commandOpts.FamilyDelay, r.remoteAddr)
+			r.sleep(commandOpts.FamilyDelay)
+		}
+	}
+	if r.supportsASPA() {
+		if err := r.sendASPAs(aspas); err != nil {
+			return err
 		}
 	}
 
-	if err := r.sendPDU(rtr.NewRTREndOfData(r.sessionId, currentSN)); err != nil {
+	// The router may send the next Reset Query as soon as it receives End of Data
+	atomic.StoreInt32(&r.inSync, 0)
+	if err := r.sendPDU(r.endOfData(currentSN)); err != nil {
 		return err
 	}
-	log.Infof("Sent End of Data PDU to %v (ID: %v, SN: %v)", r.remoteAddr, r.sessionId, currentSN)
+	r.serial = currentSN
+	atomic.StoreUint32(&r.stats.LastSerial, currentSN)
+	r.log().Infof("Sent End of Data PDU to %v (ID: %v, SN: %v)", r.remoteAddr, r.sessionId, currentSN)
+
+	return nil
+}
+
+// sendFamily sends Prefix PDUs of an address family as a phase of the
+// response.
+func (r *rtrConn) sendFamily(rf bgp.RouteFamily, list map[uint8][]*FakeROA, flags []uint8, p *pacer) error {
+	// PDUs paced by a rate are sent one by one
+	send := r.bufferPDU
+	if p != nil {
+		send = r.sendPDU
+	}
+	for _, flag := range flags {
+		for _, v := range list[flag] {
+			p.wait()
+			if err := send(rtr.NewRTRIPPrefix(v.Prefix, v.PrefixLen, v.MaxLen, v.AS, flag)); err != nil {
+				return err
+			}
+			atomic.AddInt64(&r.stats.PrefixesSent, 1)
+			r.log().Debugf("Sent %s Prefix PDU to %v (Prefix: %v/%v, Maxlen: %v, AS: %v, flags: %v)", RFToIPVer(rf), r.remoteAddr, v.Prefix, v.PrefixLen, v.MaxLen, v.AS, flag)
+		}
+		prefixes := len(list[flag])
+		if !commandOpts.Debug && prefixes != 0 {
+			r.log().Infof("Sent %s Prefix PDU(s) to %v (%d ROA(s), flags: %v)", RFToIPVer(rf), r.remoteAddr, prefixes, flag)
+		}
+	}
+	return nil
+}
 
+// writeFamily writes Prefix PDUs of an address family serialized in advance
+// at once.
+func (r *rtrConn) writeFamily(rf bgp.RouteFamily, s *fullSyncStream) error {
+	if _, err := r.writer().Write(s.families[rf]); err != nil {
+		return err
+	}
+	n := s.counts[rf]
+	pdusSent.Add(int64(n))
+	atomic.AddInt64(&r.stats.PDUsSent, int64(n))
+	atomic.AddInt64(&r.stats.PrefixesSent, int64(n))
+	atomic.AddInt64(&r.stats.BytesSent, int64(len(s.families[rf])))
+	if n != 0 {
+		r.log().Infof("Sent %s Prefix PDU(s) to %v (%d ROA(s), flags: %v)", RFToIPVer(rf), r.remoteAddr, n, rtr.ANNOUNCEMENT)
+	}
 	return nil
 }
 
+// familySent is called at the boundary of address families in a response.
+// RTR has no End of Data per family, so the boundary is only logged with
+// --family-marker rather than sent to the router.
+func (r *rtrConn) familySent(rf bgp.RouteFamily) {
+	if commandOpts.FamilyMarker {
+		r.log().Infof("Finished sending %s Prefix PDUs to %v (ID: %v)", RFToIPVer(rf), r.remoteAddr, r.sessionId)
+	}
+	if r.onFamilySent != nil {
+		r.onFamilySent(rf)
+	}
+}
+
+// logEmptyFamilies logs address families without any ROA in a full
+// synchronization, since some routers take it as the family unsupported.
+func (r *rtrConn) logEmptyFamilies(count func(bgp.RouteFamily) int) {
+	for _, rf := range []bgp.RouteFamily{bgp.RF_IPv4_UC, bgp.RF_IPv6_UC} {
+		if count(rf) == 0 {
+			r.log().Infof("Sending 0 %s ROA(s) to %v, the dataset has no %s ROA", RFToIPVer(rf), r.remoteAddr, RFToIPVer(rf))
+		}
+	}
+}
+
 func (r *rtrConn) noIncrementalUpdateAvailable() error {
 	if err := r.sendPDU(rtr.NewRTRCacheReset()); err != nil {
 		return err
 	}
-	log.Infof("Sent Cache Reset PDU to %v", r.remoteAddr)
+	r.log().Infof("Sent Cache Reset PDU to %v", r.remoteAddr)
 
 	return nil
 }
 
+// errorReport returns an Error Report PDU with the text configured by
+// --error-text. {session}, {serial} and {code} in the text are replaced with
+// the session ID, the serial number last sent to the router and the error code.
+func (r *rtrConn) errorReport(code uint16, pdu []byte) *rtr.RTRErrorReport {
+	var text []byte
+	if commandOpts.ErrorText != "" {
+		text = []byte(strings.NewReplacer(
+			"{session}", fmt.Sprint(r.sessionId),
+			"{serial}", fmt.Sprint(r.serial),
+			"{code}", fmt.Sprint(code),
+		).Replace(commandOpts.ErrorText))
+	}
+	return rtr.NewRTRErrorReport(code, pdu, text)
+}
+
+// closingReport returns an Error Report PDU to close the session. With
+// --final-serial, the text tells the serial number last sent to the router,
+// so that the router logs where it left off.
+func (r *rtrConn) closingReport(code uint16, pdu []byte) *rtr.RTRErrorReport {
+	report := r.errorReport(code, pdu)
+	if !commandOpts.FinalSerial {
+		return report
+	}
+	text := fmt.Sprintf("Closing the session at SN %d", r.serial)
+	if len(report.Text) > 0 {
+		text = string(report.Text) + ": " + text
+	}
+	return rtr.NewRTRErrorReport(code, pdu, []byte(text))
+}
+
+// tableEmptied tells the router that the table has become empty by Cache
+// Reset or No Data Available PDU as specified by --on-empty, so that the
+// router drops all ROAs at once instead of processing a huge withdrawal.
+func (r *rtrConn) tableEmptied() error {
+	r.log().Infof("The table has become empty, telling it to %v by %q", r.remoteAddr, commandOpts.OnEmpty)
+	if commandOpts.OnEmpty == "cache-reset" {
+		return r.noIncrementalUpdateAvailable()
+	}
+	return r.cacheHasNoDataAvailable()
+}
+
+// errTooManyReports is returned instead of sending an Error Report PDU
+// beyond --max-error-reports.
+var errTooManyReports = errors.New("too many Error Report PDUs")
+
+// reportsExhausted returns true once the session has sent as many Error
+// Report PDUs as --max-error-reports without closing. A broken router
+// repeating a query the cache can't answer would otherwise get a report for
+// each, amplifying its traffic.
+func (r *rtrConn) reportsExhausted() bool {
+	return commandOpts.MaxErrReports > 0 && r.errorReports >= commandOpts.MaxErrReports
+}
+
 func (r *rtrConn) cacheHasNoDataAvailable() error {
-	if err := r.sendPDU(rtr.NewRTRErrorReport(rtr.NO_DATA_AVAILABLE, nil, nil)); err != nil {
+	if r.reportsExhausted() {
+		r.log().Warnf("Closing the session to %v, which has got %d Error Report PDU(s) (ID: %v)", r.remoteAddr, r.errorReports, r.sessionId)
+		return errTooManyReports
+	}
+	r.errorReports++
+	if err := r.sendPDU(r.errorReport(rtr.NO_DATA_AVAILABLE, nil)); err != nil {
 		return err
 	}
-	log.Infof("Sent Error Report PDU to %v (ID: %v, ErrorCode: %v)", r.remoteAddr, r.sessionId, rtr.NO_DATA_AVAILABLE)
+	r.log().Infof("Sent Error Report PDU to %v (ID: %v, ErrorCode: %v)", r.remoteAddr, r.sessionId, rtr.NO_DATA_AVAILABLE)
 
 	return nil
 }
 
+// overQueryRate records a query PDU, and returns true if the router has sent
+// more query PDUs than --max-query-rate in the last second.
+func (r *rtrConn) overQueryRate(m rtr.RTRMessage, now time.Time) bool {
+	if commandOpts.MaxQueryRate <= 0 {
+		return false
+	}
+	switch m.(type) {
+	case *rtr.RTRSerialQuery, *rtr.RTRResetQuery:
+	default:
+		return false
+	}
+	r.queryTimes = append(r.queryTimes, now)
+	i := 0
+	for i < len(r.queryTimes) && now.Sub(r.queryTimes[i]) >= time.Second {
+		i++
+	}
+	r.queryTimes = r.queryTimes[i:]
+	return len(r.queryTimes) > commandOpts.MaxQueryRate
+}
+
+// sample returns the part of lists served to a canary router, or lists as is
+// for the others. The MaxLens are fuzzed with --fuzz-maxlen.
+func (r *rtrConn) sample(lists FakeROATable) FakeROATable {
+	if r.canary > 0 && r.canary < 100 {
+		lists = sampleROAs(lists, r.canary)
+	}
+	if commandOpts.FuzzMaxLen != 0 {
+		lists = fuzzMaxLens(lists, commandOpts.FuzzMaxLen)
+	}
+	return lists
+}
+
+// sampleDelta returns the delta from peerSN as sample does for the tables at
+// both serials. A fuzzed delta is the difference of the fuzzed tables, since
+// the fuzzed ROAs don't change one for one with the original ones.
+func (r *rtrConn) sampleDelta(trans *ResourceManager, peerSN uint32) FakeROATable {
+	delta := trans.DeltaList(peerSN)
+	if commandOpts.FuzzMaxLen == 0 {
+		return r.sample(delta)
+	}
+	current := trans.CurrentList()
+	if r.canary > 0 && r.canary < 100 {
+		current, delta = sampleROAs(current, r.canary), sampleROAs(delta, r.canary)
+	}
+	return fuzzDelta(current, delta, commandOpts.FuzzMaxLen)
+}
+
+// repeatedReset returns the current serial and true if a Reset Query comes
+// within --repeat-reset-window after the last full synchronization, and the
+// router already has the data of the current serial. The serial is asked only
+// within the window, as the manager may be in a long transaction.
+func (r *rtrConn) repeatedReset(mgr *ResourceManager, now time.Time) (uint32, bool) {
+	w := commandOpts.RepeatReset
+	if w <= 0 || r.fullSyncAt.IsZero() || now.Sub(r.fullSyncAt) >= w {
+		return 0, false
+	}
+	currentSN := mgr.CurrentSerial()
+	return currentSN, r.serial == currentSN
+}
+
+func (r *rtrConn) injectError(msg rtr.RTRMessage) bool {
+	if r.reportsExhausted() {
+		return false
+	}
+	code, ok := injector.take()
+	if !ok {
+		return false
+	}
+	r.errorReports++
+	pdu, _ := msg.Serialize()
+	r.sendPDU(r.errorReport(code, pdu))
+	r.log().Infof("Sent injected Error Report PDU to %v (ID: %v, ErrorCode: %v)", r.remoteAddr, r.sessionId, code)
+
+	return true
+}
+
+type errorInjector struct {
+	mu    sync.Mutex
+	code  uint16
+	count int
+}
+
+var injector = &errorInjector{}
+
+func (i *errorInjector) set(code uint16, count int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.code = code
+	i.count = count
+}
+
+func (i *errorInjector) status() (uint16, int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.code, i.count
+}
+
+func (i *errorInjector) take() (uint16, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.count <= 0 {
+		return 0, false
+	}
+	i.count--
+	return i.code, true
+}
+
 func RFToIPVer(rf bgp.RouteFamily) string {
 	switch rf {
 	case bgp.RF_IPv4_UC:
@@ -139,59 +962,297 @@ func RFToIPVer(rf bgp.RouteFamily) string {
 type errMsg struct {
 	code uint16
 	data []byte
+	// silent closes the session without Error Report PDU
+	silent bool
 }
 
 type resourceResponse struct {
 	sn   uint32
 	list FakeROATable
+	// emptied is set if the table has become empty, and --on-empty asks to
+	// tell it other than by a delta.
+	emptied bool
+	// noData is set if no data has been loaded yet
+	noData bool
+	// stream is set instead of list with --cache-full-sync
+	stream *fullSyncStream
+	// aspas is sent to routers supporting ASPA after the list
+	aspas []*FakeASPA
+}
+
+// shutdown closes the sending side of the connection, and gives the router
+// a grace period to close its side. Closing the socket right after an Error
+// Report PDU may discard the PDU by a TCP RST if the router has sent more.
+func (r *rtrConn) shutdown() {
+	r.deadlineMu.Lock()
+	defer r.deadlineMu.Unlock()
+	r.closing = true
+	r.conn.CloseWrite()
+	r.conn.SetReadDeadline(time.Now().Add(commandOpts.CloseGrace))
+}
+
+// idleTimeout returns how long to wait for the next PDU from the router, or
+// 0 for no timeout. A router of version 1 drops the data after the Expire
+// Interval without a successful query, so it is idle for good by then.
+func (r *rtrConn) idleTimeout() time.Duration {
+	if commandOpts.IdleTimeout > 0 {
+		return commandOpts.IdleTimeout
+	}
+	if r.peerVersion() >= 1 {
+		return time.Duration(commandOpts.Expire) * time.Second
+	}
+	return 0
+}
+
+// refreshDeadline extends the read deadline by the idle timeout, unless the
+// session is closing.
+func (r *rtrConn) refreshDeadline() {
+	r.deadlineMu.Lock()
+	defer r.deadlineMu.Unlock()
+	if d := r.idleTimeout(); d > 0 && !r.closing {
+		r.conn.SetReadDeadline(time.Now().Add(d))
+	}
+}
+
+// isClosing returns true once shutdown has been called.
+func (r *rtrConn) isClosing() bool {
+	r.deadlineMu.Lock()
+	defer r.deadlineMu.Unlock()
+	return r.closing
+}
+
+// latestProtocolVersion is the highest RTR version defined so far, by the
+// successor of RFC 8210.
+const latestProtocolVersion = 2
+
+// plausibleVersion returns false if the version byte is out of any version
+// an RTR router may send, up to --future-versions beyond the latest one.
+func plausibleVersion(version uint8) bool {
+	return int(version) <= latestProtocolVersion+commandOpts.FutureVers
+}
+
+// parsePDU parses a PDU from the router, or returns the error to report.
+func (r *rtrConn) parsePDU(buf []byte) (rtr.RTRMessage, *errMsg) {
+	// SplitRTR shouldn't return a PDU shorter than the header, but don't
+	// trust it on a half-closed connection. Such a PDU can't be encapsulated
+	// in Error Report PDU, which looks at the type.
+	if len(buf) < 2 {
+		return nil, &errMsg{code: rtr.CORRUPT_DATA}
+	}
+	// A garbage version byte isn't worth Error Report PDU, the peer is not
+	// an RTR router or has lost the framing
+	if !plausibleVersion(buf[0]) {
+		r.log().Warnf("Closing the connection from %v, which sent a PDU not looking like RTR (ID: %v, Version: 0x%02x)", r.remoteAddr, r.sessionId, buf[0])
+		return nil, &errMsg{silent: true}
+	}
+	if !r.negotiate(buf[0]) {
+		return nil, &errMsg{code: rtr.UNSUPPORTED_PROTOCOL_VERSION, data: append([]byte{}, buf...)}
+	}
+	m, err := rtr.ParseRTR(buf)
+	if err != nil {
+		return nil, &errMsg{code: rtr.INVALID_REQUEST, data: append([]byte{}, buf...)}
+	}
+	return m, nil
+}
+
+// Causes of the end of a session, which label sessions_closed
+const (
+	causeClientClose   = "client-close"
+	causeIdleTimeout   = "idle-timeout"
+	causeReadError     = "read-error"
+	causeWriteError    = "write-error"
+	causeRateLimit     = "rate-limit"
+	causeShutdown      = "shutdown"
+	causeProtocolError = "protocol-error"
+	causeInternalError = "internal-error"
+)
+
+// ended logs and counts the cause of the end of the session.
+func (r *rtrConn) ended(cause string) {
+	sessionsClosed.Add(cause, 1)
+	s := r.loadStats()
+	r.log().Infof("Session with %v ended (ID: %v, Cause: %v, Duration: %v, Queries: %d reset / %d serial, Prefix PDUs: %d, Last SN: %v)", r.remoteAddr, r.sessionId, cause, s.Duration, s.ResetQueries, s.SerialQueries, s.PrefixesSent, s.LastSerial)
+}
+
+// failed closes the session whose response has failed by err, and returns
+// the cause. Error Report PDU is sent only for an internal error, as it can't
+// reach the router over a broken connection, and the router that has had
+// --max-error-reports needs no more.
+func (r *rtrConn) failed(err error) string {
+	if err == errTooManyReports {
+		return causeProtocolError
+	}
+	if _, ok := err.(net.Error); ok || err == io.EOF || err == io.ErrClosedPipe {
+		r.log().Infof("Failed to send to %v (ID: %v): %v", r.remoteAddr, r.sessionId, err)
+		return causeWriteError
+	}
+	r.log().Warnf("Closing the session to %v by an internal error (ID: %v): %v", r.remoteAddr, r.sessionId, err)
+	r.sendPDU(r.closingReport(rtr.INTERNAL_ERROR, nil))
+	return causeInternalError
 }
 
 func handleRTR(r *rtrConn, mgr *ResourceManager) {
+	r.connectedAt = time.Now()
+	sessions.add(r)
+	defer sessions.remove(r)
+	// Exits other than a failed write set the cause
+	cause := causeWriteError
+	defer func() { r.ended(cause) }()
 	bcastReceiver := mgr.serialNotify.Join()
-	scanner := bufio.NewScanner(bufio.NewReader(r.conn))
+	defer bcastReceiver.Close()
+	reader := bufio.NewReader(r.conn)
+	scanner := bufio.NewScanner(reader)
 	scanner.Split(rtr.SplitRTR)
 
 	msgCh := make(chan rtr.RTRMessage, 1)
 	errCh := make(chan *errMsg, 1)
+	done := make(chan struct{})
+	closed := make(chan struct{})
+	// readCause is why the reader has stopped, set before closing closed
+	readCause := causeClientClose
+	defer func() {
+		close(done)
+		r.shutdown()
+	}()
 	go func() {
 		defer func() {
-			log.Infof("Connection to %v was closed. (ID: %v)", r.remoteAddr, r.sessionId)
+			r.log().Infof("Connection to %v was closed. (ID: %v)", r.remoteAddr, r.sessionId)
 			r.conn.Close()
+			close(closed)
 		}()
 
+		// A router which sends nothing is closed by the idle timeout too
+		r.refreshDeadline()
+
+		// A client which doesn't speak RTR, eg. a port scanner sending an
+		// HTTP request, would make SplitRTR wait for a bogus length. Close
+		// it unless the first byte is a plausible version, so that a newer
+		// router still gets Error Report PDU.
+		if b, err := reader.Peek(1); err == nil && !plausibleVersion(b[0]) {
+			r.log().Warnf("Closing the connection from %v, which doesn't look like RTR (first byte: 0x%02x)", r.remoteAddr, b[0])
+			readCause = causeProtocolError
+			select {
+			case errCh <- &errMsg{silent: true}:
+			case <-done:
+			}
+			return
+		}
+
+		// Keep reading until the router closes the connection even after
+		// the session has finished, so that the socket is closed cleanly.
+		failed := false
 		for scanner.Scan() {
-			buf := scanner.Bytes()
-			if buf[0] != rtrProtocolVersion {
-				errCh <- &errMsg{code: rtr.UNSUPPORTED_PROTOCOL_VERSION, data: buf}
+			r.refreshDeadline()
+			r.log().Tracef("Received %d byte(s) from %v: %x", len(scanner.Bytes()), r.remoteAddr, scanner.Bytes())
+			// PDUs after an error are dropped, as the session is closing
+			// with the Error Report PDU
+			if failed {
+				continue
+			}
+			m, e := r.parsePDU(scanner.Bytes())
+			if e != nil {
+				failed = true
+				select {
+				case errCh <- e:
+				case <-done:
+				}
 				continue
 			}
-			m, err := rtr.ParseRTR(buf)
-			if err != nil {
-				errCh <- &errMsg{code: rtr.INVALID_REQUEST, data: buf}
+			if _, ok := m.(*rtr.RTRResetQuery); ok && !atomic.CompareAndSwapInt32(&r.inSync, 0, 1) {
+				r.log().Warnf("Ignored Reset Query PDU from %v during a full synchronization (ID: %v)", r.remoteAddr, r.sessionId)
 				continue
 			}
-			msgCh <- m
+			select {
+			case msgCh <- m:
+			case <-done:
+			}
+		}
+		if err, ok := scanner.Err().(net.Error); ok && err.Timeout() && !r.isClosing() {
+			r.log().Warnf("Closing the connection from %v, no PDU for %v (ID: %v)", r.remoteAddr, r.idleTimeout(), r.sessionId)
+			readCause = causeIdleTimeout
+		} else if scanner.Err() != nil {
+			readCause = causeReadError
 		}
 	}()
 
+	var pingCh <-chan time.Time
+	if commandOpts.PingInterval > 0 {
+		ticker := time.NewTicker(commandOpts.PingInterval)
+		defer ticker.Stop()
+		pingCh = ticker.C
+	}
+
+	// err is why the loop has broken
+	var err error
 LOOP:
 	for {
 		select {
-		case <-bcastReceiver.In:
+		case <-r.stopCh:
+			r.log().Infof("Closing the session to %v for shutdown (ID: %v)", r.remoteAddr, r.sessionId)
+			cause = causeShutdown
+			// RTR has no PDU for shutdown, which --final-serial tells
+			// by Error Report PDU
+			if commandOpts.FinalSerial {
+				r.sendPDU(r.closingReport(rtr.INTERNAL_ERROR, nil))
+			}
+			return
+		case <-closed:
+			// The router has closed the connection, or been idle too long
+			cause = readCause
+			return
+		case <-pingCh:
+			// Serial Notify PDU doubles as a liveness probe, since a write to
+			// a dead peer fails sooner or later.
 			currentSN := mgr.CurrentSerial()
 			if err := r.sendPDU(rtr.NewRTRSerialNotify(r.sessionId, currentSN)); err != nil {
+				r.log().Warnf("Session to %v seems to be dead (ID: %v): %v", r.remoteAddr, r.sessionId, err)
+				return
+			}
+			r.log().Debugf("Sent Serial Notify PDU to %v as a liveness probe (ID: %v, SN: %v)", r.remoteAddr, r.sessionId, currentSN)
+		case <-bcastReceiver.In:
+			currentSN := mgr.CurrentSerial()
+			if err = r.sendPDU(rtr.NewRTRSerialNotify(r.sessionId, currentSN)); err != nil {
 				break LOOP
 			}
-			log.Infof("Sent Serial Notify PDU to %v (ID: %v, SN: %v)", r.remoteAddr, r.sessionId, currentSN)
+			r.log().Infof("Sent Serial Notify PDU to %v (ID: %v, SN: %v)", r.remoteAddr, r.sessionId, currentSN)
 		case msg := <-errCh:
-			r.sendPDU(rtr.NewRTRErrorReport(msg.code, msg.data, nil))
-			log.Infof("Sent Error Report PDU to %v (ID: %v, ErrorCode: %v)", r.remoteAddr, r.sessionId, msg.code)
+			cause = causeProtocolError
+			if msg.silent {
+				return
+			}
+			r.sendPDU(r.errorReport(msg.code, msg.data))
+			r.log().Infof("Sent Error Report PDU to %v (ID: %v, ErrorCode: %v)", r.remoteAddr, r.sessionId, msg.code)
 			return
 		case m := <-msgCh:
+			if r.overQueryRate(m, time.Now()) {
+				pdu, _ := m.Serialize()
+				r.log().Warnf("Router %v sent more than %d queries per second, closing the session (ID: %v)", r.remoteAddr, commandOpts.MaxQueryRate, r.sessionId)
+				r.sendPDU(r.closingReport(rtr.INVALID_REQUEST, pdu))
+				cause = causeRateLimit
+				return
+			}
 			switch msg := m.(type) {
 			case *rtr.RTRSerialQuery:
 				peerSN := msg.SerialNumber
-				log.Infof("Received Serial Query PDU from %v (ID: %v, SN: %d)", r.remoteAddr, msg.SessionID, peerSN)
+				r.log().Infof("Received Serial Query PDU from %v (ID: %v, SN: %d)", r.remoteAddr, msg.SessionID, peerSN)
+				atomic.AddInt64(&r.stats.SerialQueries, 1)
+				// The serial of another session, eg. of a previous
+				// instance, means nothing to us. Force a full
+				// synchronization instead of a delta.
+				if msg.SessionID != r.sessionId {
+					if msg.SessionID == 0 {
+						r.log().Infof("Router %v reports session ID 0, sending Cache Reset PDU (ID: %v)", r.remoteAddr, r.sessionId)
+					} else {
+						r.log().Warnf("Router %v seems to mix caches, it reports session ID %v which is not ours, sending Cache Reset PDU (ID: %v)", r.remoteAddr, msg.SessionID, r.sessionId)
+					}
+					if err = r.noIncrementalUpdateAvailable(); err == nil {
+						continue
+					}
+					break LOOP
+				}
+				if r.injectError(msg) {
+					continue
+				}
 
 				timeoutCh := make(chan bool, 1)
 				resourceResponseCh := make(chan *resourceResponse, 1)
@@ -204,35 +1265,92 @@ LOOP:
 				go func(rrCh chan *resourceResponse, peerSN uint32) {
 					trans := mgr.BeginTransaction()
 					defer trans.EndTransaction()
-					if trans.HasKey(peerSN) {
+					if !trans.HasData() {
+						rrCh <- &resourceResponse{noData: true}
+					} else if r.fullSyncOnly {
+						// All ROAs in a Cache Response would be taken as a
+						// delta, which withdraws nothing
+						r.log().Infof("Forcing a full synchronization of %v, which is full-sync-only (ID: %v, SN: %v)", r.remoteAddr, r.sessionId, peerSN)
+						rrCh <- nil
+					} else if trans.HasKey(peerSN) {
+						list := r.sampleDelta(trans, peerSN)
+						if n := countROAs(list); commandOpts.MaxDelta > 0 && n > commandOpts.MaxDelta {
+							r.log().Infof("Delta of %d ROA(s) for %v exceeds --max-delta, forcing a full synchronization (ID: %v, SN: %v)", n, r.remoteAddr, r.sessionId, peerSN)
+							rrCh <- nil
+							return
+						}
 						rrCh <- &resourceResponse{
-							sn:   trans.CurrentSerial(),
-							list: trans.DeltaList(peerSN),
+							sn:      trans.CurrentSerial(),
+							list:    list,
+							emptied: commandOpts.OnEmpty != "" && commandOpts.OnEmpty != "delta" && countROAs(list) > 0 && countROAs(r.sample(trans.CurrentList())) == 0,
+							aspas:   r.deltaASPAs(trans, peerSN),
 						}
 					} else {
+						// Our serial never goes backward unless the data has
+						// been rolled back, eg. by restoring an old source
+						if currentSN := trans.CurrentSerial(); serialNewer(peerSN, currentSN) {
+							r.log().Warnf("Router %v reports SN %v newer than ours, the data may have been rolled back (ID: %v, SN: %v)", r.remoteAddr, peerSN, r.sessionId, currentSN)
+						} else if oldestSN := trans.OldestSerial(); serialNewer(oldestSN, peerSN) {
+							r.log().Infof("Router %v has SN %v older than the oldest retained SN %v, the history has been expired (ID: %v)", r.remoteAddr, peerSN, oldestSN, r.sessionId)
+						} else {
+							r.log().Infof("Router %v has SN %v which is not in the history (ID: %v, SN: %v)", r.remoteAddr, peerSN, r.sessionId, currentSN)
+						}
 						rrCh <- nil
 					}
 				}(resourceResponseCh, peerSN)
 
 				select {
 				case rr := <-resourceResponseCh:
-					if rr != nil {
-						if err := r.cacheResponse(rr.sn, rr.list); err == nil {
+					if rr != nil && rr.noData {
+						if err = r.cacheHasNoDataAvailable(); err == nil {
+							continue
+						}
+					} else if rr != nil && rr.emptied {
+						if err = r.tableEmptied(); err == nil {
+							continue
+						}
+					} else if rr != nil {
+						if err = r.cacheResponse(rr.sn, rr.list, rr.aspas, commandOpts.DeltaRate); err == nil {
 							continue
 						}
 					} else {
-						if err := r.noIncrementalUpdateAvailable(); err == nil {
+						if err = r.noIncrementalUpdateAvailable(); err == nil {
 							continue
 						}
 					}
 				case <-timeoutCh:
-					if err := r.cacheHasNoDataAvailable(); err == nil {
+					if err = r.cacheHasNoDataAvailable(); err == nil {
 						continue
 					}
 				}
 				break LOOP
 			case *rtr.RTRResetQuery:
-				log.Infof("Received Reset Query PDU from %v", r.remoteAddr)
+				r.log().Infof("Received Reset Query PDU from %v", r.remoteAddr)
+				atomic.AddInt64(&r.stats.ResetQueries, 1)
+				if r.injectError(msg) {
+					atomic.StoreInt32(&r.inSync, 0)
+					continue
+				}
+				// Some routers send Reset Query again on a link flap. Skip
+				// the whole table if nothing has changed since the last one.
+				if currentSN, ok := r.repeatedReset(mgr, time.Now()); ok {
+					r.log().Infof("Answering repeated Reset Query PDU from %v without ROAs, no change since the last full synchronization (ID: %v, SN: %v)", r.remoteAddr, r.sessionId, currentSN)
+					if err = r.cacheResponse(currentSN, FakeROATable{}, nil, 0); err == nil {
+						continue
+					}
+					break LOOP
+				}
+				// Spread full synchronizations of routers reconnecting at once
+				if max := commandOpts.FullSyncJitter; max > 0 {
+					delay := time.Duration(rand.Int63n(int64(max)))
+					r.log().Debugf("Delaying the full synchronization with %v by %v", r.remoteAddr, delay)
+					select {
+					case <-time.After(delay):
+					case <-closed:
+						cause = readCause
+						return
+					}
+				}
 
 				timeoutCh := make(chan bool, 1)
 				resourceResponseCh := make(chan *resourceResponse, 1)
@@ -245,35 +1363,79 @@ LOOP:
 				go func(rrCh chan *resourceResponse) {
 					trans := mgr.BeginTransaction()
 					defer trans.EndTransaction()
+					if !trans.HasData() {
+						rrCh <- &resourceResponse{noData: true}
+						return
+					}
+					// Pacing, sampling and fuzzing make a response for each router
+					if commandOpts.CacheFullSync && commandOpts.FullSyncRate == 0 && r.canary == 0 && commandOpts.FuzzMaxLen == 0 {
+						stream := trans.FullSync(r.peerVersion())
+						rrCh <- &resourceResponse{
+							sn:      stream.sn,
+							stream:  stream,
+							emptied: commandOpts.OnEmpty == "no-data" && stream.roas() == 0,
+							aspas:   r.currentASPAs(trans),
+						}
+						return
+					}
+					list := r.sample(trans.CurrentList())
+					sortFakeROATable(list, commandOpts.Sort)
 					rrCh <- &resourceResponse{
-						sn:   trans.CurrentSerial(),
-						list: trans.CurrentList(),
+						sn:      trans.CurrentSerial(),
+						list:    list,
+						emptied: commandOpts.OnEmpty == "no-data" && countROAs(list) == 0,
+						aspas:   r.currentASPAs(trans),
 					}
 				}(resourceResponseCh)
 
 				select {
 				case rr := <-resourceResponseCh:
-					if err := r.cacheResponse(rr.sn, rr.list); err == nil {
+					if rr.noData {
+						atomic.StoreInt32(&r.inSync, 0)
+						if err = r.cacheHasNoDataAvailable(); err == nil {
+							continue
+						}
+						break LOOP
+					}
+					if rr.emptied {
+						atomic.StoreInt32(&r.inSync, 0)
+						if err = r.tableEmptied(); err == nil {
+							continue
+						}
+						break LOOP
+					}
+					if rr.stream != nil {
+						r.logEmptyFamilies(func(rf bgp.RouteFamily) int { return rr.stream.counts[rf] })
+						err = r.cachedResponse(rr.stream, rr.aspas)
+					} else {
+						r.logEmptyFamilies(func(rf bgp.RouteFamily) int { return len(rr.list[rf][rtr.ANNOUNCEMENT]) })
+						err = r.cacheResponse(rr.sn, rr.list, rr.aspas, commandOpts.FullSyncRate)
+					}
+					if err == nil {
+						r.fullSyncAt = time.Now()
 						continue
 					}
 				case <-timeoutCh:
-					if err := r.cacheHasNoDataAvailable(); err == nil {
+					atomic.StoreInt32(&r.inSync, 0)
+					if err = r.cacheHasNoDataAvailable(); err == nil {
 						continue
 					}
 				}
 
 				break LOOP
 			case *rtr.RTRErrorReport:
-				log.Warnf("Received Error Report PDU from %v (%#v)", r.remoteAddr, msg)
+				r.log().Warnf("Received Error Report PDU from %v (%#v)", r.remoteAddr, msg)
+				cause = causeProtocolError
 				return
 			default:
 				pdu, _ := msg.Serialize()
-				log.Warnf("Received unsupported PDU (type %d) from %v (%#v)", pdu[1], r.remoteAddr, msg)
-				r.sendPDU(rtr.NewRTRErrorReport(rtr.UNSUPPORTED_PDU_TYPE, pdu, nil))
+				r.log().Warnf("Received unsupported PDU (type %d) from %v (%#v)", pdu[1], r.remoteAddr, msg)
+				r.sendPDU(r.errorReport(rtr.UNSUPPORTED_PDU_TYPE, pdu))
+				cause = causeProtocolError
 				return
 			}
 		}
 	}
-	r.sendPDU(rtr.NewRTRErrorReport(rtr.INTERNAL_ERROR, nil, nil))
+	cause = r.failed(err)
 	return
 }
@@ -2,15 +2,30 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/osrg/gobgp/pkg/packet/bgp"
 	"github.com/osrg/gobgp/pkg/packet/rtr"
 	. "github.com/r7kamura/gospel"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 )
 
 func TestMain(m *testing.M) {
@@ -20,11 +35,15 @@ func TestMain(m *testing.M) {
 }
 
 func prepare(content []string) (*ResourceManager, *os.File) {
+	return prepareOn(42420, "*/2", content)
+}
+
+func prepareOn(port int, interval string, content []string) (*ResourceManager, *os.File) {
 	rpslFile, _ := ioutil.TempFile(os.TempDir(), "rtr_test.db")
 	addRPSL(rpslFile, content)
 
 	mgr := NewResourceManager(false)
-	go mainLoop(mgr, []string{rpslFile.Name()}, 42420, "*/2", false, true, nil)
+	go mainLoop(mgr, []string{rpslFile.Name()}, port, interval, false, true, nil)
 	return mgr, rpslFile
 }
 
@@ -34,12 +53,12 @@ func addRPSL(f *os.File, content []string) {
 	}
 }
 
-func connectRTRServer() (*rtrConn, *bufio.Scanner) {
+func connectRTRServer(port int) (*rtrConn, *bufio.Scanner) {
 	var tcpAddr *net.TCPAddr
 	var conn *net.TCPConn
 	var err error
 	for {
-		tcpAddr, err = net.ResolveTCPAddr("tcp", ":42420")
+		tcpAddr, err = net.ResolveTCPAddr("tcp", ":"+strconv.Itoa(port))
 		if err == nil {
 			break
 		}
@@ -56,6 +75,21 @@ func connectRTRServer() (*rtrConn, *bufio.Scanner) {
 	return r, scanner
 }
 
+// newConnPair returns a server side rtrConn and the client side connection
+// which are connected each other over the loopback.
+func newConnPair() (*rtrConn, *net.TCPConn) {
+	l, _ := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer l.Close()
+	client, _ := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	conn, _ := l.AcceptTCP()
+	r := &rtrConn{
+		conn:       conn,
+		sessionId:  1,
+		remoteAddr: conn.RemoteAddr(),
+	}
+	return r, client
+}
+
 func TestHandleRTR(t *testing.T) {
 	var buf []byte
 	var m rtr.RTRMessage
@@ -74,7 +108,7 @@ func TestHandleRTR(t *testing.T) {
 	}
 	mgr, f := prepare(initContent)
 	defer os.Remove(f.Name())
-	r, scanner := connectRTRServer()
+	r, scanner := connectRTRServer(42420)
 
 	Context("6.1. Start or Restart", func() {
 		pdu := rtr.NewRTRResetQuery()
@@ -119,7 +153,7 @@ func TestHandleRTR(t *testing.T) {
 
 	Context("6.2. Typical Exchange", func() {
 		Context("When its serial number is the latest", func() {
-			pdu := rtr.NewRTRSerialQuery(r.sessionId, sn)
+			pdu := rtr.NewRTRSerialQuery(id, sn)
 			r.sendPDU(pdu)
 
 			scanner.Scan()
@@ -156,7 +190,7 @@ func TestHandleRTR(t *testing.T) {
 				Expect(ok).To(Equal, true)
 			})
 
-			pdu := rtr.NewRTRSerialQuery(r.sessionId, sn)
+			pdu := rtr.NewRTRSerialQuery(id, sn)
 			r.sendPDU(pdu)
 
 			scanner.Scan()
@@ -298,22 +332,2561 @@ func TestHandleRTR(t *testing.T) {
 	})
 }
 
-func TestRFToIPVer(t *testing.T) {
-	Context("with bgp.RF_IPv4_UC", func() {
-		It("should convert to \"IPv4\"", func() {
-			Expect(RFToIPVer(bgp.RF_IPv4_UC)).To(Equal, "IPv4")
+func TestErrorInjection(t *testing.T) {
+	var m rtr.RTRMessage
+
+	_, f := prepareOn(42421, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, scanner := connectRTRServer(42421)
+	defer r.conn.Close()
+
+	injector.set(rtr.INTERNAL_ERROR, 1)
+	defer injector.set(0, 0)
+
+	Context("When an error is injected for one query", func() {
+		r.sendPDU(rtr.NewRTRResetQuery())
+
+		scanner.Scan()
+		m, _ = rtr.ParseRTR(scanner.Bytes())
+		It("should receive Error Report PDU with the injected error code", func() {
+			rtrMsg, ok := m.(*rtr.RTRErrorReport)
+			Expect(ok).To(Equal, true)
+			Expect(rtrMsg.ErrorCode).To(Equal, rtr.INTERNAL_ERROR)
+		})
+
+		r.sendPDU(rtr.NewRTRResetQuery())
+
+		scanner.Scan()
+		m, _ = rtr.ParseRTR(scanner.Bytes())
+		It("should receive Cache Response PDU for the following query", func() {
+			_, ok := m.(*rtr.RTRCacheResponse)
+			Expect(ok).To(Equal, true)
+		})
+
+		scanner.Scan()
+		m, _ = rtr.ParseRTR(scanner.Bytes())
+		It("should receive IPv4 Prefix PDU", func() {
+			_, ok := m.(*rtr.RTRIPPrefix)
+			Expect(ok).To(Equal, true)
+		})
+
+		scanner.Scan()
+		m, _ = rtr.ParseRTR(scanner.Bytes())
+		It("should receive End of Data PDU", func() {
+			_, ok := m.(*rtr.RTREndOfData)
+			Expect(ok).To(Equal, true)
 		})
 	})
+}
 
-	Context("with bgp.RF_IPv6_UC", func() {
-		It("should convert to \"IPv6\"", func() {
-			Expect(RFToIPVer(bgp.RF_IPv6_UC)).To(Equal, "IPv6")
+func TestSessionIDConsistency(t *testing.T) {
+	var cacheResponse *rtr.RTRCacheResponse
+	var endOfData *rtr.RTREndOfData
+
+	_, f := prepareOn(42423, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, scanner := connectRTRServer(42423)
+	defer r.conn.Close()
+
+	exchange := func(pdu rtr.RTRMessage) {
+		r.sendPDU(pdu)
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			switch msg := m.(type) {
+			case *rtr.RTRCacheResponse:
+				cacheResponse = msg
+			case *rtr.RTREndOfData:
+				endOfData = msg
+				return
+			}
+		}
+	}
+
+	Context("When a reset query is sent", func() {
+		exchange(rtr.NewRTRResetQuery())
+		It("should receive the same session ID in Cache Response and End of Data", func() {
+			Expect(endOfData.SessionID).To(Equal, cacheResponse.SessionID)
 		})
 	})
 
-	Context("with unsupported RouteFamily", func() {
-		It("should convert to \"Unsupported\"", func() {
-			Expect(RFToIPVer(bgp.RF_EVPN)).To(Equal, "Unsupported")
+	Context("When a serial query is sent", func() {
+		exchange(rtr.NewRTRSerialQuery(endOfData.SessionID, endOfData.SerialNumber))
+		It("should receive the same session ID in Cache Response and End of Data", func() {
+			Expect(endOfData.SessionID).To(Equal, cacheResponse.SessionID)
+		})
+	})
+
+	Context("When another router connects", func() {
+		sessionId := endOfData.SessionID
+		r2, scanner2 := connectRTRServer(42423)
+		defer r2.conn.Close()
+		r, scanner = r2, scanner2
+		exchange(rtr.NewRTRResetQuery())
+		It("should receive the same session ID of the cache", func() {
+			Expect(endOfData.SessionID).To(Equal, sessionId)
+		})
+	})
+}
+
+func TestForeignSessionID(t *testing.T) {
+	var endOfData *rtr.RTREndOfData
+
+	mgr, f := prepareOn(42431, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, scanner := connectRTRServer(42431)
+	defer r.conn.Close()
+
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	// mainLoop in quiet mode has suppressed warnings
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	defer logrus.SetLevel(level)
+
+	// exchange returns End of Data PDU or Cache Reset PDU ending the response
+	exchange := func(pdu rtr.RTRMessage) rtr.RTRMessage {
+		r.sendPDU(pdu)
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			switch msg := m.(type) {
+			case *rtr.RTREndOfData:
+				endOfData = msg
+				return msg
+			case *rtr.RTRCacheReset:
+				return msg
+			}
+		}
+		return nil
+	}
+	warned := func() bool {
+		for _, e := range hook.AllEntries() {
+			if e.Level == logrus.WarnLevel && strings.Contains(e.Message, "seems to mix caches") {
+				return true
+			}
+		}
+		return false
+	}
+
+	exchange(rtr.NewRTRResetQuery())
+
+	Context("When a serial query with our session ID is sent", func() {
+		m := exchange(rtr.NewRTRSerialQuery(endOfData.SessionID, endOfData.SerialNumber))
+		It("should answer by a delta without warning", func() {
+			_, ok := m.(*rtr.RTREndOfData)
+			Expect(ok).To(Equal, true)
+			Expect(warned()).To(Equal, false)
+		})
+	})
+
+	Context("When a serial query with a stale session ID is sent", func() {
+		m := exchange(rtr.NewRTRSerialQuery(endOfData.SessionID+1, endOfData.SerialNumber))
+		It("should warn the router mixes caches, and send Cache Reset PDU", func() {
+			Expect(warned()).To(Equal, true)
+			_, ok := m.(*rtr.RTRCacheReset)
+			Expect(ok).To(Equal, true)
+		})
+
+		Context("and then the router resynchronizes", func() {
+			m := exchange(rtr.NewRTRResetQuery())
+			It("should keep the session", func() {
+				_, ok := m.(*rtr.RTREndOfData)
+				Expect(ok).To(Equal, true)
+			})
+		})
+	})
+
+	Context("When a serial query with a stale session ID of 0 is sent", func() {
+		// 0 is as valid as any other session ID
+		r, client := newConnPair()
+		defer client.Close()
+		go handleRTR(r, mgr)
+		hook.Reset()
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf, _ := rtr.NewRTRSerialQuery(0, mgr.CurrentSerial()).Serialize()
+		client.Write(buf)
+		scanner := bufio.NewScanner(client)
+		scanner.Split(rtr.SplitRTR)
+		scanner.Scan()
+		m, _ := rtr.ParseRTR(scanner.Bytes())
+		It("should send Cache Reset PDU without warning", func() {
+			_, ok := m.(*rtr.RTRCacheReset)
+			Expect(ok).To(Equal, true)
+			Expect(warned()).To(Equal, false)
+		})
+	})
+}
+
+func TestSplitListeners(t *testing.T) {
+	s := newRTRServer(42425)
+	s.networks = []string{"tcp4", "tcp6"}
+	go s.run()
+
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		var conn net.Conn
+		var err error
+		for {
+			conn, err = net.Dial("tcp", net.JoinHostPort(host, "42425"))
+			if err == nil {
+				break
+			}
+		}
+		c := <-s.connCh
+		It("should accept a connection from "+host, func() {
+			Expect(c.remoteAddr.(*net.TCPAddr).IP.String()).To(Equal, host)
+			Expect(c.conn.LocalAddr().(*net.TCPAddr).IP.String()).To(Equal, host)
+		})
+		c.conn.Close()
+		conn.Close()
+	}
+}
+
+func TestListenNetworks(t *testing.T) {
+	split := []string{"tcp4", "tcp6"}
+	examples := []struct {
+		host     string
+		networks []string
+		expected []string
+	}{
+		{"", split, split},
+		{"localhost", split, split},
+		{"127.0.0.1", split, []string{"tcp4"}},
+		{"::1", split, []string{"tcp6"}},
+		{"127.0.0.1", []string{"tcp"}, []string{"tcp"}},
+	}
+	for _, e := range examples {
+		It("should listen on the networks matching "+e.host, func() {
+			Expect(listenNetworks(e.host, e.networks)).To(Equal, e.expected)
+		})
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	s := newRTRServer(42446)
+	s.listenHost = "::1"
+	go s.run()
+
+	var conn net.Conn
+	var err error
+	for {
+		conn, err = net.Dial("tcp", "[::1]:42446")
+		if err == nil {
+			break
+		}
+	}
+	defer conn.Close()
+	c := <-s.connCh
+	defer c.conn.Close()
+	It("should accept a connection to the address", func() {
+		Expect(c.conn.LocalAddr().(*net.TCPAddr).IP.String()).To(Equal, "::1")
+	})
+
+	_, err = net.Dial("tcp", "127.0.0.1:42446")
+	It("should not listen on other addresses", func() {
+		Expect(err != nil).To(Equal, true)
+	})
+}
+
+func TestStop(t *testing.T) {
+	file := createFile("TestStop", []string{"route: 192.168.0.0/24\norigin: AS65000\nsource: TEST\n\n"})
+	defer removeFile(file)
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{file})
+
+	s := newRTRServer(42447)
+	go s.run()
+	go func() {
+		for c := range s.connCh {
+			s.handle(c, mgr)
+		}
+	}()
+	r, scanner := connectRTRServer(42447)
+	defer r.conn.Close()
+	r.sendPDU(rtr.NewRTRResetQuery())
+	for scanner.Scan() {
+		if scanner.Bytes()[1] == rtr.RTR_END_OF_DATA {
+			break
+		}
+	}
+
+	Context("When the server is stopped with a session", func() {
+		stopped := s.Stop(5 * time.Second)
+		It("should close the session within the timeout", func() {
+			Expect(stopped).To(Equal, true)
+			Expect(scanner.Scan()).To(Equal, false)
+		})
+
+		_, err := net.Dial("tcp", "127.0.0.1:42447")
+		It("should not accept connections any more", func() {
+			Expect(err != nil).To(Equal, true)
+		})
+	})
+}
+
+func TestCloseGrace(t *testing.T) {
+	_, f := prepareOn(42426, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, scanner := connectRTRServer(42426)
+	defer r.conn.Close()
+
+	commandOpts.CloseGrace = 100 * time.Millisecond
+	defer func() { commandOpts.CloseGrace = 0 }()
+
+	Context("When a PDU with an unsupported version is sent with another PDU", func() {
+		buf, _ := rtr.NewRTRResetQuery().Serialize()
+		buf[0] = 2
+		query, _ := rtr.NewRTRResetQuery().Serialize()
+		r.conn.Write(append(buf, query...))
+
+		scanner.Scan()
+		m, _ := rtr.ParseRTR(scanner.Bytes())
+		It("should receive Error Report PDU", func() {
+			rtrMsg, ok := m.(*rtr.RTRErrorReport)
+			Expect(ok).To(Equal, true)
+			Expect(rtrMsg.ErrorCode).To(Equal, rtr.UNSUPPORTED_PROTOCOL_VERSION)
+		})
+
+		r.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := r.conn.Read(make([]byte, 1))
+		It("should be closed gracefully", func() {
+			Expect(err).To(Equal, io.EOF)
+		})
+	})
+}
+
+func TestErrorText(t *testing.T) {
+	r, client := newConnPair()
+	defer r.conn.Close()
+	defer client.Close()
+	r.serial = 100
+
+	commandOpts.ErrorText = "session {session} at serial {serial} failed with code {code}"
+	defer func() { commandOpts.ErrorText = "" }()
+
+	Context("When an Error Report PDU is sent with the text template", func() {
+		r.cacheHasNoDataAvailable()
+
+		scanner := bufio.NewScanner(bufio.NewReader(client))
+		scanner.Split(rtr.SplitRTR)
+		scanner.Scan()
+		m, _ := rtr.ParseRTR(scanner.Bytes())
+		It("should receive the text with the placeholders replaced", func() {
+			rtrMsg, ok := m.(*rtr.RTRErrorReport)
+			Expect(ok).To(Equal, true)
+			Expect(string(rtrMsg.Text)).To(Equal, "session 1 at serial 100 failed with code 2")
+		})
+	})
+}
+
+func TestShortPDU(t *testing.T) {
+	r, client := newConnPair()
+	defer r.conn.Close()
+	defer client.Close()
+
+	Context("When a PDU shorter than the header is read", func() {
+		m, e := r.parsePDU([]byte{0})
+		It("should return Corrupt Data instead of a message", func() {
+			Expect(m == nil).To(Equal, true)
+			Expect(e.code).To(Equal, rtr.CORRUPT_DATA)
+		})
+
+		r.sendPDU(r.errorReport(e.code, e.data))
+		scanner := bufio.NewScanner(bufio.NewReader(client))
+		scanner.Split(rtr.SplitRTR)
+		scanner.Scan()
+		m, _ = rtr.ParseRTR(scanner.Bytes())
+		It("should send Error Report PDU without the PDU", func() {
+			rtrMsg, ok := m.(*rtr.RTRErrorReport)
+			Expect(ok).To(Equal, true)
+			Expect(rtrMsg.ErrorCode).To(Equal, rtr.CORRUPT_DATA)
+			Expect(rtrMsg.PDULen).To(Equal, uint32(0))
+		})
+	})
+}
+
+func TestPipelinedResetQuery(t *testing.T) {
+	var m rtr.RTRMessage
+
+	_, f := prepareOn(42428, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, scanner := connectRTRServer(42428)
+	defer r.conn.Close()
+
+	receive := func() []rtr.RTRMessage {
+		msgs := []rtr.RTRMessage{}
+		r.conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		for scanner.Scan() {
+			m, _ = rtr.ParseRTR(scanner.Bytes())
+			msgs = append(msgs, m)
+		}
+		return msgs
+	}
+
+	Context("When two Reset Query PDUs are pipelined", func() {
+		query, _ := rtr.NewRTRResetQuery().Serialize()
+		r.conn.Write(append(query, query...))
+
+		msgs := receive()
+		It("should run only one full synchronization", func() {
+			Expect(len(msgs)).To(Equal, 3)
+			_, ok := msgs[0].(*rtr.RTRCacheResponse)
+			Expect(ok).To(Equal, true)
+			_, ok = msgs[2].(*rtr.RTREndOfData)
+			Expect(ok).To(Equal, true)
+		})
+	})
+}
+
+func TestPrefixFlags(t *testing.T) {
+	r, client := newConnPair()
+	defer r.conn.Close()
+	defer client.Close()
+
+	lists := FakeROATable{
+		bgp.RF_IPv4_UC: map[uint8][]*FakeROA{
+			rtr.ANNOUNCEMENT: {{Prefix: net.ParseIP("192.168.0.0"), PrefixLen: 24, MaxLen: 24, AS: 65000}},
+			rtr.WITHDRAWAL:   {{Prefix: net.ParseIP("192.168.1.0"), PrefixLen: 24, MaxLen: 24, AS: 65001}},
+		},
+		bgp.RF_IPv6_UC: map[uint8][]*FakeROA{
+			rtr.ANNOUNCEMENT: {{Prefix: net.ParseIP("2001:db8::"), PrefixLen: 32, MaxLen: 32, AS: 65000}},
+			rtr.WITHDRAWAL:   {{Prefix: net.ParseIP("2001:db8:1::"), PrefixLen: 48, MaxLen: 48, AS: 65001}},
+		},
+	}
+	go r.cacheResponse(1, lists, nil, 0)
+
+	scanner := bufio.NewScanner(bufio.NewReader(client))
+	scanner.Split(rtr.SplitRTR)
+	flags := []uint8{}
+	for scanner.Scan() {
+		buf := scanner.Bytes()
+		if buf[1] == rtr.RTR_END_OF_DATA {
+			break
+		}
+		if buf[1] == rtr.RTR_IPV4_PREFIX || buf[1] == rtr.RTR_IPV6_PREFIX {
+			// The flags field follows the 8 bytes header
+			flags = append(flags, buf[8])
+		}
+	}
+
+	Context("When Prefix PDUs are sent", func() {
+		It("should have only the announce/withdraw bit in the flags field", func() {
+			Expect(flags).To(Equal, []uint8{rtr.ANNOUNCEMENT, rtr.WITHDRAWAL, rtr.ANNOUNCEMENT, rtr.WITHDRAWAL})
+		})
+	})
+}
+
+func TestPingInterval(t *testing.T) {
+	_, f := prepareOn(42429, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+
+	commandOpts.PingInterval = 50 * time.Millisecond
+	defer func() { commandOpts.PingInterval = 0 }()
+
+	r, _ := connectRTRServer(42429)
+	addr := r.conn.LocalAddr().String()
+	for sessions.lookup(addr) == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	Context("When the router has gone away silently", func() {
+		r.conn.Close()
+
+		reaped := false
+		for i := 0; i < 100 && !reaped; i++ {
+			time.Sleep(10 * time.Millisecond)
+			reaped = sessions.lookup(addr) == nil
+		}
+		It("should reap the session on the next probe", func() {
+			Expect(reaped).To(Equal, true)
+		})
+	})
+}
+
+func TestFullSyncRate(t *testing.T) {
+	routes := func(third int) []string {
+		content := []string{}
+		for i := 0; i < 10; i++ {
+			content = append(content, fmt.Sprintf("route:  10.%d.%d.0/24\norigin: AS65000\nsource: TEST\n\n", third, i))
+		}
+		return content
+	}
+	mgr, f := prepareOn(42430, "", routes(0))
+	defer os.Remove(f.Name())
+	r, scanner := connectRTRServer(42430)
+	defer r.conn.Close()
+
+	commandOpts.FullSyncRate = 50
+	defer func() { commandOpts.FullSyncRate = 0 }()
+
+	exchange := func(pdu rtr.RTRMessage) (*rtr.RTREndOfData, time.Duration) {
+		start := time.Now()
+		r.sendPDU(pdu)
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			if msg, ok := m.(*rtr.RTREndOfData); ok {
+				return msg, time.Since(start)
+			}
+		}
+		return nil, time.Since(start)
+	}
+
+	Context("When the rate of full synchronizations is limited", func() {
+		endOfData, elapsed := exchange(rtr.NewRTRResetQuery())
+		It("should pace Prefix PDUs of a full synchronization", func() {
+			// 10 PDUs at 50 PDUs per second
+			Expect(elapsed >= 180*time.Millisecond).To(Equal, true)
+		})
+
+		addRPSL(f, routes(1))
+		mgr.Reload()
+		_, elapsed = exchange(rtr.NewRTRSerialQuery(endOfData.SessionID, endOfData.SerialNumber))
+		It("should not pace Prefix PDUs of an incremental update", func() {
+			Expect(elapsed < 100*time.Millisecond).To(Equal, true)
+		})
+	})
+}
+
+func TestPDUsInOneWrite(t *testing.T) {
+	mgr, f := prepareOn(42433, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, scanner := connectRTRServer(42433)
+	defer r.conn.Close()
+
+	// Learn the session ID by a full synchronization
+	resetQuery, _ := rtr.NewRTRResetQuery().Serialize()
+	r.conn.Write(resetQuery)
+	var sessionID uint16
+	for scanner.Scan() {
+		m, _ := rtr.ParseRTR(scanner.Bytes())
+		if endOfData, ok := m.(*rtr.RTREndOfData); ok {
+			sessionID = endOfData.SessionID
+			break
+		}
+	}
+
+	Context("When two PDUs are sent back-to-back in one write", func() {
+		serialQuery, _ := rtr.NewRTRSerialQuery(sessionID, mgr.CurrentSerial()).Serialize()
+
+		tokens := [][]byte{}
+		split := bufio.NewScanner(bytes.NewReader(append(resetQuery, serialQuery...)))
+		split.Split(rtr.SplitRTR)
+		for split.Scan() {
+			tokens = append(tokens, append([]byte{}, split.Bytes()...))
+		}
+		It("should be framed one PDU per token", func() {
+			Expect(tokens).To(Equal, [][]byte{resetQuery, serialQuery})
+		})
+
+		r.conn.Write(append(resetQuery, serialQuery...))
+		types := []uint8{}
+		r.conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		for scanner.Scan() {
+			types = append(types, scanner.Bytes()[1])
+		}
+		It("should handle both in order", func() {
+			Expect(types).To(Equal, []uint8{
+				// Reset Query
+				rtr.RTR_CACHE_RESPONSE, rtr.RTR_IPV4_PREFIX, rtr.RTR_END_OF_DATA,
+				// Serial Query with the current serial number
+				rtr.RTR_CACHE_RESPONSE, rtr.RTR_END_OF_DATA,
+			})
+		})
+	})
+}
+
+func TestEmptyFamilyLog(t *testing.T) {
+	_, f := prepareOn(42434, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, scanner := connectRTRServer(42434)
+	defer r.conn.Close()
+
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.InfoLevel)
+	defer logrus.SetLevel(level)
+
+	Context("When the dataset has only IPv4 ROAs", func() {
+		r.sendPDU(rtr.NewRTRResetQuery())
+		for scanner.Scan() {
+			if scanner.Bytes()[1] == rtr.RTR_END_OF_DATA {
+				break
+			}
+		}
+		messages := []string{}
+		for _, e := range hook.AllEntries() {
+			if strings.HasPrefix(e.Message, "Sending 0 ") {
+				messages = append(messages, e.Message)
+			}
+		}
+		It("should log the empty IPv6 family", func() {
+			Expect(len(messages)).To(Equal, 1)
+			Expect(strings.HasPrefix(messages[0], "Sending 0 IPv6 ROA(s)")).To(Equal, true)
+		})
+	})
+}
+
+func TestReaddChanged(t *testing.T) {
+	mgr, f := prepareOn(42435, "", []string{
+		"route:  10.0.0.0/8\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+		"route:  192.168.0.0/24\n",
+		"origin: AS65001\n",
+		"source: TEST\n",
+		"\n",
+		"route:  192.168.0.0/24\n",
+		"origin: AS65002\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, scanner := connectRTRServer(42435)
+	defer r.conn.Close()
+
+	commandOpts.ReaddChanged = true
+	defer func() { commandOpts.ReaddChanged = false }()
+
+	exchange := func(pdu rtr.RTRMessage) ([]string, *rtr.RTREndOfData) {
+		r.sendPDU(pdu)
+		prefixes := []string{}
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			switch msg := m.(type) {
+			case *rtr.RTRIPPrefix:
+				prefixes = append(prefixes, fmt.Sprintf("%d %v/%v-%v AS%v", msg.Flags, msg.Prefix, msg.PrefixLen, msg.MaxLen, msg.AS))
+			case *rtr.RTREndOfData:
+				return prefixes, msg
+			}
+		}
+		return prefixes, nil
+	}
+	_, endOfData := exchange(rtr.NewRTRResetQuery())
+
+	Context("When only the maxlen of a ROA is changed", func() {
+		ioutil.WriteFile(f.Name(), []byte(strings.Join([]string{
+			"route:  10.0.0.0/8\n",
+			"origin: AS65000\n",
+			"source: TEST\n",
+			"\n",
+			"route:  192.168.0.0/24\n",
+			"origin: AS65001\n",
+			"source: TEST\n",
+			"\n",
+			"route:  192.168.0.0/24\n",
+			"origin: AS65002\n",
+			"remarks: maxLength 26\n",
+			"source: TEST\n",
+			"\n",
+		}, "")), 0644)
+		mgr.Reload()
+
+		prefixes, _ := exchange(rtr.NewRTRSerialQuery(endOfData.SessionID, endOfData.SerialNumber))
+		sort.Strings(prefixes[:2])
+		sort.Strings(prefixes[2:])
+		It("should withdraw all old ROAs of the prefix before announcing the new ones", func() {
+			Expect(prefixes).To(Equal, []string{
+				"0 192.168.0.0/24-24 AS65001",
+				"0 192.168.0.0/24-24 AS65002",
+				"1 192.168.0.0/24-24 AS65001",
+				"1 192.168.0.0/24-26 AS65002",
+			})
+		})
+	})
+}
+
+func TestOnEmpty(t *testing.T) {
+	mgr, f := prepareOn(42436, "", []string{
+		"route:  10.0.0.0/8\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, scanner := connectRTRServer(42436)
+	defer r.conn.Close()
+
+	defer func() { commandOpts.OnEmpty = "delta" }()
+
+	exchange := func(pdu rtr.RTRMessage) rtr.RTRMessage {
+		r.sendPDU(pdu)
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			switch m.(type) {
+			case *rtr.RTREndOfData, *rtr.RTRCacheReset, *rtr.RTRErrorReport:
+				return m
+			}
+		}
+		return nil
+	}
+	endOfData := exchange(rtr.NewRTRResetQuery()).(*rtr.RTREndOfData)
+
+	ioutil.WriteFile(f.Name(), []byte{}, 0644)
+	mgr.Reload()
+
+	Context("When the table has become empty with --on-empty=cache-reset", func() {
+		commandOpts.OnEmpty = "cache-reset"
+		m := exchange(rtr.NewRTRSerialQuery(endOfData.SessionID, endOfData.SerialNumber))
+		It("should send Cache Reset PDU instead of withdrawals", func() {
+			_, ok := m.(*rtr.RTRCacheReset)
+			Expect(ok).To(Equal, true)
+		})
+	})
+
+	Context("When a router sends Reset Query to the empty table with --on-empty=no-data", func() {
+		commandOpts.OnEmpty = "no-data"
+		m := exchange(rtr.NewRTRResetQuery())
+		It("should send No Data Available Error Report PDU", func() {
+			msg, ok := m.(*rtr.RTRErrorReport)
+			Expect(ok).To(Equal, true)
+			Expect(msg.ErrorCode).To(Equal, uint16(rtr.NO_DATA_AVAILABLE))
+		})
+	})
+}
+
+func TestMaxDelta(t *testing.T) {
+	mgr, f := prepareOn(42451, "", []string{
+		"route:  10.0.0.0/8\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, scanner := connectRTRServer(42451)
+	defer r.conn.Close()
+
+	commandOpts.MaxDelta = 2
+	defer func() { commandOpts.MaxDelta = 0 }()
+
+	exchange := func(pdu rtr.RTRMessage) (int, rtr.RTRMessage) {
+		r.sendPDU(pdu)
+		prefixes := 0
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			switch m.(type) {
+			case *rtr.RTRIPPrefix:
+				prefixes++
+			case *rtr.RTREndOfData, *rtr.RTRCacheReset, *rtr.RTRErrorReport:
+				return prefixes, m
+			}
+		}
+		return prefixes, nil
+	}
+	addRoutes := func(origins ...int) {
+		for _, origin := range origins {
+			addRPSL(f, []string{"route:  10.0.0.0/8\n", fmt.Sprintf("origin: AS%d\n", origin), "source: TEST\n", "\n"})
+		}
+		mgr.Reload()
+	}
+	_, m := exchange(rtr.NewRTRResetQuery())
+	endOfData := m.(*rtr.RTREndOfData)
+
+	Context("When a delta is within --max-delta", func() {
+		addRoutes(65001, 65002)
+		prefixes, m := exchange(rtr.NewRTRSerialQuery(endOfData.SessionID, endOfData.SerialNumber))
+		It("should send the delta", func() {
+			Expect(prefixes).To(Equal, 2)
+			_, ok := m.(*rtr.RTREndOfData)
+			Expect(ok).To(Equal, true)
+		})
+		endOfData, _ = m.(*rtr.RTREndOfData)
+	})
+
+	Context("When a delta exceeds --max-delta", func() {
+		addRoutes(65003, 65004, 65005)
+		prefixes, m := exchange(rtr.NewRTRSerialQuery(endOfData.SessionID, endOfData.SerialNumber))
+		It("should send Cache Reset PDU instead of the delta", func() {
+			Expect(prefixes).To(Equal, 0)
+			_, ok := m.(*rtr.RTRCacheReset)
+			Expect(ok).To(Equal, true)
+		})
+	})
+}
+
+func TestExpiredSerial(t *testing.T) {
+	mgr, f := prepareOn(42453, "", []string{
+		"route:  10.0.0.0/8\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, scanner := connectRTRServer(42453)
+	defer r.conn.Close()
+
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	// mainLoop in quiet mode may have suppressed logs
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.InfoLevel)
+	defer logrus.SetLevel(level)
+
+	exchange := func(pdu rtr.RTRMessage) rtr.RTRMessage {
+		r.sendPDU(pdu)
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			switch m.(type) {
+			case *rtr.RTREndOfData, *rtr.RTRCacheReset, *rtr.RTRErrorReport:
+				return m
+			}
+		}
+		return nil
+	}
+	endOfData := exchange(rtr.NewRTRResetQuery()).(*rtr.RTREndOfData)
+
+	// The history has SN-20 loaded 2 days ago, which expires on the reload,
+	// and SN-10 loaded an hour ago
+	currentSN := endOfData.SerialNumber
+	cp := mgr.Checkpoint()
+	roas := cp.History[0].ROAs
+	cp.History = append(cp.History,
+		&checkpointSerial{Serial: currentSN - 20, LoadedAt: time.Now().Add(-48 * time.Hour), ROAs: roas},
+		&checkpointSerial{Serial: currentSN - 10, LoadedAt: time.Now().Add(-time.Hour), ROAs: roas},
+	)
+	mgr.Restore(cp)
+	mgr.Reload()
+	lastLog := func() string {
+		for i := len(hook.AllEntries()) - 1; i >= 0; i-- {
+			if msg := hook.AllEntries()[i].Message; strings.HasPrefix(msg, "Router") {
+				return msg
+			}
+		}
+		return ""
+	}
+
+	Context("When a router is at a serial older than the oldest retained one", func() {
+		m := exchange(rtr.NewRTRSerialQuery(endOfData.SessionID, currentSN-20))
+		It("should send Cache Reset PDU and log the expiry", func() {
+			_, ok := m.(*rtr.RTRCacheReset)
+			Expect(ok).To(Equal, true)
+			Expect(strings.Contains(lastLog(), fmt.Sprintf("older than the oldest retained SN %v", currentSN-10))).To(Equal, true)
+		})
+	})
+
+	Context("When a router is at a serial which has never existed", func() {
+		m := exchange(rtr.NewRTRSerialQuery(endOfData.SessionID, currentSN-5))
+		It("should send Cache Reset PDU and log it distinctly", func() {
+			_, ok := m.(*rtr.RTRCacheReset)
+			Expect(ok).To(Equal, true)
+			Expect(strings.Contains(lastLog(), "not in the history")).To(Equal, true)
+		})
+	})
+
+	Context("When a router is at a retained serial", func() {
+		m := exchange(rtr.NewRTRSerialQuery(endOfData.SessionID, currentSN-10))
+		It("should send a delta", func() {
+			_, ok := m.(*rtr.RTREndOfData)
+			Expect(ok).To(Equal, true)
+		})
+	})
+}
+
+func TestMaxQueryRate(t *testing.T) {
+	_, f := prepareOn(42437, "", []string{
+		"route:  10.0.0.0/8\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, scanner := connectRTRServer(42437)
+	defer r.conn.Close()
+
+	commandOpts.MaxQueryRate = 3
+	defer func() { commandOpts.MaxQueryRate = 0 }()
+
+	Context("When a router floods the cache with queries", func() {
+		buf := []byte{}
+		for i := 0; i < 5; i++ {
+			pdu, _ := rtr.NewRTRSerialQuery(r.sessionId, 0).Serialize()
+			buf = append(buf, pdu...)
+		}
+		r.conn.Write(buf)
+
+		responses := 0
+		var errorReport *rtr.RTRErrorReport
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			switch msg := m.(type) {
+			case *rtr.RTREndOfData, *rtr.RTRCacheReset:
+				responses++
+			case *rtr.RTRErrorReport:
+				errorReport = msg
+			}
+		}
+		It("should answer queries up to the limit, and then send Error Report PDU and close the session", func() {
+			Expect(responses).To(Equal, 3)
+			Expect(errorReport != nil).To(Equal, true)
+			Expect(errorReport.ErrorCode).To(Equal, uint16(rtr.INVALID_REQUEST))
+		})
+	})
+}
+
+func TestFullSyncJitter(t *testing.T) {
+	_, f := prepareOn(42438, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+
+	max := 200 * time.Millisecond
+	commandOpts.FullSyncJitter = max
+	defer func() { commandOpts.FullSyncJitter = 0 }()
+
+	Context("When full synchronization jitter is enabled", func() {
+		r, scanner := connectRTRServer(42438)
+		defer r.conn.Close()
+
+		var total time.Duration
+		bounded := true
+		for i := 0; i < 5; i++ {
+			start := time.Now()
+			r.sendPDU(rtr.NewRTRResetQuery())
+			for scanner.Scan() {
+				m, _ := rtr.ParseRTR(scanner.Bytes())
+				if _, ok := m.(*rtr.RTRCacheResponse); ok {
+					break
+				}
+			}
+			elapsed := time.Since(start)
+			total += elapsed
+			bounded = bounded && elapsed < max+100*time.Millisecond
+			for scanner.Scan() {
+				m, _ := rtr.ParseRTR(scanner.Bytes())
+				if _, ok := m.(*rtr.RTREndOfData); ok {
+					break
+				}
+			}
+		}
+		It("should start each full synchronization after a random delay up to the maximum", func() {
+			Expect(bounded).To(Equal, true)
+			Expect(total > 10*time.Millisecond).To(Equal, true)
+		})
+	})
+
+	Context("When the router goes away during the delay", func() {
+		commandOpts.FullSyncJitter = time.Hour
+		r, _ := connectRTRServer(42438)
+		addr := r.conn.LocalAddr().String()
+		for sessions.lookup(addr) == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+		r.sendPDU(rtr.NewRTRResetQuery())
+		time.Sleep(50 * time.Millisecond)
+		r.conn.Close()
+
+		reaped := false
+		for i := 0; i < 100 && !reaped; i++ {
+			time.Sleep(10 * time.Millisecond)
+			reaped = sessions.lookup(addr) == nil
+		}
+		It("should cancel the delay and finish the session", func() {
+			Expect(reaped).To(Equal, true)
+		})
+	})
+}
+
+type fakeSocketBuffers struct {
+	rcvbuf, sndbuf int
+}
+
+func (b *fakeSocketBuffers) SetReadBuffer(bytes int) error {
+	b.rcvbuf = bytes
+	return nil
+}
+
+func (b *fakeSocketBuffers) SetWriteBuffer(bytes int) error {
+	b.sndbuf = bytes
+	return nil
+}
+
+func TestSetSocketBuffers(t *testing.T) {
+	Context("When socket buffer sizes are not specified", func() {
+		b := &fakeSocketBuffers{}
+		setSocketBuffers(b)
+		It("should leave the OS defaults", func() {
+			Expect(*b).To(Equal, fakeSocketBuffers{})
+		})
+	})
+
+	Context("When socket buffer sizes are specified", func() {
+		commandOpts.SoRcvbuf = 65536
+		commandOpts.SoSndbuf = 4194304
+		defer func() {
+			commandOpts.SoRcvbuf = 0
+			commandOpts.SoSndbuf = 0
+		}()
+		b := &fakeSocketBuffers{}
+		setSocketBuffers(b)
+		It("should apply them to the connection", func() {
+			Expect(*b).To(Equal, fakeSocketBuffers{rcvbuf: 65536, sndbuf: 4194304})
+		})
+	})
+}
+
+func TestStandby(t *testing.T) {
+	rpslFile, _ := ioutil.TempFile(os.TempDir(), "rtr_test.db")
+	defer os.Remove(rpslFile.Name())
+	addRPSL(rpslFile, []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{rpslFile.Name()})
+
+	commandOpts.Standby = true
+	defer func() { commandOpts.Standby = false }()
+	s := newRTRServer(42439)
+	go s.run()
+
+	Context("When the server is standing by", func() {
+		time.Sleep(100 * time.Millisecond)
+		_, err := net.Dial("tcp", "127.0.0.1:42439")
+		It("should not accept connections", func() {
+			Expect(err != nil).To(Equal, true)
+		})
+	})
+
+	Context("When the server is promoted by the admin API", func() {
+		a := newAdminServer("", mgr)
+		a.rtrServer = s
+		w := httptest.NewRecorder()
+		a.mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/promote", nil))
+
+		r, scanner := connectRTRServer(42439)
+		defer r.conn.Close()
+		go handleRTR(<-s.connCh, mgr)
+		r.sendPDU(rtr.NewRTRResetQuery())
+		var endOfData *rtr.RTREndOfData
+		for endOfData == nil && scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			endOfData, _ = m.(*rtr.RTREndOfData)
+		}
+		It("should accept connections and serve the data", func() {
+			Expect(w.Code).To(Equal, http.StatusNoContent)
+			Expect(endOfData != nil).To(Equal, true)
+			Expect(endOfData.SerialNumber).To(Equal, mgr.CurrentSerial())
+		})
+	})
+}
+
+func TestFamilyPhases(t *testing.T) {
+	r, client := newConnPair()
+	defer r.conn.Close()
+	defer client.Close()
+
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	// mainLoop in quiet mode may have suppressed logs
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.InfoLevel)
+	defer logrus.SetLevel(level)
+	commandOpts.FamilyMarker = true
+	defer func() { commandOpts.FamilyMarker = false }()
+
+	lists := FakeROATable{
+		bgp.RF_IPv4_UC: map[uint8][]*FakeROA{
+			rtr.ANNOUNCEMENT: {{Prefix: net.ParseIP("192.168.0.0"), PrefixLen: 24, MaxLen: 24, AS: 65000}},
+		},
+		bgp.RF_IPv6_UC: map[uint8][]*FakeROA{
+			rtr.ANNOUNCEMENT: {{Prefix: net.ParseIP("2001:db8::"), PrefixLen: 32, MaxLen: 32, AS: 65000}},
+		},
+	}
+	phases := []bgp.RouteFamily{}
+	r.onFamilySent = func(rf bgp.RouteFamily) {
+		phases = append(phases, rf)
+	}
+	r.cacheResponse(1, lists, nil, 0)
+
+	messages := []string{}
+	for _, e := range hook.AllEntries() {
+		messages = append(messages, strings.SplitN(e.Message, " to ", 2)[0])
+	}
+
+	Context("When a response has both address families", func() {
+		It("should send them as distinct phases", func() {
+			Expect(phases).To(Equal, []bgp.RouteFamily{bgp.RF_IPv4_UC, bgp.RF_IPv6_UC})
+		})
+		It("should log the boundary of the phases", func() {
+			Expect(messages).To(Equal, []string{
+				"Sent Cache Response PDU",
+				"Sent IPv4 Prefix PDU(s)",
+				"Finished sending IPv4 Prefix PDUs",
+				"Sent IPv6 Prefix PDU(s)",
+				"Finished sending IPv6 Prefix PDUs",
+				"Sent End of Data PDU",
+			})
+		})
+	})
+}
+
+// fakeClock records waits instead of sleeping.
+type fakeClock struct {
+	slept []time.Duration
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.slept = append(c.slept, d)
+}
+
+func TestFamilyDelay(t *testing.T) {
+	r, client := newConnPair()
+	defer r.conn.Close()
+	defer client.Close()
+
+	lists := FakeROATable{
+		bgp.RF_IPv4_UC: map[uint8][]*FakeROA{
+			rtr.ANNOUNCEMENT: {{Prefix: net.ParseIP("192.168.0.0"), PrefixLen: 24, MaxLen: 24, AS: 65000}},
+		},
+		bgp.RF_IPv6_UC: map[uint8][]*FakeROA{
+			rtr.ANNOUNCEMENT: {{Prefix: net.ParseIP("2001:db8::"), PrefixLen: 32, MaxLen: 32, AS: 65000}},
+		},
+	}
+	clock := &fakeClock{}
+	r.clock = clock
+	// The phases sent before each wait
+	sleptAfter := []int{}
+	phases := []bgp.RouteFamily{}
+	r.onFamilySent = func(rf bgp.RouteFamily) {
+		phases = append(phases, rf)
+		sleptAfter = append(sleptAfter, len(clock.slept))
+	}
+
+	Context("Without --family-delay", func() {
+		r.cacheResponse(1, lists, nil, 0)
+		It("should not wait", func() {
+			Expect(clock.slept).To(Equal, []time.Duration(nil))
+		})
+	})
+
+	commandOpts.FamilyDelay = 3 * time.Second
+	defer func() { commandOpts.FamilyDelay = 0 }()
+	clock.slept = nil
+	phases = phases[:0]
+	sleptAfter = sleptAfter[:0]
+
+	Context("With --family-delay", func() {
+		r.cacheResponse(1, lists, nil, 0)
+		It("should wait once between IPv4 and IPv6", func() {
+			Expect(clock.slept).To(Equal, []time.Duration{3 * time.Second})
+			Expect(phases).To(Equal, []bgp.RouteFamily{bgp.RF_IPv4_UC, bgp.RF_IPv6_UC})
+			Expect(sleptAfter).To(Equal, []int{0, 1})
+		})
+	})
+}
+
+func TestFutureSerial(t *testing.T) {
+	_, f := prepareOn(42440, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, scanner := connectRTRServer(42440)
+	defer r.conn.Close()
+
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	// mainLoop in quiet mode has suppressed warnings
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	defer logrus.SetLevel(level)
+
+	exchange := func(pdu rtr.RTRMessage) rtr.RTRMessage {
+		r.sendPDU(pdu)
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			switch m.(type) {
+			case *rtr.RTREndOfData, *rtr.RTRCacheReset:
+				return m
+			}
+		}
+		return nil
+	}
+	endOfData := exchange(rtr.NewRTRResetQuery()).(*rtr.RTREndOfData)
+
+	Context("When a router reports our session ID with a serial newer than ours", func() {
+		m := exchange(rtr.NewRTRSerialQuery(endOfData.SessionID, endOfData.SerialNumber+100))
+		warned := false
+		for _, e := range hook.AllEntries() {
+			warned = warned || strings.Contains(e.Message, "may have been rolled back")
+		}
+		It("should send Cache Reset PDU and warn about a rollback", func() {
+			_, ok := m.(*rtr.RTRCacheReset)
+			Expect(ok).To(Equal, true)
+			Expect(warned).To(Equal, true)
+		})
+	})
+}
+
+func TestRepeatReset(t *testing.T) {
+	mgr, f := prepareOn(42441, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, scanner := connectRTRServer(42441)
+	defer r.conn.Close()
+
+	commandOpts.RepeatReset = time.Hour
+	defer func() { commandOpts.RepeatReset = 0 }()
+
+	resetQuery := func() (int, *rtr.RTREndOfData) {
+		r.sendPDU(rtr.NewRTRResetQuery())
+		prefixes := 0
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			switch msg := m.(type) {
+			case *rtr.RTRIPPrefix:
+				prefixes++
+			case *rtr.RTREndOfData:
+				return prefixes, msg
+			}
+		}
+		return prefixes, nil
+	}
+	first, endOfData := resetQuery()
+
+	Context("When a router sends Reset Query again without any change", func() {
+		prefixes, repeated := resetQuery()
+		It("should answer it without ROAs", func() {
+			Expect(first).To(Equal, 1)
+			Expect(prefixes).To(Equal, 0)
+			Expect(repeated.SerialNumber).To(Equal, endOfData.SerialNumber)
+		})
+	})
+
+	Context("When a router sends Reset Query again after a change", func() {
+		ioutil.WriteFile(f.Name(), []byte("route:  192.168.1.0/24\norigin: AS65000\nsource: TEST\n\n"), 0644)
+		mgr.Reload()
+		prefixes, _ := resetQuery()
+		It("should send all ROAs", func() {
+			Expect(prefixes).To(Equal, 1)
+		})
+	})
+}
+
+func TestFinalSerial(t *testing.T) {
+	_, f := prepareOn(42442, "", []string{
+		"route:  10.0.0.0/8\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, scanner := connectRTRServer(42442)
+	defer r.conn.Close()
+
+	var endOfData *rtr.RTREndOfData
+	r.sendPDU(rtr.NewRTRResetQuery())
+	for endOfData == nil && scanner.Scan() {
+		m, _ := rtr.ParseRTR(scanner.Bytes())
+		endOfData, _ = m.(*rtr.RTREndOfData)
+	}
+
+	commandOpts.FinalSerial = true
+	commandOpts.MaxQueryRate = 1
+	defer func() {
+		commandOpts.FinalSerial = false
+		commandOpts.MaxQueryRate = 0
+	}()
+
+	Context("When the cache closes the session", func() {
+		// The second query exceeds the limit
+		r.sendPDU(rtr.NewRTRSerialQuery(endOfData.SessionID, endOfData.SerialNumber))
+		r.sendPDU(rtr.NewRTRSerialQuery(endOfData.SessionID, endOfData.SerialNumber))
+		var errorReport *rtr.RTRErrorReport
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			if msg, ok := m.(*rtr.RTRErrorReport); ok {
+				errorReport = msg
+			}
+		}
+		It("should tell the serial number last sent in Error Report PDU", func() {
+			Expect(errorReport != nil).To(Equal, true)
+			Expect(string(errorReport.Text)).To(Equal, fmt.Sprintf("Closing the session at SN %d", endOfData.SerialNumber))
+		})
+	})
+
+	Context("When the cache shuts down", func() {
+		f := createFile("TestFinalSerial", []string{
+			"route:  10.0.0.0/8\n",
+			"origin: AS65000\n",
+			"source: TEST\n",
+			"\n",
+		})
+		defer removeFile(f)
+		mgr := NewResourceManager(false)
+		mgr.Load([]string{f})
+		r, client := newConnPair()
+		defer client.Close()
+		stopCh := make(chan struct{})
+		r.stopCh = stopCh
+		go handleRTR(r, mgr)
+
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		scanner := bufio.NewScanner(client)
+		scanner.Split(rtr.SplitRTR)
+		buf, _ := rtr.NewRTRResetQuery().Serialize()
+		client.Write(buf)
+		var endOfData *rtr.RTREndOfData
+		for endOfData == nil && scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			endOfData, _ = m.(*rtr.RTREndOfData)
+		}
+		close(stopCh)
+		var errorReport *rtr.RTRErrorReport
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			if msg, ok := m.(*rtr.RTRErrorReport); ok {
+				errorReport = msg
+			}
+		}
+		It("should tell the serial number last sent in Error Report PDU", func() {
+			Expect(errorReport != nil).To(Equal, true)
+			Expect(string(errorReport.Text)).To(Equal, fmt.Sprintf("Closing the session at SN %d", endOfData.SerialNumber))
+		})
+	})
+}
+
+func TestProtocolVersion1(t *testing.T) {
+	_, f := prepareOn(42443, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	commandOpts.Refresh, commandOpts.Retry, commandOpts.Expire = 1800, 300, 3600
+	defer func() {
+		commandOpts.MaxVersion = 0
+		commandOpts.Refresh, commandOpts.Retry, commandOpts.Expire = 0, 0, 0
+	}()
+
+	resetQueryV1 := func() [][]byte {
+		r, scanner := connectRTRServer(42443)
+		defer r.conn.Close()
+		pdu := rtr.NewRTRResetQuery()
+		pdu.Version = 1
+		r.sendPDU(pdu)
+		pdus := [][]byte{}
+		for scanner.Scan() {
+			buf := append([]byte{}, scanner.Bytes()...)
+			pdus = append(pdus, buf)
+			if buf[1] == rtr.RTR_END_OF_DATA || buf[1] == rtr.RTR_ERROR_REPORT {
+				break
+			}
+		}
+		return pdus
+	}
+
+	Context("When a router sends Reset Query of version 1", func() {
+		commandOpts.MaxVersion = 1
+		pdus := resetQueryV1()
+		versions := []uint8{}
+		for _, pdu := range pdus {
+			versions = append(versions, pdu[0])
+		}
+		endOfData := &rtrEndOfDataV1{}
+		err := endOfData.DecodeFromBytes(pdus[len(pdus)-1])
+		It("should answer with PDUs of version 1", func() {
+			Expect(versions).To(Equal, []uint8{1, 1, 1})
+		})
+		It("should send End of Data PDU with the timing parameters", func() {
+			Expect(err).To(Equal, nil)
+			Expect(len(pdus[len(pdus)-1])).To(Equal, rtrEndOfDataV1Len)
+			Expect(endOfData.RefreshInterval).To(Equal, uint32(1800))
+			Expect(endOfData.RetryInterval).To(Equal, uint32(300))
+			Expect(endOfData.ExpireInterval).To(Equal, uint32(3600))
+		})
+	})
+
+	Context("When a router sends Reset Query of version 1 to the cache serving only version 0", func() {
+		commandOpts.MaxVersion = 0
+		pdus := resetQueryV1()
+		m, _ := rtr.ParseRTR(pdus[0])
+		It("should send Error Report PDU with unsupported protocol version", func() {
+			rtrMsg, ok := m.(*rtr.RTRErrorReport)
+			Expect(ok).To(Equal, true)
+			Expect(rtrMsg.ErrorCode).To(Equal, rtr.UNSUPPORTED_PROTOCOL_VERSION)
+		})
+	})
+
+	Context("When a router sends Reset Query of version 0 to the cache with --min-version=1", func() {
+		commandOpts.MaxVersion, commandOpts.MinVersion = 1, 1
+		defer func() { commandOpts.MinVersion = 0 }()
+		r, scanner := connectRTRServer(42443)
+		defer r.conn.Close()
+		r.sendPDU(rtr.NewRTRResetQuery())
+		pdus := [][]byte{}
+		for scanner.Scan() {
+			pdus = append(pdus, append([]byte{}, scanner.Bytes()...))
+		}
+		It("should send Error Report PDU of version 1 with unsupported protocol version, and close", func() {
+			Expect(len(pdus)).To(Equal, 1)
+			Expect(pdus[0][0]).To(Equal, uint8(1))
+			Expect(pdus[0][1]).To(Equal, uint8(rtr.RTR_ERROR_REPORT))
+			Expect(binary.BigEndian.Uint16(pdus[0][2:4])).To(Equal, rtr.UNSUPPORTED_PROTOCOL_VERSION)
+		})
+	})
+}
+
+func TestCheckTimers(t *testing.T) {
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	// mainLoop in quiet mode may have suppressed warnings
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	defer logrus.SetLevel(level)
+
+	Context("When the timers are the defaults", func() {
+		err := checkTimers(3600, 600, 7200)
+		It("should accept them without warnings", func() {
+			Expect(err).To(Equal, nil)
+			Expect(len(hook.AllEntries())).To(Equal, 0)
+		})
+	})
+
+	Context("When the expire interval is not longer than the others", func() {
+		It("should reject them", func() {
+			Expect(checkTimers(3600, 600, 3600) != nil).To(Equal, true)
+			Expect(checkTimers(300, 900, 600) != nil).To(Equal, true)
+		})
+	})
+
+	Context("When a timer is out of the recommended range", func() {
+		hook.Reset()
+		err := checkTimers(100000, 600, 172800)
+		It("should accept them with a warning", func() {
+			Expect(err).To(Equal, nil)
+			Expect(len(hook.AllEntries())).To(Equal, 1)
+		})
+	})
+}
+
+func TestRFToIPVer(t *testing.T) {
+	Context("with bgp.RF_IPv4_UC", func() {
+		It("should convert to \"IPv4\"", func() {
+			Expect(RFToIPVer(bgp.RF_IPv4_UC)).To(Equal, "IPv4")
+		})
+	})
+
+	Context("with bgp.RF_IPv6_UC", func() {
+		It("should convert to \"IPv6\"", func() {
+			Expect(RFToIPVer(bgp.RF_IPv6_UC)).To(Equal, "IPv6")
+		})
+	})
+
+	Context("with unsupported RouteFamily", func() {
+		It("should convert to \"Unsupported\"", func() {
+			Expect(RFToIPVer(bgp.RF_EVPN)).To(Equal, "Unsupported")
+		})
+	})
+}
+
+func TestMalformedPDU(t *testing.T) {
+	_, f := prepareOn(42444, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+
+	Context("When a router sends a PDU of an unknown version followed by Reset Query", func() {
+		r, scanner := connectRTRServer(42444)
+		defer r.conn.Close()
+		bad, _ := rtr.NewRTRResetQuery().Serialize()
+		bad[0] = 2
+		good, _ := rtr.NewRTRResetQuery().Serialize()
+		r.conn.Write(append(bad, good...))
+
+		pdus := [][]byte{}
+		for scanner.Scan() {
+			pdus = append(pdus, append([]byte{}, scanner.Bytes()...))
+		}
+		It("should send only one Error Report PDU and close the session", func() {
+			Expect(len(pdus)).To(Equal, 1)
+			Expect(pdus[0][1]).To(Equal, uint8(rtr.RTR_ERROR_REPORT))
+		})
+	})
+}
+
+func TestImplausibleVersion(t *testing.T) {
+	f := createFile("TestImplausibleVersion", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(f)
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{f})
+
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	// mainLoop in quiet mode may have suppressed warnings
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	defer logrus.SetLevel(level)
+
+	// session synchronizes a router, sends a Reset Query of the version, and
+	// returns PDUs received after the synchronization.
+	session := func(version uint8) [][]byte {
+		r, client := newConnPair()
+		defer client.Close()
+		go handleRTR(r, mgr)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		scanner := bufio.NewScanner(client)
+		scanner.Split(rtr.SplitRTR)
+		good, _ := rtr.NewRTRResetQuery().Serialize()
+		client.Write(good)
+		for scanner.Scan() {
+			if scanner.Bytes()[1] == rtr.RTR_END_OF_DATA {
+				break
+			}
+		}
+		bad, _ := rtr.NewRTRResetQuery().Serialize()
+		bad[0] = version
+		client.Write(bad)
+		pdus := [][]byte{}
+		for scanner.Scan() {
+			pdus = append(pdus, append([]byte{}, scanner.Bytes()...))
+		}
+		return pdus
+	}
+
+	Context("When a router sends a PDU of a plausible future version", func() {
+		hook.Reset()
+		pdus := session(2)
+		It("should send Error Report PDU with unsupported protocol version", func() {
+			Expect(len(pdus)).To(Equal, 1)
+			Expect(pdus[0][1]).To(Equal, uint8(rtr.RTR_ERROR_REPORT))
+			Expect(binary.BigEndian.Uint16(pdus[0][2:4])).To(Equal, rtr.UNSUPPORTED_PROTOCOL_VERSION)
+			Expect(len(hook.AllEntries())).To(Equal, 0)
+		})
+	})
+
+	Context("When a router sends a PDU of a garbage version byte", func() {
+		hook.Reset()
+		pdus := session(0xff)
+		It("should close the connection without any PDU, and log it", func() {
+			Expect(len(pdus)).To(Equal, 0)
+			Expect(len(hook.AllEntries())).To(Equal, 1)
+			Expect(hook.LastEntry().Level).To(Equal, logrus.WarnLevel)
+		})
+	})
+
+	Context("When --future-versions takes the version as plausible", func() {
+		commandOpts.FutureVers = 1
+		defer func() { commandOpts.FutureVers = 0 }()
+		hook.Reset()
+		pdus := session(3)
+		It("should send Error Report PDU with unsupported protocol version", func() {
+			Expect(len(pdus)).To(Equal, 1)
+			Expect(binary.BigEndian.Uint16(pdus[0][2:4])).To(Equal, rtr.UNSUPPORTED_PROTOCOL_VERSION)
+		})
+	})
+}
+
+func TestNonRTRClient(t *testing.T) {
+	_, f := prepareOn(42445, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+	r, scanner := connectRTRServer(42445)
+	defer r.conn.Close()
+
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	// mainLoop in quiet mode has suppressed warnings
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	defer logrus.SetLevel(level)
+
+	Context("When a client sends an HTTP request", func() {
+		start := time.Now()
+		r.conn.SetReadDeadline(start.Add(5 * time.Second))
+		r.conn.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+		received := 0
+		for scanner.Scan() {
+			received++
+		}
+		It("should close the connection without any PDU", func() {
+			Expect(scanner.Err()).To(Equal, nil)
+			Expect(received).To(Equal, 0)
+			Expect(time.Since(start) < time.Second).To(Equal, true)
+		})
+		It("should log the close", func() {
+			Expect(len(hook.AllEntries())).To(Equal, 1)
+			Expect(hook.LastEntry().Level).To(Equal, logrus.WarnLevel)
+		})
+	})
+}
+
+func TestNoDataLoaded(t *testing.T) {
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{})
+	r, client := newConnPair()
+	defer client.Close()
+	go handleRTR(r, mgr)
+
+	scanner := bufio.NewScanner(bufio.NewReader(client))
+	scanner.Split(rtr.SplitRTR)
+	exchange := func(pdu rtr.RTRMessage) rtr.RTRMessage {
+		buf, _ := pdu.Serialize()
+		client.Write(buf)
+		scanner.Scan()
+		m, _ := rtr.ParseRTR(scanner.Bytes())
+		return m
+	}
+
+	Context("When the cache has started without any source", func() {
+		It("should have no data", func() {
+			Expect(mgr.HasData()).To(Equal, false)
+		})
+	})
+
+	Context("When a router sends Reset Query before any data is loaded", func() {
+		m := exchange(rtr.NewRTRResetQuery())
+		It("should receive Error Report PDU with no data available", func() {
+			rtrMsg, ok := m.(*rtr.RTRErrorReport)
+			Expect(ok).To(Equal, true)
+			Expect(rtrMsg.ErrorCode).To(Equal, rtr.NO_DATA_AVAILABLE)
+		})
+	})
+
+	Context("When a router sends Serial Query before any data is loaded", func() {
+		m := exchange(rtr.NewRTRSerialQuery(r.sessionId, 1))
+		It("should receive Error Report PDU with no data available", func() {
+			rtrMsg, ok := m.(*rtr.RTRErrorReport)
+			Expect(ok).To(Equal, true)
+			Expect(rtrMsg.ErrorCode).To(Equal, rtr.NO_DATA_AVAILABLE)
+		})
+	})
+}
+
+func TestMaxErrorReports(t *testing.T) {
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{})
+	commandOpts.MaxErrReports = 3
+	defer func() { commandOpts.MaxErrReports = 0 }()
+
+	// flood sends PDUs at once, and returns the Error Report PDUs received
+	// until the session is closed.
+	flood := func(pdu []byte, n int) []*rtr.RTRErrorReport {
+		r, client := newConnPair()
+		defer client.Close()
+		go handleRTR(r, mgr)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		client.Write(bytes.Repeat(pdu, n))
+
+		scanner := bufio.NewScanner(client)
+		scanner.Split(rtr.SplitRTR)
+		reports := []*rtr.RTRErrorReport{}
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			if report, ok := m.(*rtr.RTRErrorReport); ok {
+				reports = append(reports, report)
+			}
+		}
+		return reports
+	}
+
+	Context("When a router floods the cache with queries it can't answer", func() {
+		pdu, _ := rtr.NewRTRSerialQuery(1, 1).Serialize()
+		reports := flood(pdu, 10)
+		It("should send Error Report PDUs up to the limit, and close the session", func() {
+			Expect(len(reports)).To(Equal, 3)
+			Expect(reports[2].ErrorCode).To(Equal, uint16(rtr.NO_DATA_AVAILABLE))
+		})
+	})
+
+	Context("When a router floods the cache with malformed PDUs", func() {
+		pdu, _ := rtr.NewRTRResetQuery().Serialize()
+		pdu[1] = 99
+		reports := flood(pdu, 100)
+		It("should send only one Error Report PDU, and close the session", func() {
+			Expect(len(reports)).To(Equal, 1)
+			Expect(reports[0].ErrorCode).To(Equal, uint16(rtr.INVALID_REQUEST))
+		})
+	})
+}
+
+// fullSyncBytes returns the bytes sent by a full synchronization with or
+// without --cache-full-sync.
+func fullSyncBytes(mgr *ResourceManager, cached bool) []byte {
+	r, client := newConnPair()
+	defer r.conn.Close()
+	defer client.Close()
+
+	go func() {
+		if cached {
+			r.cachedResponse(mgr.FullSync(r.peerVersion()), nil)
+			return
+		}
+		list := mgr.CurrentList()
+		sortFakeROATable(list, commandOpts.Sort)
+		r.cacheResponse(mgr.CurrentSerial(), list, nil, 0)
+	}()
+	// Read until End of Data PDU
+	scanner := bufio.NewScanner(client)
+	scanner.Split(rtr.SplitRTR)
+	buf := []byte{}
+	for scanner.Scan() {
+		buf = append(buf, scanner.Bytes()...)
+		if m, _ := rtr.ParseRTR(scanner.Bytes()); m != nil {
+			if _, ok := m.(*rtr.RTREndOfData); ok {
+				break
+			}
+		}
+	}
+	return buf
+}
+
+func TestCacheFullSync(t *testing.T) {
+	content := []string{}
+	for i := 0; i < 100; i++ {
+		content = append(content, fmt.Sprintf("route:  10.0.%d.0/24\norigin: AS%d\nsource: TEST\n\n", i, 65000+i))
+		content = append(content, fmt.Sprintf("route6: 2001:db8:%x::/48\norigin: AS%d\nsource: TEST\n\n", i, 65000+i))
+	}
+	f := createFile("TestCacheFullSync", content)
+	defer removeFile(f)
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{f})
+
+	Context("When the full synchronization is served from the cache", func() {
+		expected := fullSyncBytes(mgr, false)
+		It("should send the same bytes as serialized for each router", func() {
+			Expect(len(expected) > 200*20).To(Equal, true)
+			Expect(fullSyncBytes(mgr, true)).To(Equal, expected)
+		})
+		It("should serialize once per serial", func() {
+			Expect(mgr.FullSync(0) == mgr.FullSync(0)).To(Equal, true)
+		})
+	})
+
+	Context("When the data has been reloaded", func() {
+		prev := mgr.FullSync(0)
+		fd, _ := os.OpenFile(f, os.O_APPEND|os.O_WRONLY, 0644)
+		addRPSL(fd, []string{"route:  192.168.0.0/24\norigin: AS65000\nsource: TEST\n\n"})
+		fd.Close()
+		mgr.Reload()
+		It("should not send the stale cache", func() {
+			s := mgr.FullSync(0)
+			Expect(s == prev).To(Equal, false)
+			Expect(s.sn).To(Equal, mgr.CurrentSerial())
+			Expect(s.roas()).To(Equal, 201)
+			Expect(fullSyncBytes(mgr, true)).To(Equal, fullSyncBytes(mgr, false))
+		})
+	})
+}
+
+func BenchmarkFullSync(b *testing.B) {
+	content := []string{}
+	for i := 0; i < 10000; i++ {
+		content = append(content, fmt.Sprintf("route: 10.%d.%d.0/24\norigin: AS%d\nsource: TEST\n\n", i/256, i%256, 65000+i%1000))
+	}
+	f := createFile("BenchmarkFullSync", content)
+	defer removeFile(f)
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{f})
+
+	r, client := newConnPair()
+	defer r.conn.Close()
+	defer client.Close()
+	go io.Copy(ioutil.Discard, client)
+	// Logging each response would dominate the time
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	defer logrus.SetLevel(level)
+
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			list := mgr.CurrentList()
+			sortFakeROATable(list, commandOpts.Sort)
+			if err := r.cacheResponse(mgr.CurrentSerial(), list, nil, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := r.cachedResponse(mgr.FullSync(r.peerVersion()), nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestIdleTimeout(t *testing.T) {
+	f := createFile("TestIdleTimeout", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(f)
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{f})
+
+	Context("Without --idle-timeout", func() {
+		r := &rtrConn{}
+		commandOpts.Expire = 600
+		defer func() { commandOpts.Expire = 0 }()
+		It("should wait for routers of version 1 for the Expire Interval", func() {
+			Expect(r.idleTimeout()).To(Equal, time.Duration(0))
+			r.version = 1
+			Expect(r.idleTimeout()).To(Equal, 600*time.Second)
+		})
+	})
+
+	commandOpts.IdleTimeout = 300 * time.Millisecond
+	defer func() { commandOpts.IdleTimeout = 0 }()
+
+	Context("When the router keeps sending queries", func() {
+		r, client := newConnPair()
+		defer client.Close()
+		exited := make(chan struct{})
+		go func() {
+			handleRTR(r, mgr)
+			close(exited)
+		}()
+		scanner := bufio.NewScanner(client)
+		scanner.Split(rtr.SplitRTR)
+		query := func() bool {
+			pdu, _ := rtr.NewRTRResetQuery().Serialize()
+			client.Write(pdu)
+			for scanner.Scan() {
+				if m, _ := rtr.ParseRTR(scanner.Bytes()); m != nil {
+					if _, ok := m.(*rtr.RTREndOfData); ok {
+						return true
+					}
+				}
+			}
+			return false
+		}
+		alive := true
+		for i := 0; i < 4; i++ {
+			time.Sleep(150 * time.Millisecond)
+			alive = alive && query()
+		}
+		It("should keep the session", func() {
+			Expect(alive).To(Equal, true)
+		})
+
+		start := time.Now()
+		var eof bool
+		select {
+		case <-exited:
+			eof = !scanner.Scan()
+		case <-time.After(5 * time.Second):
+		}
+		It("should close the idle session", func() {
+			Expect(eof).To(Equal, true)
+			Expect(time.Since(start) < 2*time.Second).To(Equal, true)
+			Expect(sessions.lookup(r.remoteAddr.String()) == nil).To(Equal, true)
+		})
+	})
+}
+
+func TestMaxSessions(t *testing.T) {
+	commandOpts.MaxSessions = 1
+	defer func() { commandOpts.MaxSessions = 0 }()
+	_, f := prepareOn(42454, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+
+	resetQuery := func(r *rtrConn, scanner *bufio.Scanner) bool {
+		pdu, _ := rtr.NewRTRResetQuery().Serialize()
+		r.conn.Write(pdu)
+		for scanner.Scan() {
+			if m, _ := rtr.ParseRTR(scanner.Bytes()); m != nil {
+				if _, ok := m.(*rtr.RTREndOfData); ok {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	first, firstScanner := connectRTRServer(42454)
+	rejected := sessionsRejected.Value()
+
+	Context("When the sessions have reached --max-sessions", func() {
+		synced := resetQuery(first, firstScanner)
+		second, scanner := connectRTRServer(42454)
+		defer second.conn.Close()
+		It("should close a new connection", func() {
+			Expect(synced).To(Equal, true)
+			Expect(resetQuery(second, scanner)).To(Equal, false)
+			Expect(sessionsRejected.Value()).To(Equal, rejected+1)
+		})
+	})
+
+	Context("When a session has finished", func() {
+		first.conn.Close()
+		var synced bool
+		for i := 0; i < 50 && !synced; i++ {
+			time.Sleep(20 * time.Millisecond)
+			r, scanner := connectRTRServer(42454)
+			synced = resetQuery(r, scanner)
+			r.conn.Close()
+		}
+		It("should accept a new connection", func() {
+			Expect(synced).To(Equal, true)
+		})
+	})
+}
+
+func TestAllowFrom(t *testing.T) {
+	Context("When --allow-from has IPv4 and IPv6 prefixes", func() {
+		allowlist, err := parseAllowlist([]string{"127.0.0.2/32", "2001:db8::/32"})
+		s := &rtrServer{allowlist: allowlist}
+		It("should allow only routers in them", func() {
+			Expect(err).To(Equal, nil)
+			Expect(s.allowed(&net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 1})).To(Equal, true)
+			Expect(s.allowed(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1})).To(Equal, true)
+			Expect(s.allowed(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1})).To(Equal, false)
+			Expect(s.allowed(&net.TCPAddr{IP: net.ParseIP("2001:db9::1"), Port: 1})).To(Equal, false)
+		})
+	})
+
+	Context("Without --allow-from", func() {
+		s := &rtrServer{}
+		It("should allow all routers", func() {
+			Expect(s.allowed(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1})).To(Equal, true)
+		})
+	})
+
+	Context("When --allow-from has an invalid CIDR", func() {
+		_, err := parseAllowlist([]string{"127.0.0.1"})
+		It("should fail", func() {
+			Expect(err == nil).To(Equal, false)
+		})
+	})
+
+	commandOpts.AllowFrom = []string{"127.0.0.2/32"}
+	defer func() { commandOpts.AllowFrom = nil }()
+	_, f := prepareOn(42456, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+
+	resetQuery := func(localIP string) bool {
+		r, scanner := dialRTRServerFrom(localIP, 42456)
+		defer r.conn.Close()
+		r.sendPDU(rtr.NewRTRResetQuery())
+		for scanner.Scan() {
+			if m, _ := rtr.ParseRTR(scanner.Bytes()); m != nil {
+				if _, ok := m.(*rtr.RTREndOfData); ok {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	Context("When routers connect to the server", func() {
+		It("should close the connection from a router not allowed", func() {
+			Expect(resetQuery("127.0.0.2")).To(Equal, true)
+			Expect(resetQuery("127.0.0.1")).To(Equal, false)
+		})
+	})
+}
+
+func BenchmarkSendPrefixes(b *testing.B) {
+	roas := make([]*FakeROA, 0, 500000)
+	for i := 0; i < 500000; i++ {
+		roas = append(roas, &FakeROA{Prefix: net.IPv4(byte(10+i>>16), byte(i>>8), byte(i), 0), PrefixLen: 24, MaxLen: 24, AS: 65000})
+	}
+	lists := FakeROATable{
+		bgp.RF_IPv4_UC: map[uint8][]*FakeROA{rtr.ANNOUNCEMENT: roas},
+		bgp.RF_IPv6_UC: map[uint8][]*FakeROA{},
+	}
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	defer logrus.SetLevel(level)
+
+	for _, size := range []int{16, writeBufferSize} {
+		// A buffer smaller than a PDU writes each PDU by a syscall as
+		// before the buffer was added
+		name := "buffered"
+		if size < writeBufferSize {
+			name = "per-pdu"
+		}
+		b.Run(name, func(b *testing.B) {
+			r, client := newConnPair()
+			defer r.conn.Close()
+			defer client.Close()
+			go io.Copy(ioutil.Discard, client)
+			r.w = bufio.NewWriterSize(r.conn, size)
+			for i := 0; i < b.N; i++ {
+				if err := r.cacheResponse(1, lists, nil, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionCause(t *testing.T) {
+	f := createFile("TestSessionCause", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(f)
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{f})
+
+	closedBy := func(cause string) int64 {
+		if v, ok := sessionsClosed.Get(cause).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	// session runs a session until it ends after the router does act
+	session := func(act func(client *net.TCPConn)) bool {
+		r, client := newConnPair()
+		defer client.Close()
+		exited := make(chan struct{})
+		go func() {
+			handleRTR(r, mgr)
+			close(exited)
+		}()
+		act(client)
+		select {
+		case <-exited:
+			return true
+		case <-time.After(5 * time.Second):
+			return false
+		}
+	}
+
+	Context("When the router closes the connection", func() {
+		before := closedBy(causeClientClose)
+		ended := session(func(client *net.TCPConn) {
+			client.Close()
+		})
+		It("should count the session as closed by the client", func() {
+			Expect(ended).To(Equal, true)
+			Expect(closedBy(causeClientClose)).To(Equal, before+1)
+		})
+	})
+
+	Context("When the router sends a PDU of an unknown type", func() {
+		before := closedBy(causeProtocolError)
+		ended := session(func(client *net.TCPConn) {
+			client.Write([]byte{0, 255, 0, 0, 0, 0, 0, 8})
+		})
+		It("should count the session as closed by a protocol error", func() {
+			Expect(ended).To(Equal, true)
+			Expect(closedBy(causeProtocolError)).To(Equal, before+1)
+		})
+	})
+
+	commandOpts.IdleTimeout = 100 * time.Millisecond
+	defer func() { commandOpts.IdleTimeout = 0 }()
+
+	Context("When the router is idle", func() {
+		before := closedBy(causeIdleTimeout)
+		ended := session(func(client *net.TCPConn) {})
+		It("should count the session as closed by the idle timeout", func() {
+			Expect(ended).To(Equal, true)
+			Expect(closedBy(causeIdleTimeout)).To(Equal, before+1)
+		})
+	})
+}
+
+func TestFinalErrorReport(t *testing.T) {
+	f := createFile("TestFinalErrorReport", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(f)
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{f})
+
+	// received reads PDUs until the cache closes the connection, or sends
+	// End of Data PDU if untilEOD
+	received := func(scanner *bufio.Scanner, untilEOD bool) []uint8 {
+		types := []uint8{}
+		for scanner.Scan() {
+			types = append(types, scanner.Bytes()[1])
+			if untilEOD && scanner.Bytes()[1] == rtr.RTR_END_OF_DATA {
+				break
+			}
+		}
+		return types
+	}
+	scannerOf := func(client *net.TCPConn) *bufio.Scanner {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		scanner := bufio.NewScanner(client)
+		scanner.Split(rtr.SplitRTR)
+		return scanner
+	}
+
+	Context("When the router disconnects cleanly after a full synchronization", func() {
+		r, client := newConnPair()
+		defer client.Close()
+		go handleRTR(r, mgr)
+		scanner := scannerOf(client)
+		buf, _ := rtr.NewRTRResetQuery().Serialize()
+		client.Write(buf)
+		synced := received(scanner, true)
+		client.CloseWrite()
+		It("should close the session without Error Report PDU", func() {
+			Expect(synced).To(Equal, []uint8{rtr.RTR_CACHE_RESPONSE, rtr.RTR_IPV4_PREFIX, rtr.RTR_END_OF_DATA})
+			Expect(received(scanner, false)).To(Equal, []uint8{})
+		})
+	})
+
+	Context("When a response has failed", func() {
+		r, client := newConnPair()
+		defer client.Close()
+		causes := []string{
+			r.failed(&net.OpError{Op: "write", Net: "tcp", Err: io.ErrClosedPipe}),
+			r.failed(io.EOF),
+			r.failed(errTooManyReports),
+			r.failed(fmt.Errorf("broken table")),
+		}
+		r.conn.Close()
+		It("should send Error Report PDU only for an internal error", func() {
+			Expect(causes).To(Equal, []string{causeWriteError, causeWriteError, causeProtocolError, causeInternalError})
+			Expect(received(scannerOf(client), false)).To(Equal, []uint8{rtr.RTR_ERROR_REPORT})
+		})
+	})
+}
+
+func TestLazyLoad(t *testing.T) {
+	commandOpts.LazyLoad = true
+	// The raw cache tells whether the source has been read
+	commandOpts.RawCacheSize = 1024
+	defer func() { commandOpts.LazyLoad, commandOpts.RawCacheSize = false, 0 }()
+	_, f := prepareOn(42457, "", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer os.Remove(f.Name())
+
+	Context("Before any router connects", func() {
+		time.Sleep(200 * time.Millisecond)
+		It("should not read the source", func() {
+			Expect(rawSources.get(f.Name()) == nil).To(Equal, true)
+		})
+	})
+
+	Context("When the first router connects", func() {
+		r, scanner := connectRTRServer(42457)
+		defer r.conn.Close()
+		// The session waits for the source to be loaded rather than
+		// answering No Data Available
+		r.sendPDU(rtr.NewRTRResetQuery())
+		prefixes := 0
+	LOOP:
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			switch m.(type) {
+			case *rtr.RTRIPPrefix:
+				prefixes++
+			case *rtr.RTREndOfData:
+				break LOOP
+			case *rtr.RTRErrorReport:
+				prefixes = -1
+				break LOOP
+			}
+		}
+		It("should load the source and serve it to the first query", func() {
+			Expect(rawSources.get(f.Name()) == nil).To(Equal, false)
+			Expect(prefixes).To(Equal, 1)
+		})
+	})
+}
+
+func TestLazyLoadBySIGHUP(t *testing.T) {
+	commandOpts.LazyLoad = true
+	defer func() { commandOpts.LazyLoad = false }()
+	// Reading the FIFO blocks the load until the content is written
+	fifo := filepath.Join(os.TempDir(), "TestLazyLoadBySIGHUP")
+	os.Remove(fifo)
+	syscall.Mkfifo(fifo, 0644)
+	defer os.Remove(fifo)
+	sigCh := make(chan os.Signal, 1)
+	go mainLoop(NewResourceManager(false), []string{fifo}, 42459, "", false, true, sigCh)
+
+	Context("When a router connects while the first load by SIGHUP is running", func() {
+		sigCh <- syscall.SIGHUP
+		r, scanner := connectRTRServer(42459)
+		defer r.conn.Close()
+		r.sendPDU(rtr.NewRTRResetQuery())
+		go func() {
+			f, _ := os.OpenFile(fifo, os.O_WRONLY, 0)
+			addRPSL(f, []string{
+				"route:  192.168.0.0/24\n",
+				"origin: AS65000\n",
+				"source: TEST\n",
+				"\n",
+			})
+			f.Close()
+		}()
+		prefixes := 0
+	LOOP:
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			switch m.(type) {
+			case *rtr.RTRIPPrefix:
+				prefixes++
+			case *rtr.RTREndOfData:
+				break LOOP
+			case *rtr.RTRErrorReport:
+				prefixes = -1
+				break LOOP
+			}
+		}
+		It("should wait for the load and serve it", func() {
+			Expect(prefixes).To(Equal, 1)
+		})
+	})
+}
+
+func TestSessionStats(t *testing.T) {
+	f := createFile("TestSessionStats", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+		"route6: 2001:db8::/32\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(f)
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{f})
+
+	r, client := newConnPair()
+	defer client.Close()
+	go handleRTR(r, mgr)
+	scanner := bufio.NewScanner(client)
+	scanner.Split(rtr.SplitRTR)
+	exchange := func(pdu rtr.RTRMessage) rtr.RTRMessage {
+		buf, _ := pdu.Serialize()
+		client.Write(buf)
+		for scanner.Scan() {
+			m, _ := rtr.ParseRTR(scanner.Bytes())
+			switch m.(type) {
+			case *rtr.RTREndOfData, *rtr.RTRCacheReset:
+				return m
+			}
+		}
+		return nil
+	}
+
+	Context("When the router has synchronized and then queried the serial", func() {
+		endOfData := exchange(rtr.NewRTRResetQuery()).(*rtr.RTREndOfData)
+		exchange(rtr.NewRTRSerialQuery(endOfData.SessionID, endOfData.SerialNumber))
+		stats := r.loadStats()
+		It("should count the queries and Prefix PDUs, and keep the last serial", func() {
+			Expect(stats.ResetQueries).To(Equal, int64(1))
+			Expect(stats.SerialQueries).To(Equal, int64(1))
+			Expect(stats.PrefixesSent).To(Equal, int64(2))
+			Expect(stats.LastSerial).To(Equal, endOfData.SerialNumber)
+			Expect(stats.Duration).To(Equal, "0s")
+		})
+	})
+}
+
+// temporaryError is a net.Error like EAGAIN.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "resource temporarily unavailable" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyConn fails writes by a temporary error for the given times.
+type flakyConn struct {
+	*net.TCPConn
+	failures int
+}
+
+func (c *flakyConn) Write(b []byte) (int, error) {
+	if c.failures > 0 {
+		c.failures--
+		return 0, temporaryError{}
+	}
+	return c.TCPConn.Write(b)
+}
+
+func TestWriteRetries(t *testing.T) {
+	defer func() { commandOpts.WriteRetries = 0 }()
+
+	send := func(retries, failures int) (rtr.RTRMessage, error) {
+		commandOpts.WriteRetries = retries
+		r, client := newConnPair()
+		defer client.Close()
+		defer r.conn.Close()
+		r.conn = &flakyConn{TCPConn: r.conn.(*net.TCPConn), failures: failures}
+		err := r.sendPDU(rtr.NewRTRSerialNotify(r.sessionId, 1))
+		if err != nil {
+			return nil, err
+		}
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		scanner := bufio.NewScanner(client)
+		scanner.Split(rtr.SplitRTR)
+		scanner.Scan()
+		m, _ := rtr.ParseRTR(scanner.Bytes())
+		return m, nil
+	}
+
+	Context("When writes fail temporarily fewer times than --write-retries", func() {
+		retried := writeRetries.Value()
+		m, err := send(3, 2)
+		It("should send the PDU eventually", func() {
+			Expect(err).To(Equal, nil)
+			_, ok := m.(*rtr.RTRSerialNotify)
+			Expect(ok).To(Equal, true)
+			Expect(writeRetries.Value()-retried).To(Equal, int64(2))
+		})
+	})
+
+	Context("When writes fail temporarily more times than --write-retries", func() {
+		_, err := send(1, 2)
+		It("should give up", func() {
+			Expect(err).To(Equal, error(temporaryError{}))
+		})
+	})
+
+	Context("When --write-retries is not given", func() {
+		_, err := send(0, 1)
+		It("should not retry", func() {
+			Expect(err).To(Equal, error(temporaryError{}))
+		})
+	})
+}
+
+func TestASPA(t *testing.T) {
+	file := createFile("TestASPA", []string{`{
+		"roas":[{"prefix":"192.0.2.0/24","asn":"AS65000"}],
+		"aspas":[{"customer":"AS65000","providers":["AS65001","AS65002"]},{"customer":"AS65010","providers":["AS65011"]}]
+	}`})
+	defer removeFile(file)
+	commandOpts.ROAFiles = []string{file}
+	commandOpts.MaxVersion = 2
+	defer func() {
+		commandOpts.ROAFiles = nil
+		commandOpts.MaxVersion = 0
+	}()
+	mgr := NewResourceManager(false)
+	mgr.Load(nil)
+
+	type session struct {
+		client  *net.TCPConn
+		scanner *bufio.Scanner
+	}
+	connect := func() *session {
+		r, client := newConnPair()
+		go handleRTR(r, mgr)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		scanner := bufio.NewScanner(client)
+		scanner.Split(rtr.SplitRTR)
+		return &session{client: client, scanner: scanner}
+	}
+	// query sends a query of the version, and returns PDUs until End of Data
+	query := func(s *session, msg rtr.RTRMessage, version uint8) [][]byte {
+		buf, _ := msg.Serialize()
+		buf[0] = version
+		s.client.Write(buf)
+		pdus := [][]byte{}
+		for s.scanner.Scan() {
+			pdus = append(pdus, append([]byte{}, s.scanner.Bytes()...))
+			if s.scanner.Bytes()[1] == rtr.RTR_END_OF_DATA {
+				break
+			}
+		}
+		return pdus
+	}
+	aspas := func(pdus [][]byte) []*rtrASPA {
+		found := []*rtrASPA{}
+		for _, pdu := range pdus {
+			if pdu[1] == rtrASPAType {
+				m := &rtrASPA{}
+				m.DecodeFromBytes(pdu)
+				found = append(found, m)
+			}
+		}
+		return found
+	}
+
+	Context("When a router of version 2 synchronizes", func() {
+		s := connect()
+		defer s.client.Close()
+		pdus := query(s, rtr.NewRTRResetQuery(), 2)
+		It("should send ASPA PDUs after Prefix PDUs", func() {
+			Expect(len(pdus)).To(Equal, 5)
+			Expect(pdus[1][1]).To(Equal, uint8(rtr.RTR_IPV4_PREFIX))
+			Expect(pdus[2][0]).To(Equal, uint8(2))
+			Expect(aspas(pdus)).To(Equal, []*rtrASPA{
+				{Flags: 1, Customer: 65000, Providers: []uint32{65001, 65002}},
+				{Flags: 1, Customer: 65010, Providers: []uint32{65011}},
+			})
+		})
+
+		Context("and then the ASPAs are changed", func() {
+			sn := mgr.CurrentSerial()
+			ioutil.WriteFile(file, []byte(`{"roas":[{"prefix":"192.0.2.0/24","asn":"AS65000"}],"aspas":[{"customer":"AS65000","providers":["AS65001"]}]}`), 0644)
+			mgr.Reload()
+			// Skip Serial Notify PDU
+			s.scanner.Scan()
+			pdus := query(s, rtr.NewRTRSerialQuery(1, sn), 2)
+			It("should send the changed ASPA and the withdrawal", func() {
+				Expect(aspas(pdus)).To(Equal, []*rtrASPA{
+					{Flags: 1, Customer: 65000, Providers: []uint32{65001}},
+					{Flags: 0, Customer: 65010},
+				})
+			})
+		})
+	})
+
+	Context("When a router of version 1 synchronizes", func() {
+		s := connect()
+		defer s.client.Close()
+		pdus := query(s, rtr.NewRTRResetQuery(), 1)
+		It("should not send ASPA PDUs", func() {
+			Expect(len(pdus)).To(Equal, 3)
+			Expect(len(aspas(pdus))).To(Equal, 0)
+		})
+	})
+}
+
+// pipeListener accepts in-memory connections, which are not TCP.
+type pipeListener struct {
+	conns chan net.Conn
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, io.EOF
+	}
+	return conn, nil
+}
+
+func (l *pipeListener) Close() error   { return nil }
+func (l *pipeListener) Addr() net.Addr { return &net.UnixAddr{Name: "pipe", Net: "unix"} }
+
+func TestServeNonTCP(t *testing.T) {
+	f := createFile("TestServeNonTCP", []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	defer removeFile(f)
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{f})
+
+	hook := test.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.DebugLevel)
+	defer logrus.SetLevel(level)
+	commandOpts.SoRcvbuf = 1024 * 1024
+	defer func() { commandOpts.SoRcvbuf = 0 }()
+
+	s := newRTRServer(0)
+	l := &pipeListener{conns: make(chan net.Conn)}
+	defer close(l.conns)
+	defer close(s.stopCh)
+	go s.serve(l)
+	server, client := net.Pipe()
+	defer client.Close()
+	l.conns <- server
+	r := <-s.connCh
+	s.handle(r, mgr)
+
+	Context("When a router connects by a connection other than TCP", func() {
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		buf, _ := rtr.NewRTRResetQuery().Serialize()
+		client.Write(buf)
+		scanner := bufio.NewScanner(client)
+		scanner.Split(rtr.SplitRTR)
+		received := []uint8{}
+		for scanner.Scan() {
+			received = append(received, scanner.Bytes()[1])
+			if scanner.Bytes()[1] == rtr.RTR_END_OF_DATA {
+				break
+			}
+		}
+		skipped := false
+		for _, e := range hook.AllEntries() {
+			skipped = skipped || strings.HasPrefix(e.Message, "Skipped TCP options")
+		}
+		It("should skip the TCP options, and serve the router", func() {
+			Expect(skipped).To(Equal, true)
+			Expect(received).To(Equal, []uint8{rtr.RTR_CACHE_RESPONSE, rtr.RTR_IPV4_PREFIX, rtr.RTR_END_OF_DATA})
 		})
 	})
 }
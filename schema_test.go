@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONSchema(t *testing.T) {
+	assert := assert.New(t)
+
+	schema := &jsonSchema{}
+	err := schema.UnmarshalJSON([]byte(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "maxLength": 4, "pattern": "^[a-z]+$"},
+			"kind": {"enum": ["roa", "aspa"]},
+			"tags": {"type": "array", "minItems": 1, "maxItems": 2, "items": {"type": "string"}},
+			"count": {"type": "integer", "minimum": 1, "maximum": 10}
+		},
+		"additionalProperties": false
+	}`))
+	assert.Nil(err)
+
+	for _, payload := range []string{
+		`{}`,
+		`{"name":"abcd","kind":"roa","tags":["x","y"],"count":10}`,
+		`{"count":1.0}`,
+	} {
+		assert.Nil(schema.validatePayload([]byte(payload)), payload)
+	}
+	for payload, expected := range map[string]string{
+		`[]`:                     "/ is not object",
+		`{"name":""}`:            "/name is shorter than 1",
+		`{"name":"abcde"}`:       "/name is longer than 4",
+		`{"name":"AB"}`:          `/name does not match "^[a-z]+$"`,
+		`{"kind":"rpsl"}`:        "/kind is not any of the enum",
+		`{"tags":[]}`:            "/tags has less than 1 items",
+		`{"tags":["x",1]}`:       "/tags/1 is not string",
+		`{"tags":["x","y","z"]}`: "/tags has more than 2 items",
+		`{"count":1.5}`:          "/count is not integer",
+		`{"count":11}`:           "/count is greater than 10",
+		`{"other":1}`:            "/other is not allowed",
+	} {
+		err := schema.validatePayload([]byte(payload))
+		if assert.NotNil(err, payload) {
+			assert.Equal(expected, err.Error(), payload)
+		}
+	}
+
+	for _, s := range []string{`{"type":1}`, `{"pattern":"("}`} {
+		assert.NotNil((&jsonSchema{}).UnmarshalJSON([]byte(s)), s)
+	}
+}
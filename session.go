@@ -0,0 +1,65 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "sync"
+
+// sessionRegistry keeps track of RTR sessions being handled.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[*rtrConn]struct{}
+}
+
+var sessions = &sessionRegistry{sessions: map[*rtrConn]struct{}{}}
+
+func (s *sessionRegistry) add(r *rtrConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[r] = struct{}{}
+}
+
+func (s *sessionRegistry) remove(r *rtrConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, r)
+}
+
+func (s *sessionRegistry) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+func (s *sessionRegistry) all() []*rtrConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make([]*rtrConn, 0, len(s.sessions))
+	for r := range s.sessions {
+		all = append(all, r)
+	}
+	return all
+}
+
+func (s *sessionRegistry) lookup(remoteAddr string) *rtrConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for r := range s.sessions {
+		if r.remoteAddr.String() == remoteAddr {
+			return r
+		}
+	}
+	return nil
+}
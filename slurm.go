@@ -0,0 +1,85 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+
+	"github.com/osrg/gobgp/pkg/packet/bgp"
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+)
+
+// slurmFile is a SLURM file defined in RFC 8416. Only prefixAssertions are
+// filled, and the other members are empty.
+type slurmFile struct {
+	SlurmVersion            int             `json:"slurmVersion"`
+	ValidationOutputFilters slurmFilters    `json:"validationOutputFilters"`
+	LocallyAddedAssertions  slurmAssertions `json:"locallyAddedAssertions"`
+}
+
+type slurmFilters struct {
+	PrefixFilters []interface{} `json:"prefixFilters"`
+	BgpsecFilters []interface{} `json:"bgpsecFilters"`
+}
+
+type slurmAssertions struct {
+	PrefixAssertions []*slurmPrefixAssertion `json:"prefixAssertions"`
+	BgpsecAssertions []interface{}           `json:"bgpsecAssertions"`
+}
+
+type slurmPrefixAssertion struct {
+	ASN             uint32 `json:"asn"`
+	Prefix          string `json:"prefix"`
+	MaxPrefixLength uint8  `json:"maxPrefixLength,omitempty"`
+}
+
+// newSLURM returns a SLURM file which asserts all announced ROAs in lists.
+func newSLURM(lists FakeROATable) *slurmFile {
+	s := &slurmFile{
+		SlurmVersion: 1,
+		ValidationOutputFilters: slurmFilters{
+			PrefixFilters: []interface{}{},
+			BgpsecFilters: []interface{}{},
+		},
+		LocallyAddedAssertions: slurmAssertions{
+			BgpsecAssertions: []interface{}{},
+		},
+	}
+	s.LocallyAddedAssertions.PrefixAssertions = slurmPrefixAssertions(lists, rtr.ANNOUNCEMENT)
+	return s
+}
+
+// slurmPrefixAssertions returns ROAs in lists with the flag, sorted by prefix.
+func slurmPrefixAssertions(lists FakeROATable, flag uint8) []*slurmPrefixAssertion {
+	assertions := []*slurmPrefixAssertion{}
+	for _, rf := range []bgp.RouteFamily{bgp.RF_IPv4_UC, bgp.RF_IPv6_UC} {
+		bits := net.IPv4len * 8
+		if rf == bgp.RF_IPv6_UC {
+			bits = net.IPv6len * 8
+		}
+		roas := lists[rf][flag]
+		sortFakeROAs(roas, "prefix")
+		for _, v := range roas {
+			prefix := &net.IPNet{IP: v.Prefix, Mask: net.CIDRMask(int(v.PrefixLen), bits)}
+			assertions = append(assertions, &slurmPrefixAssertion{
+				ASN:             v.AS,
+				Prefix:          prefix.String(),
+				MaxPrefixLength: v.MaxLen,
+			})
+		}
+	}
+	return assertions
+}
@@ -0,0 +1,174 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshSubsystem is the name of the SSH subsystem for RTR defined by RFC 6810.
+const sshSubsystem = "rpki-rtr"
+
+// sshHandshakeTimeout limits how long a router may take to finish the SSH
+// handshake and authentication, as tlsHandshakeTimeout does for TLS.
+var sshHandshakeTimeout = tlsHandshakeTimeout
+
+// loadSSHConfig returns the configuration to serve RTR over SSH. Routers
+// authenticate by a public key in the authorized keys file.
+func loadSSHConfig(hostKeyFile, authKeysFile string) (*ssh.ServerConfig, error) {
+	if hostKeyFile == "" || authKeysFile == "" {
+		return nil, errors.New("specify both --ssh-host-key and --ssh-authorized-keys")
+	}
+	pem, err := ioutil.ReadFile(hostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", hostKeyFile, err)
+	}
+
+	buf, err := ioutil.ReadFile(authKeysFile)
+	if err != nil {
+		return nil, err
+	}
+	authKeys := map[string]bool{}
+	for len(bytes.TrimSpace(buf)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", authKeysFile, err)
+		}
+		authKeys[string(key.Marshal())] = true
+		buf = rest
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if authKeys[string(key.Marshal())] {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %q", meta.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+	return config, nil
+}
+
+// sshStream is the rpki-rtr subsystem channel of an SSH connection. The
+// addresses and deadlines are of the underlying TCP connection, so a read
+// deadline closes the whole SSH connection.
+type sshStream struct {
+	net.Conn
+	ch ssh.Channel
+}
+
+func (s *sshStream) Read(b []byte) (int, error) {
+	return s.ch.Read(b)
+}
+
+func (s *sshStream) Write(b []byte) (int, error) {
+	return s.ch.Write(b)
+}
+
+func (s *sshStream) CloseWrite() error {
+	return s.ch.CloseWrite()
+}
+
+func (s *sshStream) Close() error {
+	s.ch.Close()
+	return s.Conn.Close()
+}
+
+func (s *rtrServer) serveSSH(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.stopCh:
+				return
+			default:
+			}
+			continue
+		}
+		if !s.allowed(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		tuneConn(conn)
+		go s.acceptSSH(conn)
+	}
+}
+
+// acceptSSH runs the SSH handshake, and starts an RTR session for each
+// channel requesting the rpki-rtr subsystem.
+func (s *rtrServer) acceptSSH(conn net.Conn) {
+	// A peer which never authenticates would hold the connection forever
+	conn.SetDeadline(time.Now().Add(sshHandshakeTimeout))
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConfig)
+	if err != nil {
+		log.Warnf("SSH handshake with %v failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	log.Infof("SSH connection from %v was authenticated (User: %v)", conn.RemoteAddr(), sconn.User())
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go s.startSubsystem(conn, ch, reqs)
+	}
+}
+
+// startSubsystem waits for the rpki-rtr subsystem request on the channel,
+// and then hands the channel to the RTR session.
+func (s *rtrServer) startSubsystem(conn net.Conn, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		var payload struct{ Name string }
+		if req.Type != "subsystem" || ssh.Unmarshal(req.Payload, &payload) != nil || payload.Name != sshSubsystem {
+			req.Reply(false, nil)
+			continue
+		}
+		if !s.acquire(conn.RemoteAddr()) {
+			req.Reply(false, nil)
+			break
+		}
+		req.Reply(true, nil)
+		go ssh.DiscardRequests(reqs)
+		s.connCh <- &rtrConn{
+			conn:       &sshStream{Conn: conn, ch: ch},
+			sessionId:  s.sessionId,
+			remoteAddr: conn.RemoteAddr(),
+			stopCh:     s.stopCh,
+		}
+		return
+	}
+	ch.Close()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestSSHKey returns a new key, and the file of it in PEM.
+func newTestSSHKey(name string) (ssh.Signer, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalECPrivateKey(key)
+	signer, _ := ssh.NewSignerFromKey(key)
+	return signer, createFile(name, []string{string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))})
+}
+
+func TestLoadSSHConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	_, hostKeyFile := newTestSSHKey("TestLoadSSHConfig")
+	defer removeFile(hostKeyFile)
+	client, _ := newTestSSHKey("TestLoadSSHConfigClient")
+	authKeysFile := createFile("TestLoadSSHConfigKeys", []string{"# routers\n", string(ssh.MarshalAuthorizedKey(client.PublicKey()))})
+	defer removeFile(authKeysFile)
+
+	_, err := loadSSHConfig(hostKeyFile, "")
+	assert.NotNil(err)
+	_, err = loadSSHConfig(authKeysFile, authKeysFile)
+	assert.NotNil(err)
+	_, err = loadSSHConfig(hostKeyFile, hostKeyFile)
+	assert.NotNil(err)
+	config, err := loadSSHConfig(hostKeyFile, authKeysFile)
+	assert.Nil(err)
+	assert.NotNil(config)
+}
+
+func TestSSH(t *testing.T) {
+	assert := assert.New(t)
+
+	host, hostKeyFile := newTestSSHKey("TestSSH")
+	defer removeFile(hostKeyFile)
+	client, _ := newTestSSHKey("TestSSHClient")
+	stranger, _ := newTestSSHKey("TestSSHStranger")
+	authKeysFile := createFile("TestSSHKeys", []string{string(ssh.MarshalAuthorizedKey(client.PublicKey()))})
+	defer removeFile(authKeysFile)
+	file := createFile("TestSSH", []string{"route: 192.168.0.0/24\norigin: AS65000\nsource: TEST\n\n"})
+	defer removeFile(file)
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{file})
+
+	s := newRTRServer(42449)
+	config, err := loadSSHConfig(hostKeyFile, authKeysFile)
+	assert.Nil(err)
+	s.sshConfig = config
+	s.sshPort = 42450
+	go s.run()
+	go func() {
+		for c := range s.connCh {
+			s.handle(c, mgr)
+		}
+	}()
+	defer s.Stop(time.Second)
+
+	dial := func(signer ssh.Signer) (*ssh.Client, error) {
+		for {
+			c, err := ssh.Dial("tcp", "127.0.0.1:42450", &ssh.ClientConfig{
+				User:            "router",
+				Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+				HostKeyCallback: ssh.FixedHostKey(host.PublicKey()),
+			})
+			// Retry until the server starts listening
+			if e, ok := err.(*net.OpError); !ok || e.Op != "dial" {
+				return c, err
+			}
+		}
+	}
+
+	// A router with an unknown key is rejected
+	_, err = dial(stranger)
+	assert.NotNil(err)
+
+	c, err := dial(client)
+	if !assert.Nil(err) {
+		return
+	}
+	defer c.Close()
+	// Other subsystems are refused
+	session, err := c.NewSession()
+	assert.Nil(err)
+	assert.NotNil(session.RequestSubsystem("sftp"))
+
+	session, err = c.NewSession()
+	assert.Nil(err)
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	assert.Nil(session.RequestSubsystem(sshSubsystem))
+	pdu, _ := rtr.NewRTRResetQuery().Serialize()
+	stdin.Write(pdu)
+	scanner := bufio.NewScanner(stdout)
+	scanner.Split(rtr.SplitRTR)
+	types := []uint8{}
+	for scanner.Scan() {
+		types = append(types, scanner.Bytes()[1])
+		if scanner.Bytes()[1] == rtr.RTR_END_OF_DATA {
+			break
+		}
+	}
+	assert.Equal([]uint8{rtr.RTR_CACHE_RESPONSE, rtr.RTR_IPV4_PREFIX, rtr.RTR_END_OF_DATA}, types)
+}
+
+func TestSSHHandshakeTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	_, hostKeyFile := newTestSSHKey("TestSSHHandshakeTimeout")
+	defer removeFile(hostKeyFile)
+	client, _ := newTestSSHKey("TestSSHHandshakeTimeoutClient")
+	authKeysFile := createFile("TestSSHHandshakeTimeoutKeys", []string{string(ssh.MarshalAuthorizedKey(client.PublicKey()))})
+	defer removeFile(authKeysFile)
+	s := newRTRServer(0)
+	config, err := loadSSHConfig(hostKeyFile, authKeysFile)
+	assert.Nil(err)
+	s.sshConfig = config
+
+	timeout := sshHandshakeTimeout
+	sshHandshakeTimeout = 100 * time.Millisecond
+	defer func() { sshHandshakeTimeout = timeout }()
+
+	// A peer which connects and sends nothing
+	server, peer := net.Pipe()
+	defer peer.Close()
+	go ioutil.ReadAll(peer)
+	done := make(chan struct{})
+	go func() {
+		s.acceptSSH(server)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		assert.Fail("the handshake didn't time out")
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/osrg/gobgp/pkg/packet/bgp"
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+	log "github.com/sirupsen/logrus"
+)
+
+// logStats logs a summary of the cache every time tickCh ticks, for
+// environments without any metrics collector.
+func logStats(mgr *ResourceManager, tickCh <-chan time.Time) {
+	var lastSent int64
+	for range tickCh {
+		sent := pdusSent.Value()
+
+		trans := mgr.BeginTransaction()
+		currentSN := trans.CurrentSerial()
+		list := trans.CurrentList()
+		trans.EndTransaction()
+
+		log.Infof("Stats: %d session(s), %d PDU(s) sent, SN: %v, %d IPv4 ROA(s), %d IPv6 ROA(s)",
+			sessions.count(), sent-lastSent, currentSN,
+			len(list[bgp.RF_IPv4_UC][rtr.ANNOUNCEMENT]), len(list[bgp.RF_IPv6_UC][rtr.ANNOUNCEMENT]))
+		lastSent = sent
+	}
+}
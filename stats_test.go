@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogStats(t *testing.T) {
+	assert := assert.New(t)
+
+	rpslFile, _ := ioutil.TempFile(os.TempDir(), "rtr_test.db")
+	defer os.Remove(rpslFile.Name())
+	addRPSL(rpslFile, []string{
+		"route:  192.168.0.0/24\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+		"route6: 2001:db8::/32\n",
+		"origin: AS65000\n",
+		"source: TEST\n",
+		"\n",
+	})
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{rpslFile.Name()})
+
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	// mainLoop in quiet mode may have suppressed logs
+	level := log.GetLevel()
+	log.SetLevel(log.InfoLevel)
+	defer log.SetLevel(level)
+
+	tickCh := make(chan time.Time)
+	done := make(chan struct{})
+	go func() {
+		logStats(mgr, tickCh)
+		close(done)
+	}()
+	tickCh <- time.Now()
+	close(tickCh)
+	<-done
+
+	var stats []string
+	for _, e := range hook.AllEntries() {
+		if strings.HasPrefix(e.Message, "Stats:") {
+			stats = append(stats, e.Message)
+		}
+	}
+	assert.Len(stats, 1)
+	assert.Regexp(`SN: \d+, 1 IPv4 ROA\(s\), 1 IPv6 ROA\(s\)$`, stats[0])
+}
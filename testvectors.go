@@ -0,0 +1,57 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "fmt"
+
+// testVector is a ROA in the built-in dataset served by --test-vectors.
+type testVector struct {
+	prefix string
+	maxLen int
+	asn    uint32
+	note   string
+}
+
+// testVectors are edge cases for conformance testing of routers. They must
+// not be changed, so that the dataset is reproducible across versions.
+var testVectors = []testVector{
+	{"0.0.0.0/0", 0, 64496, "IPv4 shortest prefix"},
+	{"192.0.2.1/32", 32, 64496, "IPv4 host route"},
+	{"192.0.2.0/24", 32, 64496, "IPv4 longest maxLength"},
+	{"198.51.100.0/24", 24, 64497, "maxLength equal to the prefix length"},
+	{"198.51.100.0/24", 24, 64498, "prefix with multiple ASNs"},
+	{"198.51.100.0/22", 23, 64499, "maxLength one longer than the prefix length"},
+	{"203.0.113.0/24", 24, 0, "IPv4 AS0"},
+	{"198.18.0.0/15", 15, 4294967295, "largest 4-byte ASN"},
+	{"::/0", 0, 64496, "IPv6 shortest prefix"},
+	{"2001:db8::1/128", 128, 64496, "IPv6 host route"},
+	{"2001:db8::/32", 128, 64496, "IPv6 longest maxLength"},
+	{"2001:db8:1::/48", 48, 0, "IPv6 AS0"},
+}
+
+// loadTestVectors adds testVectors to the table. They are filtered as ROAs
+// in files are.
+func (rsrc *resource) loadTestVectors(sn uint32) (*resource, error) {
+	rsrc.initTable(sn)
+	for _, v := range testVectors {
+		var err error
+		rsrc, err = rsrc.addValidInfo(sn, fmt.Sprintf("AS%d", v.asn), v.prefix, v.maxLen)
+		if err != nil {
+			return nil, fmt.Errorf("test vector %v (%s): %v", v.prefix, v.note, err)
+		}
+	}
+	return rsrc, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTestVectors(t *testing.T) {
+	assert := assert.New(t)
+	commandOpts.TestVectors = true
+	defer func() { commandOpts.TestVectors = false }()
+
+	// The edge cases documented for conformance testing
+	for _, note := range []string{
+		"IPv4 shortest prefix",
+		"IPv4 host route",
+		"IPv4 longest maxLength",
+		"IPv4 AS0",
+		"IPv6 shortest prefix",
+		"IPv6 host route",
+		"IPv6 longest maxLength",
+		"IPv6 AS0",
+		"largest 4-byte ASN",
+	} {
+		found := false
+		for _, v := range testVectors {
+			found = found || v.note == note
+		}
+		assert.True(found, note)
+	}
+
+	r, err := newResource(nil, false)
+	assert.Nil(err)
+	for _, v := range testVectors {
+		rf, addr, maskLen, _, err := parsePrefix(v.prefix)
+		assert.Nil(err)
+		b, ok := r.table[r.currentSN][rf].Get(generateKey(rf, addr, maskLen))
+		if !assert.True(ok, v.note) {
+			continue
+		}
+		found := false
+		for _, sub := range b.(*prefixResource).values {
+			found = found || int(sub.maxLen) == v.maxLen && containsASN(sub.asns, v.asn)
+		}
+		assert.True(found, v.note)
+	}
+
+	// Stable across loads
+	r2, err := newResource(nil, false)
+	assert.Nil(err)
+	assert.Equal(countPrefixes(r.table[r.currentSN]), countPrefixes(r2.table[r2.currentSN]))
+}
+
+func containsASN(asns []uint32, asn uint32) bool {
+	for _, a := range asns {
+		if a == asn {
+			return true
+		}
+	}
+	return false
+}
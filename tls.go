@@ -0,0 +1,105 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout limits how long a router may take to finish the TLS
+// handshake.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// rtrStream is a connection to a router, over plain TCP or TLS.
+type rtrStream interface {
+	net.Conn
+	CloseWrite() error
+}
+
+// newRTRStream returns conn as rtrStream. A connection which can't be
+// half-closed is closed only as a whole after --close-grace.
+func newRTRStream(conn net.Conn) rtrStream {
+	if s, ok := conn.(rtrStream); ok {
+		return s
+	}
+	return &fullCloseStream{conn}
+}
+
+type fullCloseStream struct {
+	net.Conn
+}
+
+func (s *fullCloseStream) CloseWrite() error {
+	return errHalfClose
+}
+
+var errHalfClose = errors.New("the connection can't be half-closed")
+
+// loadTLSConfig returns the configuration to serve RTR over TLS, or nil if
+// no certificate is given. Routers must present a certificate signed by
+// clientCA if it is given.
+func loadTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCA != "" {
+			return nil, errors.New("--tls-client-ca requires --tls-cert and --tls-key")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("specify both --tls-cert and --tls-key")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCA != "" {
+		pem, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificate found", clientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// handshake finishes the TLS handshake before the session starts, so that a
+// failure, eg. a router without a valid client certificate, is logged as such.
+func (r *rtrConn) handshake() bool {
+	c, ok := r.conn.(*tls.Conn)
+	if !ok {
+		return true
+	}
+	c.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := c.Handshake(); err != nil {
+		r.log().Warnf("TLS handshake with %v failed: %v", r.remoteAddr, err)
+		c.Close()
+		return false
+	}
+	c.SetDeadline(time.Time{})
+	return true
+}
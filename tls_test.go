@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/osrg/gobgp/pkg/packet/rtr"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestCert issues a certificate for 127.0.0.1 signed by parent, or a
+// self-signed CA certificate if parent is nil, and returns it with the
+// files of the certificate and the key.
+func newTestCert(name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile := createFile(name+".crt", []string{string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))})
+	keyFile := createFile(name+".key", []string{string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))})
+	return cert, key, certFile, keyFile
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	ca, _, certFile, keyFile := newTestCert("TestLoadTLSConfig", nil, nil)
+	defer removeFile(certFile)
+	defer removeFile(keyFile)
+
+	config, err := loadTLSConfig("", "", "")
+	assert.Nil(err)
+	assert.Nil(config)
+
+	_, err = loadTLSConfig(certFile, "", "")
+	assert.NotNil(err)
+	_, err = loadTLSConfig("", "", certFile)
+	assert.NotNil(err)
+	_, err = loadTLSConfig(certFile, keyFile, keyFile)
+	assert.NotNil(err)
+
+	config, err = loadTLSConfig(certFile, keyFile, "")
+	assert.Nil(err)
+	assert.Len(config.Certificates, 1)
+	assert.Equal(tls.NoClientCert, config.ClientAuth)
+
+	config, err = loadTLSConfig(certFile, keyFile, certFile)
+	assert.Nil(err)
+	assert.Equal(tls.RequireAndVerifyClientCert, config.ClientAuth)
+	_, err = ca.Verify(x509.VerifyOptions{Roots: config.ClientCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	assert.Nil(err)
+}
+
+func TestTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	ca, caKey, caFile, caKeyFile := newTestCert("TestTLSCA", nil, nil)
+	defer removeFile(caFile)
+	defer removeFile(caKeyFile)
+	_, _, clientFile, clientKeyFile := newTestCert("TestTLSClient", ca, caKey)
+	defer removeFile(clientFile)
+	defer removeFile(clientKeyFile)
+	file := createFile("TestTLS", []string{"route: 192.168.0.0/24\norigin: AS65000\nsource: TEST\n\n"})
+	defer removeFile(file)
+	mgr := NewResourceManager(false)
+	mgr.Load([]string{file})
+
+	// The CA certificate serves as both the server one and the client CA
+	s := newRTRServer(42448)
+	config, err := loadTLSConfig(caFile, caKeyFile, caFile)
+	assert.Nil(err)
+	s.tlsConfig = config
+	go s.run()
+	go func() {
+		for c := range s.connCh {
+			s.handle(c, mgr)
+		}
+	}()
+	defer s.Stop(time.Second)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	resetQuery := func(certs []tls.Certificate) (rtr.RTRMessage, error) {
+		var conn *tls.Conn
+		for {
+			conn, err = tls.Dial("tcp", "127.0.0.1:42448", &tls.Config{RootCAs: roots, Certificates: certs})
+			// Retry until the server starts listening
+			if e, ok := err.(*net.OpError); !ok || e.Op != "dial" {
+				break
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		pdu, _ := rtr.NewRTRResetQuery().Serialize()
+		if _, err := conn.Write(pdu); err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(conn)
+		scanner.Split(rtr.SplitRTR)
+		if !scanner.Scan() {
+			return nil, scanner.Err()
+		}
+		return rtr.ParseRTR(scanner.Bytes())
+	}
+
+	// A router without a client certificate is rejected
+	m, _ := resetQuery(nil)
+	assert.Nil(m)
+
+	cert, err := tls.LoadX509KeyPair(clientFile, clientKeyFile)
+	assert.Nil(err)
+	m, err = resetQuery([]tls.Certificate{cert})
+	assert.Nil(err)
+	assert.IsType(&rtr.RTRCacheResponse{}, m)
+}
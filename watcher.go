@@ -0,0 +1,73 @@
+// Copyright (C) 2015 Eiichiro Watanabe
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// watchFiles sends to ch when any of the files has changed, once the changes
+// have settled for the debounce duration, as editors write in bursts.
+func watchFiles(files []string, debounce time.Duration, ch chan<- bool) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// The directories are watched, as an editor or a validator may replace
+	// a file by renaming a new one
+	names := map[string]bool{}
+	dirs := map[string]bool{}
+	for _, f := range files {
+		names[filepath.Clean(f)] = true
+		dirs[filepath.Dir(f)] = true
+	}
+	for dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer w.Close()
+		var settled <-chan time.Time
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if names[filepath.Clean(ev.Name)] && ev.Op != fsnotify.Chmod {
+					log.Debugf("Detected a change of %v (%v)", ev.Name, ev.Op)
+					settled = time.After(debounce)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Warnf("Could not watch files: %v", err)
+			case <-settled:
+				settled = nil
+				ch <- true
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir(os.TempDir(), "TestWatchFiles")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "roas.json")
+	ioutil.WriteFile(file, []byte(`{"roas":[]}`), 0644)
+	ch := make(chan bool, 10)
+	assert.Nil(watchFiles([]string{file}, 100*time.Millisecond, ch))
+
+	received := func() int {
+		n := 0
+		timeout := time.After(500 * time.Millisecond)
+		for {
+			select {
+			case <-ch:
+				n++
+			case <-timeout:
+				return n
+			}
+		}
+	}
+
+	// Writes in a burst are debounced
+	for i := 0; i < 3; i++ {
+		ioutil.WriteFile(file, []byte(`{"roas":[]}`), 0644)
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(1, received())
+
+	// A file replaced by renaming is detected
+	tmp := filepath.Join(dir, "roas.json.tmp")
+	ioutil.WriteFile(tmp, []byte(`{"roas":[]}`), 0644)
+	os.Rename(tmp, file)
+	assert.Equal(1, received())
+
+	// Other files in the directory are ignored
+	ioutil.WriteFile(filepath.Join(dir, "other.json"), []byte(`{}`), 0644)
+	assert.Equal(0, received())
+}